@@ -0,0 +1,51 @@
+package main
+
+import "fmt"
+
+// box is a mutable cell holding a single value, as in SRFI 111.  Its
+// written representation is `#&` followed by the contents.
+type box struct {
+	v val
+}
+
+func (b *box) pr() string {
+	return printString(b, false)
+}
+
+func (b *box) display() string {
+	return printString(b, true)
+}
+
+func (b *box) equal(other val) bool {
+	return isEqual(b, other)
+}
+
+func boxArg(name string, args []val, i int) *box {
+	b, ok := args[i].(*box)
+	if !ok {
+		panic(fmt.Sprintf("%s: not a box: %s", name, args[i].pr()))
+	}
+	return b
+}
+
+func builtinBox(args []val) val {
+	checkArgCount("box", args, 1, 1)
+	return &box{v: args[0]}
+}
+
+func builtinIsBox(args []val) val {
+	checkArgCount("box?", args, 1, 1)
+	_, ok := args[0].(*box)
+	return boolean{ok}
+}
+
+func builtinUnbox(args []val) val {
+	checkArgCount("unbox", args, 1, 1)
+	return boxArg("unbox", args, 0).v
+}
+
+func builtinSetBox(args []val) val {
+	checkArgCount("set-box!", args, 2, 2)
+	boxArg("set-box!", args, 0).v = args[1]
+	return unspecified{}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+func bytevectorArg(name string, args []val, i int) *bytevector {
+	bv, ok := args[i].(*bytevector)
+	if !ok {
+		panic(fmt.Sprintf("%s: not a bytevector: %s", name, args[i].pr()))
+	}
+	return bv
+}
+
+// byteArg returns an integer argument that must be a byte.
+func byteArg(name string, args []val, i int) byte {
+	n, ok := args[i].(number)
+	if !ok || n.i < 0 || n.i > 255 {
+		panic(fmt.Sprintf("%s: not a byte: %s", name, args[i].pr()))
+	}
+	return byte(n.i)
+}
+
+func builtinBytevector(args []val) val {
+	b := make([]byte, len(args))
+	for i := range args {
+		b[i] = byteArg("bytevector", args, i)
+	}
+	return &bytevector{b: b}
+}
+
+func builtinMakeBytevector(args []val) val {
+	checkArgCount("make-bytevector", args, 1, 2)
+	n := intArg("make-bytevector", args, 0)
+	if n < 0 {
+		panic(fmt.Sprintf("make-bytevector: negative length: %d", n))
+	}
+	var fill byte
+	if len(args) == 2 {
+		fill = byteArg("make-bytevector", args, 1)
+	}
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = fill
+	}
+	return &bytevector{b: b}
+}
+
+func builtinIsBytevector(args []val) val {
+	checkArgCount("bytevector?", args, 1, 1)
+	_, ok := args[0].(*bytevector)
+	return boolean{ok}
+}
+
+func builtinBytevectorLength(args []val) val {
+	checkArgCount("bytevector-length", args, 1, 1)
+	return number{int64(len(bytevectorArg("bytevector-length", args, 0).b))}
+}
+
+func builtinBytevectorU8Ref(args []val) val {
+	checkArgCount("bytevector-u8-ref", args, 2, 2)
+	bv := bytevectorArg("bytevector-u8-ref", args, 0)
+	return number{int64(bv.b[indexArg("bytevector-u8-ref", args, 1, len(bv.b)-1)])}
+}
+
+func builtinBytevectorU8Set(args []val) val {
+	checkArgCount("bytevector-u8-set!", args, 3, 3)
+	bv := bytevectorArg("bytevector-u8-set!", args, 0)
+	i := indexArg("bytevector-u8-set!", args, 1, len(bv.b)-1)
+	bv.b[i] = byteArg("bytevector-u8-set!", args, 2)
+	return unspecified{}
+}
+
+func builtinBytevectorCopy(args []val) val {
+	checkArgCount("bytevector-copy", args, 1, 3)
+	b := bytevectorArg("bytevector-copy", args, 0).b
+	start, end := rangeArgs("bytevector-copy", len(b), args, 1)
+	return &bytevector{b: append([]byte{}, b[start:end]...)}
+}
+
+func builtinBytevectorAppend(args []val) val {
+	b := []byte{}
+	for i := range args {
+		b = append(b, bytevectorArg("bytevector-append", args, i).b...)
+	}
+	return &bytevector{b: b}
+}
+
+func builtinUTF8ToString(args []val) val {
+	checkArgCount("utf8->string", args, 1, 3)
+	b := bytevectorArg("utf8->string", args, 0).b
+	start, end := rangeArgs("utf8->string", len(b), args, 1)
+	if !utf8.Valid(b[start:end]) {
+		panic("utf8->string: invalid UTF-8")
+	}
+	return newStr(string(b[start:end]))
+}
+
+func builtinStringToUTF8(args []val) val {
+	checkArgCount("string->utf8", args, 1, 3)
+	runes := []rune(stringArg("string->utf8", args, 0))
+	start, end := rangeArgs("string->utf8", len(runes), args, 1)
+	return &bytevector{b: []byte(string(runes[start:end]))}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"unicode"
+	"unicode/utf8"
+)
+
+func builtinIsChar(args []val) val {
+	checkArgCount("char?", args, 1, 1)
+	_, ok := args[0].(char)
+	return boolean{ok}
+}
+
+func builtinCharToInteger(args []val) val {
+	checkArgCount("char->integer", args, 1, 1)
+	return number{int64(charArg("char->integer", args, 0))}
+}
+
+func builtinIntegerToChar(args []val) val {
+	checkArgCount("integer->char", args, 1, 1)
+	n := intArg("integer->char", args, 0)
+	if n < 0 || n > unicode.MaxRune || !utf8.ValidRune(rune(n)) {
+		panic(fmt.Sprintf("integer->char: not a Unicode scalar value: %d", n))
+	}
+	return char{rune(n)}
+}
+
+func builtinCharIsAlphabetic(args []val) val {
+	checkArgCount("char-alphabetic?", args, 1, 1)
+	return boolean{unicode.IsLetter(charArg("char-alphabetic?", args, 0))}
+}
+
+func builtinCharIsNumeric(args []val) val {
+	checkArgCount("char-numeric?", args, 1, 1)
+	return boolean{unicode.IsDigit(charArg("char-numeric?", args, 0))}
+}
+
+func builtinCharUpcase(args []val) val {
+	checkArgCount("char-upcase", args, 1, 1)
+	return char{unicode.ToUpper(charArg("char-upcase", args, 0))}
+}
+
+func builtinCharDowncase(args []val) val {
+	checkArgCount("char-downcase", args, 1, 1)
+	return char{unicode.ToLower(charArg("char-downcase", args, 0))}
+}
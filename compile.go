@@ -0,0 +1,546 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// code is the compiled body of a closure: instructions for a stack
+// machine, which the machine executes in execMode.  Each instruction
+// works on a stack of values that belongs to the call of the closure.
+type code struct {
+	instrs []instr
+	// locs holds the location of the form each instruction was
+	// compiled from, which is added to errors.
+	locs   []*srcLoc
+	consts []val
+	sites  []*callSite
+	folds  []*folded
+}
+
+type instr struct {
+	op  opcode
+	arg int
+}
+
+type opcode byte
+
+const (
+	// opConst pushes constant arg.
+	opConst opcode = iota
+	// opLocalRef pushes the value of the variable named by constant
+	// arg, which is bound by one of the lambdas the code was compiled
+	// in.
+	opLocalRef
+	// opGlobalRef pushes the value of the variable named by constant
+	// arg, which is bound outside the compiled lambdas, or defined
+	// when the code runs.
+	opGlobalRef
+	// opOperator pushes the value of the operator of call site arg,
+	// unless it has been defined as a macro since the code was
+	// compiled, in which case the call is evaluated as a form.
+	opOperator
+	// opFunction checks that the value on top is a function.
+	opFunction
+	// opSet assigns the value it pops to the variable named by
+	// constant arg.
+	opSet
+	// opDefine defines the variable named by constant arg as the
+	// value it pops.
+	opDefine
+	// opClosure pushes a closure made from the closure constant arg,
+	// in the current environment.
+	opClosure
+	// opJump continues at instruction arg.
+	opJump
+	// opJumpIfFalse pops a value, and continues at instruction arg if
+	// it's false.
+	opJumpIfFalse
+	// opPop drops the value on top.
+	opPop
+	// opCall applies a function to the arg values above it, and
+	// pushes the result.
+	opCall
+	// opTailCall is like opCall, but returns the result.
+	opTailCall
+	// opReturn returns the value on top.
+	opReturn
+	// opEval evaluates form constant arg, and pushes its value.
+	opEval
+	// opTailEval is like opEval, but returns the value.
+	opTailEval
+	// opFolded pushes the value of folded call arg if it's still
+	// valid, and evaluates the call otherwise.
+	opFolded
+)
+
+// callSite is the place of a call whose operator is a variable.  If
+// the variable turns out to be a macro, form is evaluated instead, and
+// execution continues at after, unless the call is in tail position.
+type callSite struct {
+	name  symbol
+	form  val
+	after int
+	tail  bool
+}
+
+// compiledBody is the code of a closure, which is compiled when it's
+// first called, and shared with the closures made from the same
+// lambda.
+type compiledBody struct {
+	code *code
+}
+
+// compiled returns the code of the body of c.
+func (c *closure) compiled() *code {
+	if c.code.code == nil {
+		c.code.code = compileBody(c, &scope{env: c.env})
+	}
+	return c.code.code
+}
+
+// scope is what the compiler knows about the bindings of variables:
+// the names bound by the frames of the lambdas it's compiling, and
+// the environment of the closure whose body it compiles, which
+// is where the other names are looked up.
+type scope struct {
+	names  map[symbol]bool
+	parent *scope
+	env    env
+}
+
+// local checks whether s is bound by one of the compiled lambdas.
+func (sc *scope) local(s symbol) bool {
+	for ; sc != nil; sc = sc.parent {
+		if sc.names[s] {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns the binding of s at compile time, which is nil for
+// local variables.
+func (sc *scope) lookup(s symbol) (val, bool) {
+	if sc.local(s) {
+		return nil, true
+	}
+	return lookupIdentifier(sc.env, s)
+}
+
+type compiler struct {
+	code  *code
+	scope *scope
+	loc   *srcLoc
+	// dynamic is set once a form that defines macros has been
+	// compiled, since the forms after it might use them.  They are
+	// evaluated as forms from then on.
+	dynamic bool
+}
+
+// compileBody compiles the body of c, whose frame is on top of the
+// environments of sc.
+func compileBody(c *closure, sc *scope) *code {
+	names := map[symbol]bool{}
+	for _, p := range c.params {
+		names[p] = true
+	}
+	for _, o := range append(c.optionals, c.keys...) {
+		names[o.name] = true
+	}
+	if c.variadic {
+		names[c.rest] = true
+	}
+	for _, d := range c.defines {
+		names[d] = true
+	}
+	comp := &compiler{code: &code{}, scope: &scope{names: names, parent: sc, env: sc.env}}
+	comp.compileSeq(c.body, true)
+	return comp.code
+}
+
+func (c *compiler) emit(op opcode, arg int) int {
+	c.code.instrs = append(c.code.instrs, instr{op: op, arg: arg})
+	c.code.locs = append(c.code.locs, c.loc)
+	return len(c.code.instrs) - 1
+}
+
+// patch makes the jump at i continue at the next instruction.
+func (c *compiler) patch(i int) {
+	c.code.instrs[i].arg = len(c.code.instrs)
+}
+
+func (c *compiler) constant(v val) int {
+	c.code.consts = append(c.code.consts, v)
+	return len(c.code.consts) - 1
+}
+
+// ret returns the value on top if the form is in tail position.
+func (c *compiler) ret(tail bool) {
+	if tail {
+		c.emit(opReturn, 0)
+	}
+}
+
+// evalForm compiles x to be evaluated as a form when it's reached.
+func (c *compiler) evalForm(x val, tail bool) {
+	if tail {
+		c.emit(opTailEval, c.constant(x))
+	} else {
+		c.emit(opEval, c.constant(x))
+	}
+}
+
+// compileSeq compiles a non-empty sequence of forms, which leaves the
+// value of the last one.
+func (c *compiler) compileSeq(forms seq, tail bool) {
+	for ; !forms.rest().empty(); forms = forms.rest() {
+		c.compile(forms.first(), false)
+		c.emit(opPop, 0)
+	}
+	c.compile(forms.first(), tail)
+}
+
+// compile compiles x to push its value, or to return it if it's in
+// tail position.  Forms that are invalid are compiled to be evaluated,
+// so that the error is raised when, and only if, they're reached.
+func (c *compiler) compile(x val, tail bool) {
+	if c.dynamic {
+		c.evalForm(x, tail)
+		return
+	}
+	n, loc := len(c.code.instrs), c.loc
+	defer func() {
+		c.loc = loc
+		if r := recover(); r != nil {
+			switch r.(type) {
+			case *continuationInvocation, runtime.Error:
+				panic(r)
+			}
+			c.code.instrs, c.code.locs = c.code.instrs[:n], c.code.locs[:n]
+			c.evalForm(x, tail)
+		}
+	}()
+	if xc, ok := x.(*cons); ok && xc.loc != nil {
+		c.loc = xc.loc
+	}
+	switch xx := x.(type) {
+	case boolean, number, bignum, flonum, rational, *vector, *bytevector, *box, keyword, str, char, function:
+		c.emit(opConst, c.constant(xx))
+		c.ret(tail)
+	case symbol:
+		if c.scope.local(xx) {
+			c.emit(opLocalRef, c.constant(xx))
+		} else {
+			c.emit(opGlobalRef, c.constant(xx))
+		}
+		c.ret(tail)
+	case *cons:
+		if v, deps, ok := c.fold(xx); ok {
+			c.code.folds = append(c.code.folds, &folded{value: v, deps: deps, form: xx, tail: tail})
+			c.emit(opFolded, len(c.code.folds)-1)
+			c.ret(tail)
+			return
+		}
+		c.compileForm(xx, tail)
+	default:
+		c.evalForm(x, tail)
+	}
+}
+
+func (c *compiler) compileForm(x *cons, tail bool) {
+	if head, ok := x.car.(symbol); ok {
+		// Keywords that are bound as variables are just that.
+		binding, bound := c.scope.lookup(head)
+		if t, ok := binding.(transformer); ok {
+			c.compile(t.expand(x), tail)
+			return
+		}
+		if !bound {
+			name := unalias(head).(symbol).name
+			switch name {
+			case "if":
+				items := subforms("if", x.rest(), 2, 3)
+				if test, deps, ok := c.constantValue(items[0]); ok && len(deps) == 0 {
+					// Only the branch that's taken is compiled.
+					switch {
+					case isTrue(test):
+						c.compile(items[1], tail)
+					case len(items) == 3:
+						c.compile(items[2], tail)
+					default:
+						c.emit(opConst, c.constant(unspecified{}))
+						c.ret(tail)
+					}
+					return
+				}
+				c.compile(items[0], false)
+				jumpToAlternative := c.emit(opJumpIfFalse, 0)
+				c.compile(items[1], tail)
+				jumpToEnd := -1
+				if !tail {
+					jumpToEnd = c.emit(opJump, 0)
+				}
+				c.patch(jumpToAlternative)
+				if len(items) == 3 {
+					c.compile(items[2], tail)
+				} else {
+					c.emit(opConst, c.constant(unspecified{}))
+					c.ret(tail)
+				}
+				if jumpToEnd >= 0 {
+					c.patch(jumpToEnd)
+				}
+				return
+			case "quote":
+				c.emit(opConst, c.constant(subforms("quote", x.rest(), 1, 1)[0]))
+				c.ret(tail)
+				return
+			case "begin":
+				if len(subforms("begin", x.rest(), 0, -1)) == 0 {
+					c.emit(opConst, c.constant(unspecified{}))
+					c.ret(tail)
+					return
+				}
+				c.compileSeq(x.rest(), tail)
+				return
+			case "define":
+				c.compileDefine(x.rest())
+				c.ret(tail)
+				return
+			case "set!":
+				items := subforms("set!", x.rest(), 2, 2)
+				name, ok := items[0].(symbol)
+				if !ok {
+					panic(fmt.Sprintf("set!: invalid name %s", items[0].pr()))
+				}
+				c.compile(items[1], false)
+				c.emit(opSet, c.constant(name))
+				c.ret(tail)
+				return
+			case "lambda":
+				c.compileLambda(x.rest(), "")
+				c.ret(tail)
+				return
+			case "define-syntax", "define-macro", "defmacro":
+				c.evalForm(x, tail)
+				c.dynamic = true
+				return
+			case "delay", "delay-force", "parameterize", "define-record-type", "let-syntax", "letrec-syntax":
+				c.evalForm(x, tail)
+				return
+			}
+			if expand, ok := derivedForms[name]; ok {
+				c.compile(expand(x), tail)
+				return
+			}
+		}
+	}
+	if !isList(x.cdr) {
+		panic(fmt.Sprintf("improper list of arguments %s", x.cdr.pr()))
+	}
+	var site *callSite
+	if head, ok := x.car.(symbol); ok && !c.scope.local(head) {
+		site = &callSite{name: head, form: x, tail: tail}
+		c.code.sites = append(c.code.sites, site)
+		c.emit(opOperator, len(c.code.sites)-1)
+	} else {
+		c.compile(x.car, false)
+		c.emit(opFunction, 0)
+	}
+	args := seqToSlice(x.rest())
+	for _, arg := range args {
+		c.compile(arg, false)
+	}
+	if tail {
+		c.emit(opTailCall, len(args))
+	} else {
+		c.emit(opCall, len(args))
+	}
+	if site != nil {
+		site.after = len(c.code.instrs)
+	}
+}
+
+// compileDefine compiles the operands of a `define`.
+func (c *compiler) compileDefine(forms seq) {
+	if forms.empty() {
+		panic("define: missing name")
+	}
+	switch target := forms.first().(type) {
+	case symbol:
+		if forms.rest().empty() || !forms.rest().rest().empty() {
+			panic(fmt.Sprintf("define: expected one value for %s", target.name))
+		}
+		value := forms.rest().first()
+		if vc, ok := value.(*cons); ok && isSymbolNamed(vc.car, "lambda") {
+			if _, bound := c.scope.lookup(vc.car.(symbol)); !bound {
+				if vc.loc != nil {
+					c.loc = vc.loc
+				}
+				c.compileLambda(vc.rest(), target.name)
+				c.emit(opDefine, c.constant(target))
+				return
+			}
+		}
+		c.compile(value, false)
+		c.emit(opDefine, c.constant(target))
+	case *cons:
+		name, ok := target.car.(symbol)
+		if !ok {
+			panic(fmt.Sprintf("define: invalid name %s", target.car.pr()))
+		}
+		c.compileLambda(&cons{car: target.cdr, cdr: forms.rest()}, name.name)
+		c.emit(opDefine, c.constant(name))
+	default:
+		panic(fmt.Sprintf("define: invalid name %s", target.pr()))
+	}
+}
+
+// compileLambda compiles the operands of a `lambda` to a closure with
+// the given name, whose body is compiled right away.
+func (c *compiler) compileLambda(forms seq, name string) {
+	cl := evalLambda(nil, forms).(*closure)
+	cl.name = name
+	cl.code.code = compileBody(cl, c.scope)
+	c.emit(opClosure, c.constant(cl))
+}
+
+// exec executes the code of the machine until it calls, returns or
+// evaluates a form.
+func (m *machine) exec() {
+	c, e := m.code, m.env
+	for {
+		in := c.instrs[m.pc]
+		m.loc = c.locs[m.pc]
+		m.pc++
+		switch in.op {
+		case opConst:
+			m.vals = append(m.vals, c.consts[in.arg])
+		case opLocalRef:
+			s := c.consts[in.arg].(symbol)
+			v, ok := e.lookup(s)
+			m.vals = append(m.vals, variableValue(s, v, ok))
+		case opGlobalRef:
+			s := c.consts[in.arg].(symbol)
+			v, ok := lookupIdentifier(e, s)
+			m.vals = append(m.vals, variableValue(s, v, ok))
+		case opOperator:
+			site := c.sites[in.arg]
+			v, ok := lookupIdentifier(e, site.name)
+			if _, isMacro := v.(transformer); isMacro {
+				if !site.tail {
+					m.pc = site.after
+					m.push(&codeFrame{code: c, pc: m.pc, env: e, vals: m.vals})
+				}
+				m.vals = nil
+				m.eval(e, site.form)
+				return
+			}
+			m.vals = append(m.vals, operator(variableValue(site.name, v, ok)))
+		case opFunction:
+			m.vals[len(m.vals)-1] = operator(single(m.vals[len(m.vals)-1]))
+		case opSet:
+			s := c.consts[in.arg].(symbol)
+			if !setIdentifier(e, s, single(m.vals[len(m.vals)-1])) {
+				panic(fmt.Sprintf("set!: unbound %s", unalias(s).pr()))
+			}
+			m.vals[len(m.vals)-1] = unspecified{}
+		case opDefine:
+			e.define(c.consts[in.arg].(symbol), single(m.vals[len(m.vals)-1]))
+			m.vals[len(m.vals)-1] = unspecified{}
+		case opClosure:
+			cl := *c.consts[in.arg].(*closure)
+			cl.env = e
+			m.vals = append(m.vals, &cl)
+		case opJump:
+			m.pc = in.arg
+		case opJumpIfFalse:
+			v := m.vals[len(m.vals)-1]
+			m.vals = m.vals[:len(m.vals)-1]
+			if !isTrue(single(v)) {
+				m.pc = in.arg
+			}
+		case opPop:
+			m.vals = m.vals[:len(m.vals)-1]
+		case opCall, opTailCall:
+			n := len(m.vals) - in.arg
+			f := m.vals[n-1].(function)
+			args := make([]val, in.arg)
+			for i, arg := range m.vals[n:] {
+				args[i] = single(arg)
+			}
+			if in.op == opCall {
+				m.push(&codeFrame{code: c, pc: m.pc, env: e, vals: m.vals[:n-1]})
+			}
+			m.vals = nil
+			m.apply(f, args)
+			return
+		case opReturn:
+			v := m.vals[len(m.vals)-1]
+			m.vals = nil
+			m.ret(v)
+			return
+		case opEval:
+			m.push(&codeFrame{code: c, pc: m.pc, env: e, vals: m.vals})
+			m.vals = nil
+			m.eval(e, c.consts[in.arg])
+			return
+		case opTailEval:
+			m.vals = nil
+			m.eval(e, c.consts[in.arg])
+			return
+		case opFolded:
+			f := c.folds[in.arg]
+			if f.valid(e) {
+				m.vals = append(m.vals, f.value)
+				continue
+			}
+			if !f.tail {
+				m.push(&codeFrame{code: c, pc: m.pc, env: e, vals: m.vals})
+			}
+			m.vals = nil
+			m.eval(e, f.form)
+			return
+		}
+	}
+}
+
+// variableValue returns the value v of the variable s, which is bound
+// if ok.
+func variableValue(s symbol, v val, ok bool) val {
+	if !ok {
+		panic(fmt.Sprintf("unbound %s", unalias(s).pr()))
+	}
+	switch v.(type) {
+	case unassigned:
+		panic(fmt.Sprintf("%s used before its initialization", unalias(s).pr()))
+	case transformer:
+		panic(fmt.Sprintf("invalid use of macro %s", unalias(s).pr()))
+	}
+	return v
+}
+
+// operator checks that v is a function to apply.
+func operator(v val) val {
+	if _, ok := v.(function); !ok {
+		panic(fmt.Sprintf("cannot apply non-function %s", v.pr()))
+	}
+	return v
+}
+
+// codeFrame continues executing code after a call returns, with the
+// value pushed on the stack of values.
+type codeFrame struct {
+	code *code
+	pc   int
+	env  env
+	vals []val
+}
+
+func (f *codeFrame) resume(m *machine, v val) {
+	m.mode, m.code, m.pc, m.env = execMode, f.code, f.pc, f.env
+	// The values are copied, because a continuation might resume f
+	// again.
+	m.vals = append(f.vals[:len(f.vals):len(f.vals)], v)
+}
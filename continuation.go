@@ -0,0 +1,126 @@
+package main
+
+// continuation is a continuation, as created by `call/cc`: a copy of
+// the stack of the machine that created it, together with the dynamic
+// state.  Invoking it in that machine replaces the machine's stack with
+// the copy, after leaving and entering the dynamic extents in between,
+// so continuations can be invoked any number of times.  Invoking it
+// anywhere else unwinds the Go stack back to its machine by panicking.
+// If its machine isn't running anymore, the continuation is resumed in
+// the outermost running machine instead, like the continuation of an
+// earlier form at a REPL.
+type continuation struct {
+	m        *machine
+	stack    []stackEntry
+	winds    *wind
+	handlers []function
+}
+
+// continuationInvocation is panicked to unwind the stack when a
+// continuation is invoked outside of its machine.
+type continuationInvocation struct {
+	k    *continuation
+	vals []val
+}
+
+func (k *continuation) pr() string {
+	return "#<continuation>"
+}
+
+func (k *continuation) equal(other val) bool {
+	return k == other
+}
+
+func (k *continuation) procedureName() string {
+	return ""
+}
+
+func (k *continuation) procedureArity() arity {
+	return arity{0, -1}
+}
+
+func (k *continuation) call(args []val) val {
+	return callInMachine(k, args)
+}
+
+// target returns the machine that k resumes in.
+func (k *continuation) target() *machine {
+	if k.m.running {
+		return k.m
+	}
+	return runningMachines[0]
+}
+
+func (k *continuation) invoke(m *machine, args []val) {
+	if k.target() != m {
+		panic(&continuationInvocation{k: k, vals: append([]val{}, args...)})
+	}
+	m.resumeContinuation(k, args)
+}
+
+// capture returns the continuation of the current step of m.
+func (m *machine) capture() *continuation {
+	return &continuation{m: m, stack: append([]stackEntry{}, m.stack...), winds: winds, handlers: handlers}
+}
+
+func (m *machine) resumeContinuation(k *continuation, vals []val) {
+	rewind(k.winds)
+	handlers = k.handlers
+	m.setStack(append([]stackEntry{}, k.stack...))
+	m.loc = nil
+	m.ret(makeValues(vals))
+}
+
+func builtinCallCC(m *machine, args []val) {
+	f := functionArg("call-with-current-continuation", args, 0)
+	m.apply(f, []val{m.capture()})
+}
+
+// builtinDynamicWind calls the before thunk, then the thunk, and then
+// the after thunk.  If the thunk is left by invoking a continuation or
+// by an error, the after thunk is called, too, and if it's entered
+// again by invoking a continuation, so is the before thunk.
+func builtinDynamicWind(m *machine, args []val) {
+	before := functionArg("dynamic-wind", args, 0)
+	thunk := functionArg("dynamic-wind", args, 1)
+	after := functionArg("dynamic-wind", args, 2)
+	m.enter(newWind(func() { before.call(nil) }, func() { after.call(nil) }))
+	m.apply(thunk, nil)
+}
+
+// dynamicWind is used by the expansion of `fluid-let`.
+var dynamicWind = builtin{name: "dynamic-wind", control: builtinDynamicWind, min: 3, max: 3}
+
+// expandFluidLet expands
+//
+//	(fluid-let ((name value) ...) body ...)
+//
+// into
+//
+//	(let ((temp value) ...)
+//	  (define (swap) (let ((old name) ...) (set! name temp) ... (set! temp old) ...))
+//	  (dynamic-wind swap (lambda () body ...) swap))
+//
+// so that the variables, which must already be bound, have the new
+// values during the body and get their old values back when it's
+// left, however that happens.
+func expandFluidLet(form *cons) val {
+	items := syntaxItems("fluid-let", form, 3)
+	names, inits := parseBindings("fluid-let", items[1])
+	temps, olds := []val{}, []val{}
+	lets, saves, sets, restores := []val{}, []val{}, []val{}, []val{}
+	for i, n := range names {
+		temps = append(temps, newTemp())
+		olds = append(olds, newTemp())
+		lets = append(lets, list(temps[i], inits[i]))
+		saves = append(saves, list(olds[i], n))
+		sets = append(sets, list(core("set!"), n, temps[i]))
+		restores = append(restores, list(core("set!"), temps[i], olds[i]))
+	}
+	swap := newTemp()
+	swapBody := &cons{car: core("let"), cdr: &cons{car: list(saves...), cdr: list(append(append(sets, restores...), list(core("quote"), unspecified{}))...)}}
+	define := list(core("define"), swap, list(core("lambda"), empty{}, swapBody))
+	body := &cons{car: core("lambda"), cdr: &cons{car: empty{}, cdr: list(items[2:]...)}}
+	wind := callValue(dynamicWind, swap, body, swap)
+	return &cons{car: core("let"), cdr: list(list(lets...), define, wind), loc: form.loc}
+}
@@ -0,0 +1,454 @@
+package main
+
+import "fmt"
+
+// derivedForms maps the names of derived expression types to
+// functions that expand them into simpler forms.  A derived form is
+// evaluated by evaluating its expansion, so the evaluator proper only
+// has to deal with the primitive special forms.
+var derivedForms map[string]func(form *cons) val
+
+func init() {
+	derivedForms = map[string]func(form *cons) val{
+		"let":     expandLet,
+		"let*":    expandLetStar,
+		"letrec":  expandLetrec,
+		"letrec*": expandLetrec,
+		"cond":    expandCond,
+		"case":    expandCase,
+		"and":     expandAnd,
+		"or":      expandOr,
+		"when":    expandWhen,
+		"unless":  expandWhen,
+		"do":      expandDo,
+
+		"let-values":    expandLetValues,
+		"let*-values":   expandLetStarValues,
+		"define-values": expandDefineValues,
+		"guard":         expandGuard,
+		"assert":        expandAssert,
+		"fluid-let":     expandFluidLet,
+
+		"quasiquote": expandQuasiquote,
+	}
+}
+
+// unassigned is the value of letrec variables before their
+// initialization.
+type unassigned struct{}
+
+func (unassigned) pr() string {
+	return "#<unassigned>"
+}
+
+func (unassigned) equal(other val) bool {
+	_, ok := other.(unassigned)
+	return ok
+}
+
+// tempCounter numbers the temporary variables made by newTemp.
+var tempCounter int
+
+// newTemp returns a fresh symbol for a temporary variable in an
+// expansion.  Its name contains a space, so it can't clash with
+// variables in the user's code.
+func newTemp() symbol {
+	tempCounter++
+	return symbol{name: fmt.Sprintf(" t%d", tempCounter)}
+}
+
+// syntaxItems returns the items of a list that's part of a special
+// form, which must have at least min items.
+func syntaxItems(name string, v val, min int) []val {
+	if !isList(v) {
+		panic(fmt.Sprintf("%s: invalid syntax %s", name, v.pr()))
+	}
+	items := seqToSlice(v.(seq))
+	if len(items) < min {
+		panic(fmt.Sprintf("%s: invalid syntax %s", name, v.pr()))
+	}
+	return items
+}
+
+// parseBindings parses a list of `(name init)` bindings.
+func parseBindings(name string, v val) ([]val, []val) {
+	names, inits := []val{}, []val{}
+	for _, b := range syntaxItems(name, v, 0) {
+		if !isList(b) {
+			panic(fmt.Sprintf("%s: invalid binding %s", name, b.pr()))
+		}
+		items := seqToSlice(b.(seq))
+		if len(items) != 2 {
+			panic(fmt.Sprintf("%s: invalid binding %s", name, b.pr()))
+		}
+		if _, ok := items[0].(symbol); !ok {
+			panic(fmt.Sprintf("%s: invalid binding %s", name, b.pr()))
+		}
+		names = append(names, items[0])
+		inits = append(inits, items[1])
+	}
+	return names, inits
+}
+
+// expandLet expands
+//
+//	(let ((name init) ...) body ...)
+//
+// into
+//
+//	((lambda (name ...) body ...) init ...)
+//
+// and the named let
+//
+//	(let loop ((name init) ...) body ...)
+//
+// into
+//
+//	((letrec ((loop (lambda (name ...) body ...))) loop) init ...)
+func expandLet(form *cons) val {
+	items := syntaxItems("let", form, 3)
+	if loop, ok := items[1].(symbol); ok {
+		if len(items) < 4 {
+			panic(fmt.Sprintf("let: invalid syntax %s", form.pr()))
+		}
+		names, inits := parseBindings("let", items[2])
+		lambda := &cons{car: core("lambda"), cdr: &cons{car: list(names...), cdr: list(items[3:]...)}}
+		letrec := list(core("letrec"), list(list(loop, lambda)), loop)
+		return &cons{car: letrec, cdr: list(inits...), loc: form.loc}
+	}
+	names, inits := parseBindings("let", items[1])
+	lambda := &cons{car: core("lambda"), cdr: &cons{car: list(names...), cdr: list(items[2:]...)}}
+	return &cons{car: lambda, cdr: list(inits...), loc: form.loc}
+}
+
+// expandLetStar expands `let*` into nested `let`s.
+func expandLetStar(form *cons) val {
+	items := syntaxItems("let*", form, 3)
+	bindings := syntaxItems("let*", items[1], 0)
+	parseBindings("let*", items[1])
+	body := list(items[2:]...)
+	if len(bindings) == 0 {
+		return &cons{car: core("let"), cdr: &cons{car: empty{}, cdr: body}, loc: form.loc}
+	}
+	var result val
+	for i := len(bindings) - 1; i >= 0; i-- {
+		result = &cons{car: core("let"), cdr: &cons{car: list(bindings[i]), cdr: body}, loc: form.loc}
+		body = list(result)
+	}
+	return result
+}
+
+// expandLetrec expands `letrec` and `letrec*` into
+//
+//	(let ((name '#<unassigned>) ...)
+//	  (set! name init) ...
+//	  (let () body ...))
+//
+// Since the variables are initialized in order, this implements the
+// semantics of `letrec*`, which are also valid for `letrec`.  Using a
+// variable before it's initialized is an error.
+func expandLetrec(form *cons) val {
+	name := unalias(form.car).(symbol).name
+	items := syntaxItems(name, form, 3)
+	names, inits := parseBindings(name, items[1])
+	bindings := []val{}
+	sets := []val{}
+	for i, n := range names {
+		bindings = append(bindings, list(n, list(core("quote"), unassigned{})))
+		sets = append(sets, list(core("set!"), n, inits[i]))
+	}
+	inner := &cons{car: core("let"), cdr: &cons{car: empty{}, cdr: list(items[2:]...)}}
+	body := list(append(sets, inner)...)
+	return &cons{car: core("let"), cdr: &cons{car: list(bindings...), cdr: body}, loc: form.loc}
+}
+
+// expandCond expands `cond` into nested `if`s.  A clause
+// `(test => receiver)` calls receiver with the value of test if it's
+// true, and a clause `(test)` returns the value of test.  If no clause
+// applies, the result is unspecified.
+func expandCond(form *cons) val {
+	clauses := syntaxItems("cond", form, 1)[1:]
+	var result val = list(core("quote"), unspecified{})
+	for i := len(clauses) - 1; i >= 0; i-- {
+		clause := syntaxItems("cond", clauses[i], 1)
+		if isSymbolNamed(clause[0], "else") {
+			if i != len(clauses)-1 || len(clause) < 2 {
+				panic(fmt.Sprintf("cond: invalid else clause %s", clauses[i].pr()))
+			}
+			result = &cons{car: core("begin"), cdr: list(clause[1:]...)}
+			continue
+		}
+		switch {
+		case len(clause) == 1:
+			t := newTemp()
+			result = list(core("let"), list(list(t, clause[0])), list(core("if"), t, t, result))
+		case isSymbolNamed(clause[1], "=>"):
+			if len(clause) != 3 {
+				panic(fmt.Sprintf("cond: invalid => clause %s", clauses[i].pr()))
+			}
+			t := newTemp()
+			result = list(core("let"), list(list(t, clause[0])), list(core("if"), t, list(clause[2], t), result))
+		default:
+			result = list(core("if"), clause[0], &cons{car: core("begin"), cdr: list(clause[1:]...)}, result)
+		}
+	}
+	if c, ok := result.(*cons); ok {
+		c.loc = form.loc
+	}
+	return result
+}
+
+// caseMatch is used by the expansion of `case` to check whether the
+// key is in the datum list of a clause.  It's put into the expansion
+// as a value, so it can't be shadowed.
+var caseMatch = builtin{name: "case-match", min: 2, max: 2, f: func(args []val) val {
+	for _, datum := range seqToSlice(args[1].(seq)) {
+		if eqv(args[0], datum) {
+			return boolean{true}
+		}
+	}
+	return boolean{false}
+}}
+
+// expandCase expands
+//
+//	(case key ((datum ...) body ...) ... (else body ...))
+//
+// into a `cond` on the key, which is only evaluated once.  Instead
+// of a body, a clause can have `=> receiver`, to call receiver with
+// the key.
+func expandCase(form *cons) val {
+	items := syntaxItems("case", form, 2)
+	key := newTemp()
+	clauses := []val{}
+	for i, c := range items[2:] {
+		clause := syntaxItems("case", c, 2)
+		var test val
+		if isSymbolNamed(clause[0], "else") {
+			if i != len(items)-3 {
+				panic(fmt.Sprintf("case: invalid else clause %s", c.pr()))
+			}
+			test = core("else")
+		} else {
+			if !isList(clause[0]) {
+				panic(fmt.Sprintf("case: invalid clause %s", c.pr()))
+			}
+			test = list(list(core("quote"), caseMatch), key, list(core("quote"), clause[0]))
+		}
+		body := clause[1:]
+		if isSymbolNamed(body[0], "=>") {
+			if len(body) != 2 {
+				panic(fmt.Sprintf("case: invalid => clause %s", c.pr()))
+			}
+			body = []val{list(body[1], key)}
+		}
+		clauses = append(clauses, &cons{car: test, cdr: list(body...)})
+	}
+	cond := &cons{car: core("cond"), cdr: list(clauses...)}
+	return &cons{car: core("let"), cdr: list(list(list(key, items[1])), cond), loc: form.loc}
+}
+
+// expandAnd expands `and` into nested `if`s.
+func expandAnd(form *cons) val {
+	items := syntaxItems("and", form, 1)[1:]
+	switch len(items) {
+	case 0:
+		return boolean{true}
+	case 1:
+		return items[0]
+	}
+	rest := &cons{car: core("and"), cdr: list(items[1:]...)}
+	return &cons{car: core("if"), cdr: list(items[0], rest, boolean{false}), loc: form.loc}
+}
+
+// expandOr expands `or` into nested `if`s, binding the value of each
+// test to a temporary, so it's only evaluated once.
+func expandOr(form *cons) val {
+	items := syntaxItems("or", form, 1)[1:]
+	switch len(items) {
+	case 0:
+		return boolean{false}
+	case 1:
+		return items[0]
+	}
+	t := newTemp()
+	rest := &cons{car: core("or"), cdr: list(items[1:]...)}
+	return &cons{car: core("let"), cdr: list(list(list(t, items[0])), list(core("if"), t, t, rest)), loc: form.loc}
+}
+
+// expandWhen expands `when` and `unless` into an `if` whose other
+// branch is unspecified.
+func expandWhen(form *cons) val {
+	name := unalias(form.car).(symbol).name
+	items := syntaxItems(name, form, 3)
+	body := &cons{car: core("begin"), cdr: list(items[2:]...)}
+	var nothing val = list(core("quote"), unspecified{})
+	if name == "unless" {
+		return &cons{car: core("if"), cdr: list(items[1], nothing, body), loc: form.loc}
+	}
+	return &cons{car: core("if"), cdr: list(items[1], body, nothing), loc: form.loc}
+}
+
+// expandDo expands
+//
+//	(do ((var init step) ...) (test expr ...) command ...)
+//
+// into the loop
+//
+//	(let loop ((var init) ...)
+//	  (if test
+//	      (begin expr ...)
+//	      (begin command ... (loop step ...))))
+//
+// A variable without a step keeps its value.
+func expandDo(form *cons) val {
+	items := syntaxItems("do", form, 3)
+	bindings, steps := []val{}, []val{}
+	for _, spec := range syntaxItems("do", items[1], 0) {
+		specItems := syntaxItems("do", spec, 2)
+		if _, ok := specItems[0].(symbol); !ok || len(specItems) > 3 {
+			panic(fmt.Sprintf("do: invalid variable spec %s", spec.pr()))
+		}
+		bindings = append(bindings, list(specItems[0], specItems[1]))
+		if len(specItems) == 3 {
+			steps = append(steps, specItems[2])
+		} else {
+			steps = append(steps, specItems[0])
+		}
+	}
+	exit := syntaxItems("do", items[2], 1)
+	var result val = list(core("quote"), unspecified{})
+	if len(exit) > 1 {
+		result = &cons{car: core("begin"), cdr: list(exit[1:]...)}
+	}
+	loop := newTemp()
+	commands := append(append([]val{}, items[3:]...), &cons{car: loop, cdr: list(steps...)})
+	body := list(core("if"), exit[0], result, &cons{car: core("begin"), cdr: list(commands...)})
+	return &cons{car: core("let"), cdr: list(loop, list(bindings...), body), loc: form.loc}
+}
+
+// callWithValues is used by the expansions of the multiple-value
+// binding forms.
+var callWithValues = builtin{name: "call-with-values", control: builtinCallWithValues, min: 2, max: 2}
+
+// renameFormals parses the formals of a multiple-value binding, which
+// are a list of names, possibly with a rest name as its dotted tail,
+// or a single rest name.  It returns the formals with each name
+// replaced by a temporary, as well as the names and their temporaries.
+func renameFormals(name string, formals val) (val, []val, []val) {
+	names, temps := []val{}, []val{}
+	seen := map[symbol]bool{}
+	var rename func(v val) val
+	rename = func(v val) val {
+		switch v := v.(type) {
+		case empty:
+			return v
+		case symbol:
+			if seen[v] {
+				panic(fmt.Sprintf("%s: duplicate name %s", name, v.name))
+			}
+			seen[v] = true
+			t := newTemp()
+			names = append(names, v)
+			temps = append(temps, t)
+			return t
+		case *cons:
+			if _, ok := v.car.(symbol); ok {
+				car := rename(v.car)
+				return &cons{car: car, cdr: rename(v.cdr)}
+			}
+		}
+		panic(fmt.Sprintf("%s: invalid formals %s", name, formals.pr()))
+	}
+	return rename(formals), names, temps
+}
+
+// expandLetValues expands
+//
+//	(let-values ((formals init) ...) body ...)
+//
+// into
+//
+//	(call-with-values (lambda () init)
+//	  (lambda temps
+//	    ...
+//	      (let ((name temp) ...) body ...)))
+//
+// where temps are the formals with the names replaced by temporaries,
+// so that the inits don't see the variables bound by the other
+// bindings.
+func expandLetValues(form *cons) val {
+	name := unalias(form.car).(symbol).name
+	items := syntaxItems(name, form, 3)
+	specs := syntaxItems(name, items[1], 0)
+	type binding struct {
+		init  val
+		temps val
+	}
+	bindings := []binding{}
+	lets := []val{}
+	for _, spec := range specs {
+		specItems := syntaxItems(name, spec, 2)
+		if len(specItems) != 2 {
+			panic(fmt.Sprintf("%s: invalid binding %s", name, spec.pr()))
+		}
+		renamed, names, temps := renameFormals(name, specItems[0])
+		bindings = append(bindings, binding{init: specItems[1], temps: renamed})
+		for i, n := range names {
+			lets = append(lets, list(n, temps[i]))
+		}
+	}
+	var result val = &cons{car: core("let"), cdr: &cons{car: list(lets...), cdr: list(items[2:]...)}}
+	for i := len(bindings) - 1; i >= 0; i-- {
+		producer := list(core("lambda"), empty{}, bindings[i].init)
+		consumer := list(core("lambda"), bindings[i].temps, result)
+		result = callValue(callWithValues, producer, consumer)
+	}
+	result.(*cons).loc = form.loc
+	return result
+}
+
+// expandLetStarValues expands `let*-values` into nested
+// `let-values`.
+func expandLetStarValues(form *cons) val {
+	items := syntaxItems("let*-values", form, 3)
+	specs := syntaxItems("let*-values", items[1], 0)
+	body := list(items[2:]...)
+	if len(specs) == 0 {
+		return &cons{car: core("let"), cdr: &cons{car: empty{}, cdr: body}, loc: form.loc}
+	}
+	var result val
+	for i := len(specs) - 1; i >= 0; i-- {
+		result = &cons{car: core("let-values"), cdr: &cons{car: list(specs[i]), cdr: body}, loc: form.loc}
+		body = list(result)
+	}
+	return result
+}
+
+// expandDefineValues expands
+//
+//	(define-values formals expr)
+//
+// into
+//
+//	(begin
+//	  (define name '#<unassigned>) ...
+//	  (call-with-values (lambda () expr)
+//	    (lambda temps (set! name temp) ... '#<unspecified>)))
+func expandDefineValues(form *cons) val {
+	items := syntaxItems("define-values", form, 3)
+	if len(items) != 3 {
+		panic(fmt.Sprintf("define-values: invalid syntax %s", form.pr()))
+	}
+	renamed, names, temps := renameFormals("define-values", items[1])
+	nothing := list(core("quote"), unspecified{})
+	defines, sets := []val{}, []val{}
+	for i, n := range names {
+		defines = append(defines, list(core("define"), n, list(core("quote"), unassigned{})))
+		sets = append(sets, list(core("set!"), n, temps[i]))
+	}
+	producer := list(core("lambda"), empty{}, items[2])
+	consumer := &cons{car: core("lambda"), cdr: &cons{car: renamed, cdr: list(append(sets, nothing)...)}}
+	body := append(defines, callValue(callWithValues, producer, consumer))
+	return &cons{car: core("begin"), cdr: list(body...), loc: form.loc}
+}
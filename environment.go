@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// environment is an environment as a first-class value.
+type environment struct {
+	e env
+}
+
+func (env *environment) pr() string {
+	return "#<environment>"
+}
+
+func (env *environment) equal(other val) bool {
+	return env == other
+}
+
+func environmentArg(name string, args []val, i int) env {
+	env, ok := args[i].(*environment)
+	if !ok {
+		panic(fmt.Sprintf("%s: not an environment: %s", name, args[i].pr()))
+	}
+	return env.e
+}
+
+func builtinIsEnvironment(args []val) val {
+	checkArgCount("environment?", args, 1, 1)
+	_, ok := args[0].(*environment)
+	return boolean{ok}
+}
+
+// environmentBuiltins returns the builtins that refer to the global
+// environment ge: `interaction-environment`, which returns it,
+// `eval`, which evaluates in it unless given another environment, and
+// `macroexpand` and `macroexpand-1`, which expand the macros defined
+// in it.
+// `load` evaluates the datums in a file in it unless given another
+// environment.
+// `environment`, which returns a new global environment, is here
+// because the builtins table can't refer to itself.  Its import sets
+// are checked, but otherwise ignored, since there are no libraries.
+// Each global environment has its own of these builtins, so they
+// have ids.
+func environmentBuiltins(ge globalEnv) []builtin {
+	interaction := &environment{e: ge}
+	bs := []builtin{
+		{name: "environment", min: 0, max: -1, f: func(args []val) val {
+			for _, set := range args {
+				if !isList(set) {
+					panic(fmt.Sprintf("environment: invalid import set: %s", set.pr()))
+				}
+			}
+			return &environment{e: newGlobalEnv()}
+		}},
+		{name: "interaction-environment", min: 0, max: 0, f: func(args []val) val {
+			checkArgCount("interaction-environment", args, 0, 0)
+			return interaction
+		}},
+		{name: "eval", min: 1, max: 2, control: func(m *machine, args []val) {
+			var e env = ge
+			if len(args) == 2 {
+				e = environmentArg("eval", args, 1)
+			}
+			m.eval(e, args[0])
+		}},
+		{name: "load", min: 1, max: 2, control: func(m *machine, args []val) {
+			file := stringArg("load", args, 0)
+			var e env = ge
+			if len(args) == 2 {
+				e = environmentArg("load", args, 1)
+			}
+			forms := readFile("load", file)
+			if len(forms) == 0 {
+				m.ret(unspecified{})
+				return
+			}
+			m.evalBody(e, list(forms...))
+		}},
+		{name: "macroexpand-1", min: 1, max: 2, f: func(args []val) val {
+			checkArgCount("macroexpand-1", args, 1, 2)
+			var e env = ge
+			if len(args) == 2 {
+				e = environmentArg("macroexpand-1", args, 1)
+			}
+			expansion, _ := macroexpand1(e, args[0])
+			return stripAliases(expansion)
+		}},
+		{name: "macroexpand", min: 1, max: 2, f: func(args []val) val {
+			checkArgCount("macroexpand", args, 1, 2)
+			var e env = ge
+			if len(args) == 2 {
+				e = environmentArg("macroexpand", args, 1)
+			}
+			form, expanded := args[0], true
+			for expanded {
+				form, expanded = macroexpand1(e, form)
+			}
+			return stripAliases(form)
+		}},
+	}
+	for i := range bs {
+		bs[i].id = &builtinID{}
+	}
+	return bs
+}
+
+// readFile reads all the datums in a file, for the builtin called
+// name.  Their source locations refer to the file.
+func readFile(name string, file string) []val {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		panic(fmt.Sprintf("%s: %s", name, err))
+	}
+	forms, err := readAll(file, string(b))
+	if err != nil {
+		panic(fmt.Sprintf("%s: %s", name, err))
+	}
+	return forms
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// errorObject is an error as seen by Scheme code: a message and a
+// list of irritants, the values the error is about.  It implements
+// Go's error interface, so it can be used as a panic value.
+type errorObject struct {
+	message   string
+	irritants []val
+}
+
+func (eo *errorObject) pr() string {
+	return "#<error " + eo.describe(newStr(eo.message).pr()) + ">"
+}
+
+func (eo *errorObject) equal(other val) bool {
+	return eo == other
+}
+
+func (eo *errorObject) Error() string {
+	return eo.describe(eo.message)
+}
+
+// describe returns the message, as given, followed by the written
+// irritants.
+func (eo *errorObject) describe(message string) string {
+	var b strings.Builder
+	b.WriteString(message)
+	for _, irritant := range eo.irritants {
+		b.WriteString(" " + irritant.pr())
+	}
+	return b.String()
+}
+
+func errorObjectArg(name string, args []val, i int) *errorObject {
+	eo, ok := args[i].(*errorObject)
+	if !ok {
+		panic(fmt.Sprintf("%s: not an error object: %s", name, args[i].pr()))
+	}
+	return eo
+}
+
+func builtinMakeErrorObject(args []val) val {
+	checkArgCount("make-error-object", args, 1, -1)
+	message := stringArg("make-error-object", args, 0)
+	return &errorObject{message: message, irritants: append([]val{}, args[1:]...)}
+}
+
+// builtinError raises a new error object with the given message and
+// irritants.
+func builtinError(args []val) val {
+	checkArgCount("error", args, 1, -1)
+	message := stringArg("error", args, 0)
+	eo := &errorObject{message: message, irritants: append([]val{}, args[1:]...)}
+	panic(&raisedObject{obj: eo, depth: len(handlers)})
+}
+
+func builtinIsErrorObject(args []val) val {
+	checkArgCount("error-object?", args, 1, 1)
+	_, ok := args[0].(*errorObject)
+	return boolean{ok}
+}
+
+func builtinErrorObjectMessage(args []val) val {
+	checkArgCount("error-object-message", args, 1, 1)
+	return newStr(errorObjectArg("error-object-message", args, 0).message)
+}
+
+func builtinErrorObjectIrritants(args []val) val {
+	checkArgCount("error-object-irritants", args, 1, 1)
+	return list(errorObjectArg("error-object-irritants", args, 0).irritants...)
+}
+
+// handlers is the stack of the currently installed exception
+// handlers, innermost last.  `guard` installs a nil entry, because it
+// handles exceptions by unwinding to its catchFrame.
+var handlers []function
+
+// raisedObject is panicked to raise an exception.  depth is the number
+// of handlers that were installed when it was raised, so that handlers
+// only get exceptions raised within their own extent and not from
+// within themselves.
+type raisedObject struct {
+	obj   val
+	depth int
+}
+
+func (ro *raisedObject) Error() string {
+	if eo, ok := ro.obj.(*errorObject); ok {
+		return eo.Error()
+	}
+	return "uncaught exception: " + ro.obj.pr()
+}
+
+// raised returns the exception that the panic r stands for.  Go panics
+// from builtins become error objects, raised at depth.  Other panics,
+// like continuation invocations, aren't exceptions, so the result is
+// nil for them.
+func raised(r interface{}, depth int) *raisedObject {
+	switch r := r.(type) {
+	case *raisedObject:
+		return r
+	case *locatedError:
+		return raised(r.cause, depth)
+	case *errorObject:
+		return &raisedObject{obj: r, depth: depth}
+	case string:
+		return &raisedObject{obj: &errorObject{message: r}, depth: depth}
+	case error:
+		return &raisedObject{obj: &errorObject{message: r.Error()}, depth: depth}
+	}
+	return nil
+}
+
+func builtinRaise(args []val) val {
+	checkArgCount("raise", args, 1, 1)
+	panic(&raisedObject{obj: args[0], depth: len(handlers)})
+}
+
+// builtinRaiseContinuable calls the current handler with the outer
+// handlers installed and returns what it returns.
+func builtinRaiseContinuable(m *machine, args []val) {
+	n := len(handlers)
+	if n == 0 || handlers[n-1] == nil {
+		panic(&raisedObject{obj: args[0], depth: n})
+	}
+	m.push(&handlersFrame{handlers: handlers})
+	handler := handlers[n-1]
+	handlers = handlers[: n-1 : n-1]
+	m.apply(handler, args)
+}
+
+// handlersFrame reinstalls handlers when a handler called by
+// `raise-continuable` returns.
+type handlersFrame struct {
+	handlers []function
+}
+
+func (f *handlersFrame) resume(m *machine, v val) {
+	handlers = f.handlers
+	m.ret(v)
+}
+
+// builtinWithExceptionHandler calls the thunk with the handler
+// installed.  Non-continuable exceptions are passed to the handler
+// where they're raised, by handlePanic.  If the handler returns,
+// that's a secondary exception.
+func builtinWithExceptionHandler(m *machine, args []val) {
+	handler := functionArg("with-exception-handler", args, 0)
+	thunk := functionArg("with-exception-handler", args, 1)
+	m.catch(handler, false)
+	m.apply(thunk, nil)
+}
+
+// catch pushes a catchFrame that calls proc with the exceptions raised
+// in the body that's evaluated next, and installs proc as the handler
+// for it.  For `guard`, a nil handler is installed instead.
+func (m *machine) catch(proc function, guard bool) {
+	depth := len(handlers)
+	m.push(&catchFrame{depth: depth, proc: proc, guard: guard, winds: winds, handlers: handlers})
+	var handler function
+	if !guard {
+		handler = proc
+	}
+	handlers = append(handlers[:depth:depth], handler)
+}
+
+// catchFrame reinstalls the outer handlers when its body returns.  It
+// catches the exceptions raised in its body that have to unwind to it
+// while its handler is installed, that is, those raised at a greater
+// depth.  When the machine unwinds to it, it calls proc with the
+// exception, in the dynamic state of the frame.  For `guard`, what
+// proc returns is returned from the frame.  For
+// `with-exception-handler`, proc must not return.
+type catchFrame struct {
+	depth    int
+	proc     function
+	guard    bool
+	winds    *wind
+	handlers []function
+}
+
+func (f *catchFrame) resume(m *machine, v val) {
+	handlers = f.handlers
+	m.ret(v)
+}
+
+func (f *catchFrame) handle(m *machine, ro *raisedObject) {
+	rewind(f.winds)
+	handlers = f.handlers
+	if f.guard {
+		m.push(&guardFrame{ro: ro})
+	} else {
+		m.push(&handlerReturnedFrame{ro: ro, depth: f.depth})
+	}
+	m.apply(f.proc, []val{ro.obj})
+}
+
+// handlerReturnedFrame raises a secondary exception when the handler
+// of a non-continuable exception returns.
+type handlerReturnedFrame struct {
+	ro    *raisedObject
+	depth int
+}
+
+func (f *handlerReturnedFrame) resume(m *machine, v val) {
+	panic(&raisedObject{
+		obj:   &errorObject{message: "exception handler returned", irritants: []val{f.ro.obj}},
+		depth: f.depth,
+	})
+}
+
+// guardNoMatch is returned by the handler in the expansion of `guard`
+// if none of the clauses apply.
+type guardNoMatch struct{}
+
+func (guardNoMatch) pr() string {
+	return "#<no-match>"
+}
+
+func (guardNoMatch) equal(other val) bool {
+	_, ok := other.(guardNoMatch)
+	return ok
+}
+
+// guardFrame raises the exception again if the handler of `guard`
+// returns guardNoMatch.
+type guardFrame struct {
+	ro *raisedObject
+}
+
+func (f *guardFrame) resume(m *machine, v val) {
+	if _, ok := v.(guardNoMatch); ok {
+		panic(&raisedObject{obj: f.ro.obj, depth: len(handlers)})
+	}
+	m.ret(v)
+}
+
+// guardCall is used by the expansion of `guard`.  It calls the body
+// thunk, and if that raises an exception, it unwinds and calls the
+// handler with it.  If the handler returns guardNoMatch, the exception
+// is raised again.  Since the stack has been unwound by then, it can't
+// be continued anymore, even if it was raised with `raise-continuable`.
+var guardCall = builtin{name: "guard", min: 2, max: 2, control: func(m *machine, args []val) {
+	m.catch(args[1].(function), true)
+	m.apply(args[0].(function), nil)
+}}
+
+// expandGuard expands
+//
+//	(guard (var clause ...) body ...)
+//
+// into a call of guardCall with a thunk for the body and a handler
+// that evaluates the clauses like `cond`.
+func expandGuard(form *cons) val {
+	items := syntaxItems("guard", form, 3)
+	spec := syntaxItems("guard", items[1], 1)
+	v, ok := spec[0].(symbol)
+	if !ok {
+		panic(fmt.Sprintf("guard: invalid variable %s", spec[0].pr()))
+	}
+	clauses := spec[1:]
+	last := len(clauses) - 1
+	if last < 0 || !isList(clauses[last]) || clauses[last].(seq).empty() || !isSymbolNamed(clauses[last].(seq).first(), "else") {
+		clauses = append(clauses, list(core("else"), list(core("quote"), guardNoMatch{})))
+	}
+	body := &cons{car: core("lambda"), cdr: &cons{car: empty{}, cdr: list(items[2:]...)}}
+	handler := list(core("lambda"), list(v), &cons{car: core("cond"), cdr: list(clauses...)})
+	result := callValue(guardCall, body, handler).(*cons)
+	result.loc = form.loc
+	return result
+}
+
+// assertionFailed is used by the expansion of `assert`.  It raises an
+// error about the expression that was false.
+var assertionFailed = builtin{name: "assert", min: 1, max: 1, f: func(args []val) val {
+	panic(&raisedObject{obj: &errorObject{message: "assertion failed", irritants: args}, depth: len(handlers)})
+}}
+
+// expandAssert expands `(assert expr)` into an `if` that calls
+// assertionFailed with the quoted expression if it's false.
+func expandAssert(form *cons) val {
+	items := syntaxItems("assert", form, 2)
+	if len(items) != 2 {
+		panic(fmt.Sprintf("assert: invalid syntax %s", form.pr()))
+	}
+	failed := callValue(assertionFailed, list(core("quote"), items[1]))
+	return &cons{car: core("if"), cdr: list(items[1], list(core("quote"), unspecified{}), failed), loc: form.loc}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"math/bits"
+	"runtime"
+)
+
+// maxFoldBits is the size in bits of the largest exact number that a
+// folded call can take or return.  Larger ones are computed when the
+// call is reached, so that compiling code that never runs it doesn't
+// take long.
+const maxFoldBits = 1 << 16
+
+// foldable are the names of the builtins whose calls are folded when
+// their arguments are constant, because they only compute an
+// immutable value from their arguments.  Builtins made at run time
+// aren't folded even if they have one of these names.  A folded call
+// checks that its operators are still bound to the same builtins when
+// it's reached, so redefining them affects compiled code like any
+// other.
+var foldable = map[string]bool{
+	"+":                true,
+	"*":                true,
+	"-":                true,
+	"/":                true,
+	"=":                true,
+	"<":                true,
+	"<=":               true,
+	">":                true,
+	">=":               true,
+	"min":              true,
+	"max":              true,
+	"abs":              true,
+	"expt":             true,
+	"gcd":              true,
+	"lcm":              true,
+	"sqrt":             true,
+	"quotient":         true,
+	"remainder":        true,
+	"modulo":           true,
+	"numerator":        true,
+	"denominator":      true,
+	"not":              true,
+	"boolean=?":        true,
+	"pair?":            true,
+	"null?":            true,
+	"symbol?":          true,
+	"boolean?":         true,
+	"procedure?":       true,
+	"string?":          true,
+	"vector?":          true,
+	"number?":          true,
+	"integer?":         true,
+	"zero?":            true,
+	"positive?":        true,
+	"negative?":        true,
+	"odd?":             true,
+	"even?":            true,
+	"exact?":           true,
+	"inexact?":         true,
+	"char?":            true,
+	"char->integer":    true,
+	"integer->char":    true,
+	"char-alphabetic?": true,
+	"char-numeric?":    true,
+	"char-upcase":      true,
+	"char-downcase":    true,
+}
+
+// foldDep is a variable whose binding a folded value depends on: the
+// operator of a folded call and the builtin it was bound to.
+type foldDep struct {
+	name symbol
+	b    builtin
+}
+
+// folded is the value of a folded call, which is only valid as long as
+// the variables in deps are bound to the same builtins.  Otherwise the
+// call is evaluated as a form, which is returned if it's in tail
+// position.
+type folded struct {
+	value val
+	deps  []foldDep
+	form  val
+	tail  bool
+}
+
+// valid checks whether the value of f is still valid in e.
+func (f *folded) valid(e env) bool {
+	for _, d := range f.deps {
+		v, _ := lookupIdentifier(e, d.name)
+		if b, ok := v.(builtin); !ok || !b.equal(d.b) {
+			return false
+		}
+	}
+	return true
+}
+
+// constantValue returns the value of x if it can be computed at
+// compile time: x is a literal, a `quote` form, or a call of a
+// foldable builtin with constant arguments.  It also returns the
+// variables the value depends on.
+func (c *compiler) constantValue(x val) (val, []foldDep, bool) {
+	switch x := x.(type) {
+	case boolean, number, bignum, flonum, rational, *vector, *bytevector, *box, keyword, str, char, function:
+		return x, nil, true
+	case *cons:
+		if datum, ok := abbreviated(x, "quote"); ok {
+			if _, bound := c.scope.lookup(x.car.(symbol)); !bound {
+				return datum, nil, true
+			}
+			return nil, nil, false
+		}
+		return c.fold(x)
+	}
+	return nil, nil, false
+}
+
+// fold returns the value of the call x if it's a call of a foldable
+// builtin with constant arguments, and the variables it depends on.
+// Calls that raise an error aren't folded, so that the error is raised
+// when they're reached, and neither are those whose arguments or
+// result are too large.
+func (c *compiler) fold(x *cons) (v val, deps []foldDep, ok bool) {
+	f, deps, ok := c.constantValue(x.car)
+	if s, isSymbol := x.car.(symbol); isSymbol {
+		f, ok = c.scope.lookup(s)
+	}
+	b, isBuiltin := f.(builtin)
+	if !ok || !isBuiltin || b.id != nil || !foldable[b.name] || !isList(x.cdr) {
+		return nil, nil, false
+	}
+	if s, isSymbol := x.car.(symbol); isSymbol {
+		deps = append(deps, foldDep{name: s, b: b})
+	}
+	args := []val{}
+	for _, form := range seqToSlice(x.rest()) {
+		arg, argDeps, ok := c.constantValue(form)
+		if !ok {
+			return nil, nil, false
+		}
+		args = append(args, arg)
+		deps = append(deps, argDeps...)
+	}
+	if !cheapToFold(b.name, args) {
+		return nil, nil, false
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			if _, isRuntimeError := r.(runtime.Error); isRuntimeError {
+				panic(r)
+			}
+			v, deps, ok = nil, nil, false
+		}
+	}()
+	v = b.call(args)
+	if exactBits(v) > maxFoldBits {
+		return nil, nil, false
+	}
+	return v, deps, true
+}
+
+// cheapToFold returns whether calling the foldable builtin called name
+// with args takes little time.  Except for `expt`, the results of the
+// foldable builtins are no larger than all of their arguments
+// together.
+func cheapToFold(name string, args []val) bool {
+	for _, arg := range args {
+		if exactBits(arg) > maxFoldBits {
+			return false
+		}
+	}
+	if name != "expt" || len(args) != 2 || !isExact(args[0]) {
+		return true
+	}
+	p, ok := args[1].(number)
+	if !ok {
+		_, isBignum := args[1].(bignum)
+		return !isBignum
+	}
+	if p.i < -maxFoldBits || p.i > maxFoldBits {
+		return false
+	}
+	if p.i < 0 {
+		p.i = -p.i
+	}
+	return int64(exactBits(args[0]))*p.i <= maxFoldBits
+}
+
+// exactBits returns the size in bits of v if it's an exact number, or
+// 0 otherwise.
+func exactBits(v val) int {
+	switch v := v.(type) {
+	case number:
+		if v.i < 0 {
+			return bits.Len64(uint64(-v.i))
+		}
+		return bits.Len64(uint64(v.i))
+	case bignum:
+		return v.b.BitLen()
+	case rational:
+		return v.r.Num().BitLen() + v.r.Denom().BitLen()
+	}
+	return 0
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"hash/maphash"
+	"math"
+)
+
+// hashTable is a mutable hash table.  Tables created with the `eq?`
+// or `eqv?` test compare keys by identity, except for numbers and
+// characters, which are compared by value.  Tables created with the
+// default `equal?` test compare strings, pairs, vectors, bytevectors
+// and boxes by structure.  Entries are kept in insertion order.
+type hashTable struct {
+	identity bool
+	entries  map[interface{}]*hashEntry
+	// structural holds the entries of an `equal?` table whose keys
+	// are compared by structure, by the equalHash of their keys.
+	structural map[uint64][]*hashEntry
+	order      []*hashEntry
+}
+
+type hashEntry struct {
+	key   val
+	value val
+}
+
+// strKey stands for a string in an `equal?` table.
+type strKey struct {
+	s string
+}
+
+// numKey stands for a number that isn't comparable with `==`.
+type numKey struct {
+	printed string
+}
+
+// flonumKey stands for a flonum, which is compared by its bits like
+// by `eqv?`.
+type flonumKey struct {
+	bits uint64
+}
+
+// builtinKey stands for a builtin, which isn't comparable with `==`.
+type builtinKey struct {
+	name string
+	id   *builtinID
+}
+
+func newHashTable(identity bool) *hashTable {
+	return &hashTable{identity: identity, entries: map[interface{}]*hashEntry{}, structural: map[uint64][]*hashEntry{}}
+}
+
+func (h *hashTable) pr() string {
+	return fmt.Sprintf("#<hash-table %d>", len(h.order))
+}
+
+func (h *hashTable) equal(other val) bool {
+	return h == other
+}
+
+// isStructural returns whether the key k is compared by structure.
+func (h *hashTable) isStructural(k val) bool {
+	switch k.(type) {
+	case *cons, *vector, *bytevector, *box:
+		return !h.identity
+	}
+	return false
+}
+
+// mapKey returns the Go map key for the Scheme key k, unless it's
+// compared by structure.
+func (h *hashTable) mapKey(k val) interface{} {
+	switch k := k.(type) {
+	case bignum, rational:
+		return numKey{k.pr()}
+	case flonum:
+		return flonumKey{math.Float64bits(k.f)}
+	case builtin:
+		return builtinKey{k.name, k.id}
+	case str:
+		if !h.identity {
+			return strKey{k.s}
+		}
+	}
+	return k
+}
+
+// lookup returns the entry for the key k, or nil if there is none.
+func (h *hashTable) lookup(k val) *hashEntry {
+	if !h.isStructural(k) {
+		return h.entries[h.mapKey(k)]
+	}
+	for _, e := range h.structural[equalHash(k)] {
+		if isEqual(e.key, k) {
+			return e
+		}
+	}
+	return nil
+}
+
+func (h *hashTable) get(k val) (val, bool) {
+	e := h.lookup(k)
+	if e == nil {
+		return nil, false
+	}
+	return e.value, true
+}
+
+func (h *hashTable) set(k val, v val) {
+	if e := h.lookup(k); e != nil {
+		e.value = v
+		return
+	}
+	e := &hashEntry{key: k, value: v}
+	if h.isStructural(k) {
+		hash := equalHash(k)
+		h.structural[hash] = append(h.structural[hash], e)
+	} else {
+		h.entries[h.mapKey(k)] = e
+	}
+	h.order = append(h.order, e)
+}
+
+func (h *hashTable) delete(k val) {
+	e := h.lookup(k)
+	if e == nil {
+		return
+	}
+	if h.isStructural(k) {
+		hash := equalHash(k)
+		bucket := h.structural[hash]
+		for i, be := range bucket {
+			if be == e {
+				bucket = append(bucket[:i:i], bucket[i+1:]...)
+				break
+			}
+		}
+		if len(bucket) == 0 {
+			delete(h.structural, hash)
+		} else {
+			h.structural[hash] = bucket
+		}
+	} else {
+		delete(h.entries, h.mapKey(k))
+	}
+	for i, oe := range h.order {
+		if oe == e {
+			h.order = append(h.order[:i], h.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// hashSeed is the seed for hashing strings in equalHash.
+var hashSeed = maphash.MakeSeed()
+
+// equalHashBudget is the number of values equalHash looks at.
+const equalHashBudget = 64
+
+// equalHash returns a hash of v that's the same for values that are
+// isEqual.  It only looks at the first few values in v, so that it
+// terminates on circular structures and is fast on large ones.  The
+// values it can't hash by content, like procedures, records and
+// ports, all hash the same, leaving it to isEqual to tell them apart.
+func equalHash(v val) uint64 {
+	budget := equalHashBudget
+	return hashIn(v, &budget)
+}
+
+// hashIn hashes v like equalHash, looking at no more than budget
+// values, which it decrements.
+func hashIn(v val, budget *int) uint64 {
+	if *budget == 0 {
+		return 0
+	}
+	*budget--
+	switch v := v.(type) {
+	case *cons:
+		car := hashIn(v.car, budget)
+		return combineHashes(1, car, hashIn(v.cdr, budget))
+	case *vector:
+		hash := combineHashes(2, uint64(len(v.items)))
+		for _, item := range v.items {
+			if *budget == 0 {
+				break
+			}
+			hash = combineHashes(hash, hashIn(item, budget))
+		}
+		return hash
+	case *box:
+		return combineHashes(3, hashIn(v.v, budget))
+	case *bytevector:
+		return combineHashes(4, maphash.Bytes(hashSeed, v.b))
+	case str:
+		return combineHashes(5, maphash.String(hashSeed, v.s))
+	case symbol:
+		return combineHashes(6, maphash.String(hashSeed, v.name))
+	case keyword:
+		return combineHashes(7, maphash.String(hashSeed, v.name))
+	case char:
+		return combineHashes(8, uint64(v.r))
+	case boolean:
+		if v.b {
+			return 9
+		}
+		return 10
+	case number:
+		return combineHashes(11, uint64(v.i))
+	case bignum, rational:
+		return combineHashes(12, maphash.String(hashSeed, v.pr()))
+	case flonum:
+		return combineHashes(13, math.Float64bits(v.f))
+	}
+	return 0
+}
+
+// combineHashes combines the hashes into one, in the manner of FNV.
+func combineHashes(hashes ...uint64) uint64 {
+	combined := uint64(14695981039346656037)
+	for _, hash := range hashes {
+		combined = (combined ^ hash) * 1099511628211
+	}
+	return combined
+}
+
+func hashTableArg(name string, args []val, i int) *hashTable {
+	h, ok := args[i].(*hashTable)
+	if !ok {
+		panic(fmt.Sprintf("%s: not a hash table: %s", name, args[i].pr()))
+	}
+	return h
+}
+
+func builtinMakeHashTable(args []val) val {
+	checkArgCount("make-hash-table", args, 0, 1)
+	if len(args) == 0 {
+		return newHashTable(false)
+	}
+	test, ok := args[0].(symbol)
+	if ok {
+		switch test.name {
+		case "eq?", "eqv?":
+			return newHashTable(true)
+		case "equal?":
+			return newHashTable(false)
+		}
+	}
+	panic(fmt.Sprintf("make-hash-table: unknown test %s", args[0].pr()))
+}
+
+func builtinIsHashTable(args []val) val {
+	checkArgCount("hash-table?", args, 1, 1)
+	_, ok := args[0].(*hashTable)
+	return boolean{ok}
+}
+
+func builtinHashRef(args []val) val {
+	checkArgCount("hash-ref", args, 2, 3)
+	v, ok := hashTableArg("hash-ref", args, 0).get(args[1])
+	if ok {
+		return v
+	}
+	if len(args) == 3 {
+		return args[2]
+	}
+	panic(fmt.Sprintf("hash-ref: no value for key %s", args[1].pr()))
+}
+
+func builtinHashSet(args []val) val {
+	checkArgCount("hash-set!", args, 3, 3)
+	hashTableArg("hash-set!", args, 0).set(args[1], args[2])
+	return unspecified{}
+}
+
+func builtinHashDelete(args []val) val {
+	checkArgCount("hash-delete!", args, 2, 2)
+	hashTableArg("hash-delete!", args, 0).delete(args[1])
+	return unspecified{}
+}
+
+func builtinHashCount(args []val) val {
+	checkArgCount("hash-count", args, 1, 1)
+	return number{int64(len(hashTableArg("hash-count", args, 0).order))}
+}
+
+func builtinHashKeys(args []val) val {
+	checkArgCount("hash-keys", args, 1, 1)
+	keys := []val{}
+	for _, e := range hashTableArg("hash-keys", args, 0).order {
+		keys = append(keys, e.key)
+	}
+	return list(keys...)
+}
+
+func builtinHashForEach(args []val) val {
+	checkArgCount("hash-for-each", args, 2, 2)
+	h := hashTableArg("hash-for-each", args, 0)
+	f := functionArg("hash-for-each", args, 1)
+	// Copy the entries so that the procedure can modify the table.
+	for _, e := range append([]*hashEntry{}, h.order...) {
+		f.call([]val{e.key, e.value})
+	}
+	return unspecified{}
+}
@@ -0,0 +1,59 @@
+package main
+
+import "fmt"
+
+// keyword is a self-evaluating symbol-like value, written `#:name`.
+type keyword struct {
+	name string
+}
+
+func (k keyword) pr() string {
+	return "#:" + symbol{name: k.name}.pr()
+}
+
+func (k keyword) display() string {
+	return "#:" + k.name
+}
+
+func (k keyword) equal(other val) bool {
+	ok, isKeyword := other.(keyword)
+	return isKeyword && k.name == ok.name
+}
+
+// readKeyword reads the name of a keyword.  The lexer must be
+// positioned after the `#:`.
+func (ls lexState) readKeyword() (val, lexState, error) {
+	start := ls
+	if ls.isEOS() || (isDelimiter(ls.current()) && ls.current() != '|') {
+		return nil, ls, start.errorf("missing keyword name")
+	}
+	v, ls, err := ls.read()
+	if err != nil {
+		return nil, ls, err
+	}
+	s, ok := v.(symbol)
+	if !ok {
+		return nil, ls, start.errorf("invalid keyword name %s", v.pr())
+	}
+	return keyword{s.name}, ls, nil
+}
+
+func builtinIsKeyword(args []val) val {
+	checkArgCount("keyword?", args, 1, 1)
+	_, ok := args[0].(keyword)
+	return boolean{ok}
+}
+
+func builtinKeywordToString(args []val) val {
+	checkArgCount("keyword->string", args, 1, 1)
+	k, ok := args[0].(keyword)
+	if !ok {
+		panic(fmt.Sprintf("keyword->string: not a keyword: %s", args[0].pr()))
+	}
+	return newStr(k.name)
+}
+
+func builtinStringToKeyword(args []val) val {
+	checkArgCount("string->keyword", args, 1, 1)
+	return keyword{stringArg("string->keyword", args, 0)}
+}
@@ -0,0 +1,344 @@
+package main
+
+import "fmt"
+
+func pairArg(name string, args []val, i int) *cons {
+	c, ok := args[i].(*cons)
+	if !ok {
+		panic(fmt.Sprintf("%s: not a pair: %s", name, args[i].pr()))
+	}
+	return c
+}
+
+func builtinSetCar(args []val) val {
+	checkArgCount("set-car!", args, 2, 2)
+	pairArg("set-car!", args, 0).car = args[1]
+	return unspecified{}
+}
+
+func builtinSetCdr(args []val) val {
+	checkArgCount("set-cdr!", args, 2, 2)
+	pairArg("set-cdr!", args, 0).cdr = args[1]
+	return unspecified{}
+}
+
+func builtinCons(args []val) val {
+	checkArgCount("cons", args, 2, 2)
+	return &cons{car: args[0], cdr: args[1]}
+}
+
+func builtinCar(args []val) val {
+	checkArgCount("car", args, 1, 1)
+	return pairArg("car", args, 0).car
+}
+
+func builtinCdr(args []val) val {
+	checkArgCount("cdr", args, 1, 1)
+	return pairArg("cdr", args, 0).cdr
+}
+
+func builtinList(args []val) val {
+	return list(args...)
+}
+
+func builtinLength(args []val) val {
+	checkArgCount("length", args, 1, 1)
+	return number{int64(len(listArg("length", args, 0)))}
+}
+
+// builtinAppend returns a list of the elements of all the arguments
+// but the last, followed by the last argument, which is shared, and
+// needn't be a list.
+func builtinAppend(args []val) val {
+	if len(args) == 0 {
+		return empty{}
+	}
+	result := args[len(args)-1]
+	for i := len(args) - 2; i >= 0; i-- {
+		items := listArg("append", args, i)
+		for j := len(items) - 1; j >= 0; j-- {
+			result = &cons{car: items[j], cdr: result}
+		}
+	}
+	return result
+}
+
+func builtinReverse(args []val) val {
+	checkArgCount("reverse", args, 1, 1)
+	var result val = empty{}
+	for _, item := range listArg("reverse", args, 0) {
+		result = &cons{car: item, cdr: result}
+	}
+	return result
+}
+
+func builtinIsList(args []val) val {
+	checkArgCount("list?", args, 1, 1)
+	return boolean{isList(args[0])}
+}
+
+// listTail returns the tail of the list args[0] after args[1]
+// elements, for the builtin called name.
+func listTail(name string, args []val) val {
+	checkArgCount(name, args, 2, 2)
+	l, k := args[0], intArg(name, args, 1)
+	if k < 0 {
+		panic(fmt.Sprintf("%s: index out of range: %d", name, k))
+	}
+	for ; k > 0; k-- {
+		c, ok := l.(*cons)
+		if !ok {
+			panic(fmt.Sprintf("%s: index out of range: %d", name, args[1].(number).i))
+		}
+		l = c.cdr
+	}
+	return l
+}
+
+func builtinListTail(args []val) val {
+	return listTail("list-tail", args)
+}
+
+func builtinListRef(args []val) val {
+	c, ok := listTail("list-ref", args).(*cons)
+	if !ok {
+		panic(fmt.Sprintf("list-ref: index out of range: %d", args[1].(number).i))
+	}
+	return c.car
+}
+
+// equivalence returns the test for comparing elements that's given
+// as the optional argument i of the builtin called name, or same if
+// it isn't given.
+func equivalence(name string, args []val, i int, same func(a, b val) bool) func(a, b val) bool {
+	if len(args) <= i {
+		return same
+	}
+	f := functionArg(name, args, i)
+	return func(a, b val) bool {
+		return isTrue(single(f.call([]val{a, b})))
+	}
+}
+
+// builtinMember returns `memq`, `memv` or `member`, which return the
+// first tail of a list whose car is the same as a value, according
+// to same, or to the procedure given as the third argument of
+// `member`.
+func builtinMember(name string, same func(a, b val) bool) builtin {
+	max := 2
+	if name == "member" {
+		max = 3
+	}
+	return builtin{name: name, min: 2, max: max, f: func(args []val) val {
+		checkArgCount(name, args, 2, max)
+		if !isList(args[1]) {
+			panic(fmt.Sprintf("%s: not a list: %s", name, args[1].pr()))
+		}
+		same := equivalence(name, args, 2, same)
+		for l := args[1]; l != val(empty{}); l = l.(*cons).cdr {
+			if same(args[0], l.(*cons).car) {
+				return l
+			}
+		}
+		return boolean{false}
+	}}
+}
+
+// builtinAssoc returns `assq`, `assv` or `assoc`, which return the
+// first pair in an association list whose car is the same as a key,
+// like builtinMember.
+func builtinAssoc(name string, same func(a, b val) bool) builtin {
+	max := 2
+	if name == "assoc" {
+		max = 3
+	}
+	return builtin{name: name, min: 2, max: max, f: func(args []val) val {
+		checkArgCount(name, args, 2, max)
+		same := equivalence(name, args, 2, same)
+		for _, entry := range listArg(name, args, 1) {
+			pair, ok := entry.(*cons)
+			if !ok {
+				panic(fmt.Sprintf("%s: not a pair: %s", name, entry.pr()))
+			}
+			if same(args[0], pair.car) {
+				return pair
+			}
+		}
+		return boolean{false}
+	}}
+}
+
+// loopFrame continues the loop of a builtin that called a procedure
+// with the value it returned.  The state of the loop is kept in the
+// variables of next, which mustn't change them, so that continuations
+// can resume the frame again.
+type loopFrame struct {
+	next func(m *machine, v val)
+}
+
+func (f *loopFrame) resume(m *machine, v val) {
+	f.next(m, v)
+}
+
+// listArgs returns the lists from argument i on.
+func listArgs(name string, args []val, i int) [][]val {
+	lists := [][]val{}
+	for ; i < len(args); i++ {
+		lists = append(lists, listArg(name, args, i))
+	}
+	return lists
+}
+
+// elementsAt returns the elements at index i of lists, and false if
+// one of them is too short.
+func elementsAt(lists [][]val, i int) ([]val, bool) {
+	elements := make([]val, len(lists))
+	for j, l := range lists {
+		if i >= len(l) {
+			return nil, false
+		}
+		elements[j] = l[i]
+	}
+	return elements, true
+}
+
+// builtinMap calls a procedure with the elements at each index of
+// the lists, until the shortest one ends, and returns the list of the
+// results.
+func builtinMap(m *machine, args []val) {
+	mapElements(m, functionArg("map", args, 0), listArgs("map", args, 1), func(results []val) val {
+		return list(results...)
+	})
+}
+
+// mapElements calls f with the elements at each index of lists, until
+// the shortest one ends, and returns what result makes of the results.
+func mapElements(m *machine, f function, lists [][]val, result func(results []val) val) {
+	var loop func(m *machine, i int, results []val)
+	loop = func(m *machine, i int, results []val) {
+		elements, ok := elementsAt(lists, i)
+		if !ok {
+			m.ret(result(results))
+			return
+		}
+		m.push(&loopFrame{func(m *machine, v val) {
+			loop(m, i+1, append(results[:i:i], single(v)))
+		}})
+		m.apply(f, elements)
+	}
+	loop(m, 0, nil)
+}
+
+// builtinForEach is like builtinMap, but only for the side effects.
+func builtinForEach(m *machine, args []val) {
+	forEachElements(m, functionArg("for-each", args, 0), listArgs("for-each", args, 1))
+}
+
+// forEachElements is like mapElements, but returns nothing.
+func forEachElements(m *machine, f function, lists [][]val) {
+	var loop func(m *machine, i int)
+	loop = func(m *machine, i int) {
+		elements, ok := elementsAt(lists, i)
+		if !ok {
+			m.ret(unspecified{})
+			return
+		}
+		m.push(&loopFrame{func(m *machine, v val) {
+			loop(m, i+1)
+		}})
+		m.apply(f, elements)
+	}
+	loop(m, 0)
+}
+
+// builtinFilter returns the list of the elements of a list for which
+// a predicate returns true.
+func builtinFilter(m *machine, args []val) {
+	pred, items := functionArg("filter", args, 0), listArg("filter", args, 1)
+	var loop func(m *machine, i int, kept []val)
+	loop = func(m *machine, i int, kept []val) {
+		if i == len(items) {
+			m.ret(list(kept...))
+			return
+		}
+		m.push(&loopFrame{func(m *machine, v val) {
+			if isTrue(single(v)) {
+				loop(m, i+1, append(kept[:len(kept):len(kept)], items[i]))
+				return
+			}
+			loop(m, i+1, kept)
+		}})
+		m.apply(pred, []val{items[i]})
+	}
+	loop(m, 0, nil)
+}
+
+// builtinFoldLeft combines an initial value with the elements at each
+// index of the lists, from the first on, by calling a procedure with
+// the value so far followed by the elements.
+func builtinFoldLeft(m *machine, args []val) {
+	f, lists := functionArg("fold-left", args, 0), listArgs("fold-left", args, 2)
+	var loop func(m *machine, i int, acc val)
+	loop = func(m *machine, i int, acc val) {
+		elements, ok := elementsAt(lists, i)
+		if !ok {
+			m.ret(acc)
+			return
+		}
+		m.push(&loopFrame{func(m *machine, v val) {
+			loop(m, i+1, single(v))
+		}})
+		m.apply(f, append([]val{acc}, elements...))
+	}
+	loop(m, 0, args[1])
+}
+
+// builtinFoldRight is like builtinFoldLeft, but goes from the last
+// elements to the first, and passes the value so far after the
+// elements.
+func builtinFoldRight(m *machine, args []val) {
+	f, lists := functionArg("fold-right", args, 0), listArgs("fold-right", args, 2)
+	n := -1
+	for _, l := range lists {
+		if n < 0 || len(l) < n {
+			n = len(l)
+		}
+	}
+	var loop func(m *machine, i int, acc val)
+	loop = func(m *machine, i int, acc val) {
+		if i < 0 {
+			m.ret(acc)
+			return
+		}
+		elements, _ := elementsAt(lists, i)
+		m.push(&loopFrame{func(m *machine, v val) {
+			loop(m, i-1, single(v))
+		}})
+		m.apply(f, append(elements, acc))
+	}
+	loop(m, n-1, args[1])
+}
+
+// builtinReduce combines the elements of a list by calling a
+// procedure with each element and the value so far, which starts as
+// the first element.  The result for the empty list is the second
+// argument.
+func builtinReduce(m *machine, args []val) {
+	f, items := functionArg("reduce", args, 0), listArg("reduce", args, 2)
+	if len(items) == 0 {
+		m.ret(args[1])
+		return
+	}
+	var loop func(m *machine, i int, acc val)
+	loop = func(m *machine, i int, acc val) {
+		if i == len(items) {
+			m.ret(acc)
+			return
+		}
+		m.push(&loopFrame{func(m *machine, v val) {
+			loop(m, i+1, single(v))
+		}})
+		m.apply(f, []val{items[i], acc})
+	}
+	loop(m, 1, items[0])
+}
@@ -0,0 +1,410 @@
+package main
+
+import "fmt"
+
+// machine evaluates forms with an explicit stack of continuation
+// frames instead of recursing on the Go stack.  At each step it either
+// evaluates an expression, executes the compiled body of a closure,
+// applies a procedure to arguments, or returns a value to the frame on
+// top of the stack.  Since the stack is data,
+// `call/cc` can capture it, and builtins that need to, like
+// `dynamic-wind`, can work on it directly.
+//
+// Builtins that call procedures from Go run them in a nested machine.
+type machine struct {
+	stack []stackEntry
+
+	mode machineMode
+	// expr is evaluated in env in evalMode.
+	expr val
+	env  env
+	// f is applied to args in applyMode.
+	f    function
+	args []val
+	// value is returned to the top frame in returnMode.
+	value val
+	// code is executed in env in execMode, from instruction pc on,
+	// with the stack of values vals.
+	code *code
+	pc   int
+	vals []val
+
+	// loc is the location of the innermost form being evaluated,
+	// which is added to errors.
+	loc *srcLoc
+
+	running bool
+	// winds and handlers are the dynamic state the machine was
+	// started in, which is restored if an error escapes from it.
+	winds    *wind
+	handlers []function
+}
+
+type machineMode int
+
+const (
+	evalMode machineMode = iota
+	applyMode
+	returnMode
+	execMode
+)
+
+// frame is a continuation frame: what's left to do with the value of
+// the expression that's being evaluated.  Frames are never changed, so
+// that the continuations that share them can be invoked any number of
+// times.
+type frame interface {
+	resume(m *machine, v val)
+}
+
+// stackEntry is a frame together with the location of the form it
+// belongs to.
+type stackEntry struct {
+	f   frame
+	loc *srcLoc
+}
+
+// runningMachines are the machines that are running, outermost first.
+var runningMachines []*machine
+
+// eval makes the machine evaluate v in e next.
+func (m *machine) eval(e env, v val) {
+	m.mode, m.env, m.expr = evalMode, e, v
+}
+
+// apply makes the machine apply f to args next.
+func (m *machine) apply(f function, args []val) {
+	m.mode, m.f, m.args = applyMode, f, args
+}
+
+// ret makes the machine return v to the top frame next.
+func (m *machine) ret(v val) {
+	m.mode, m.value = returnMode, v
+}
+
+// evalBody makes the machine evaluate a non-empty sequence of forms,
+// the last one in tail position.
+func (m *machine) evalBody(e env, forms seq) {
+	if forms.empty() {
+		panic("empty body")
+	}
+	if !forms.rest().empty() {
+		m.push(&bodyFrame{env: e, forms: forms.rest()})
+	}
+	m.eval(e, forms.first())
+}
+
+// evalDepthError is raised when evaluation would be nested more deeply
+// than the limit.
+type evalDepthError struct {
+	limit int64
+}
+
+func (e *evalDepthError) Error() string {
+	return fmt.Sprintf("evaluation nested more than %d levels deep", e.limit)
+}
+
+// checkEvalDepth raises an error if nesting evaluation one level
+// deeper would exceed the limit.
+func checkEvalDepth() {
+	if limit := maxEvalDepth.value.(number).i; int64(evalDepth) >= limit {
+		panic(&evalDepthError{limit: limit})
+	}
+}
+
+func (m *machine) push(f frame) {
+	checkEvalDepth()
+	evalDepth++
+	m.stack = append(m.stack, stackEntry{f: f, loc: m.loc})
+}
+
+func (m *machine) pop() frame {
+	top := m.stack[len(m.stack)-1]
+	m.setStack(m.stack[:len(m.stack)-1])
+	m.loc = top.loc
+	return top.f
+}
+
+func (m *machine) setStack(stack []stackEntry) {
+	evalDepth += len(stack) - len(m.stack)
+	m.stack = stack
+}
+
+// run runs the machine until it has returned a value from its bottom
+// frame.  Exceptions and continuation invocations that it doesn't
+// handle itself are passed on, after unwinding its dynamic state.
+func (m *machine) run() val {
+	checkEvalDepth()
+	evalDepth++
+	m.running, m.winds, m.handlers = true, winds, handlers
+	runningMachines = append(runningMachines, m)
+	defer func() {
+		evalDepth--
+		m.running = false
+		runningMachines = runningMachines[:len(runningMachines)-1]
+	}()
+	var r interface{}
+	for {
+		v, p, escaping := m.runSteps(r)
+		if escaping {
+			m.setStack(nil)
+			rewind(m.winds)
+			handlers = m.handlers
+			panic(p)
+		}
+		if p == nil {
+			return v
+		}
+		r = p
+	}
+}
+
+// runSteps runs the machine after handling the panic r, if there is
+// one, until it's done or something panics.
+func (m *machine) runSteps(r interface{}) (v val, p interface{}, escaping bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			p = locate(r, m.loc)
+		}
+	}()
+	if r != nil && !m.handlePanic(r) {
+		return nil, r, true
+	}
+	for {
+		switch m.mode {
+		case evalMode:
+			m.step()
+		case applyMode:
+			m.applyNow()
+		case returnMode:
+			if len(m.stack) == 0 {
+				return m.value, nil, false
+			}
+			m.pop().resume(m, m.value)
+		case execMode:
+			m.exec()
+		}
+	}
+}
+
+// locate adds loc to errors that don't have a location yet.  Other
+// panics, like continuation invocations, are returned unchanged.
+func locate(r interface{}, loc *srcLoc) interface{} {
+	switch r.(type) {
+	case string, error:
+		if _, ok := r.(*locatedError); !ok && loc != nil {
+			return &locatedError{loc: loc, msg: fmt.Sprint(r), cause: r}
+		}
+	}
+	return r
+}
+
+// handlePanic handles the panic r if it's an exception that a handler
+// or a frame on the stack catches, or the invocation of a continuation
+// whose target is m.  It returns false if the panic has to be passed
+// on.
+//
+// A handler installed by `with-exception-handler` is called where the
+// exception was raised, in its dynamic environment, except that the
+// outer handlers are installed.  The exceptions that `guard` catches,
+// and those raised because evaluation is nested too deeply, which
+// leaves no room to call the handler, unwind to their catchFrame
+// instead.
+func (m *machine) handlePanic(r interface{}) bool {
+	if ci, ok := r.(*continuationInvocation); ok {
+		if ci.k.target() != m {
+			return false
+		}
+		m.resumeContinuation(ci.k, ci.vals)
+		return true
+	}
+	ro := raised(r, len(handlers))
+	if ro == nil || ro.depth == 0 {
+		return false
+	}
+	cause := r
+	if le, ok := r.(*locatedError); ok {
+		cause = le.cause
+	}
+	_, tooDeep := cause.(*evalDepthError)
+	if handler := handlers[ro.depth-1]; handler != nil && !tooDeep {
+		depth := ro.depth - 1
+		handlers = handlers[:depth:depth]
+		m.push(&handlerReturnedFrame{ro: ro, depth: depth})
+		m.apply(handler, []val{ro.obj})
+		return true
+	}
+	for i := len(m.stack) - 1; i >= 0; i-- {
+		if cf, ok := m.stack[i].f.(*catchFrame); ok && ro.depth > cf.depth {
+			m.loc = m.stack[i].loc
+			m.setStack(m.stack[:i])
+			cf.handle(m, ro)
+			return true
+		}
+	}
+	return false
+}
+
+func (m *machine) applyNow() {
+	switch f := m.f.(type) {
+	case *closure:
+		m.mode, m.env, m.code, m.pc, m.vals = execMode, f.bind(m.args), f.compiled(), 0, nil
+	case builtin:
+		if f.control == nil {
+			m.ret(f.call(m.args))
+			return
+		}
+		checkArgCount(f.name, m.args, f.min, f.max)
+		f.control(m, m.args)
+	case *continuation:
+		f.invoke(m, m.args)
+	default:
+		m.ret(f.call(m.args))
+	}
+}
+
+// callInMachine calls f with args in a new machine.
+func callInMachine(f function, args []val) val {
+	m := &machine{}
+	m.apply(f, args)
+	return m.run()
+}
+
+// evalBody evaluates a non-empty sequence of forms and returns the
+// value of the last one.
+func evalBody(e env, forms seq) val {
+	m := &machine{}
+	m.evalBody(e, forms)
+	return m.run()
+}
+
+// bodyFrame evaluates the rest of a body.
+type bodyFrame struct {
+	env   env
+	forms seq
+}
+
+func (f *bodyFrame) resume(m *machine, v val) {
+	m.evalBody(f.env, f.forms)
+}
+
+// ifFrame evaluates one of the branches of an `if`, depending on the
+// value of the test.  alternative is nil if there's none.
+type ifFrame struct {
+	env         env
+	consequent  val
+	alternative val
+}
+
+func (f *ifFrame) resume(m *machine, v val) {
+	switch {
+	case isTrue(single(v)):
+		m.eval(f.env, f.consequent)
+	case f.alternative != nil:
+		m.eval(f.env, f.alternative)
+	default:
+		m.ret(unspecified{})
+	}
+}
+
+// argFrame collects the values of the operator and the operands of an
+// application, and then applies the one to the others.  f is nil
+// while the operator is evaluated, and forms are the operands that
+// are still to be evaluated.
+type argFrame struct {
+	env   env
+	f     function
+	args  []val
+	forms seq
+}
+
+func (f *argFrame) resume(m *machine, v val) {
+	v = single(v)
+	next := *f
+	if f.f == nil {
+		fn, ok := v.(function)
+		if !ok {
+			panic(fmt.Sprintf("cannot apply non-function %s", v.pr()))
+		}
+		next.f = fn
+	} else {
+		// The arguments are copied, because a continuation might
+		// resume f again.
+		next.args = append(f.args[:len(f.args):len(f.args)], v)
+	}
+	if next.forms.empty() {
+		m.apply(next.f, next.args)
+		return
+	}
+	form := next.forms.first()
+	next.forms = next.forms.rest()
+	m.push(&next)
+	m.eval(next.env, form)
+}
+
+// wind is an entry in the list of the dynamic extents that have been
+// entered by `dynamic-wind` and `parameterize`, innermost first.
+// before is called when the extent is entered, after when it's left.
+type wind struct {
+	before, after func()
+	parent        *wind
+	depth         int
+}
+
+// winds is the current list of winds.
+var winds *wind
+
+func newWind(before, after func()) *wind {
+	w := &wind{before: before, after: after, parent: winds}
+	if winds != nil {
+		w.depth = winds.depth + 1
+	}
+	return w
+}
+
+// enter calls the before function of w and makes w the current wind,
+// until the body that's evaluated next returns to the frame that's
+// pushed for leaving it.
+func (m *machine) enter(w *wind) {
+	w.before()
+	winds = w
+	m.push(&windFrame{w: w})
+}
+
+// windFrame leaves the extent of its wind when the body returns.
+type windFrame struct {
+	w *wind
+}
+
+func (f *windFrame) resume(m *machine, v val) {
+	winds = f.w.parent
+	f.w.after()
+	m.ret(v)
+}
+
+// rewind makes target the current wind, leaving the extents of the
+// current winds that aren't in target's list, innermost first, and
+// entering the ones of target's list that aren't current, outermost
+// first.
+func rewind(target *wind) {
+	common, other := winds, target
+	for common != other {
+		if common == nil || (other != nil && other.depth > common.depth) {
+			common, other = other, common
+		}
+		common = common.parent
+	}
+	for winds != common {
+		w := winds
+		winds = w.parent
+		w.after()
+	}
+	var entered []*wind
+	for w := target; w != common; w = w.parent {
+		entered = append(entered, w)
+	}
+	for i := len(entered) - 1; i >= 0; i-- {
+		entered[i].before()
+		winds = entered[i]
+	}
+}
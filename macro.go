@@ -0,0 +1,642 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// macro is a `syntax-rules` transformer, as bound by `define-syntax`,
+// `let-syntax` and `letrec-syntax`.
+//
+// Macros are hygienic: the symbols that a template introduces are
+// renamed to aliases that are fresh for each expansion, so they can't
+// capture variables of the macro's user.  An alias that isn't bound
+// where the expansion is evaluated refers to the original symbol in
+// the environment the macro was defined in.
+type macro struct {
+	name     string
+	id       int
+	ellipsis string
+	literals map[string]bool
+	rules    []macroRule
+	env      env
+}
+
+// transformer is a value bound to a macro keyword.  Forms that start
+// with the keyword are evaluated by evaluating their expansion.
+type transformer interface {
+	expand(form *cons) val
+}
+
+// procMacro is a non-hygienic macro, as defined with `define-macro`:
+// an ordinary procedure that's called with the unevaluated operands of
+// a form and returns its expansion.
+type procMacro struct {
+	name string
+	proc function
+}
+
+func (pm *procMacro) pr() string {
+	return fmt.Sprintf("#<macro:%s>", pm.name)
+}
+
+func (pm *procMacro) equal(other val) bool {
+	return pm == other
+}
+
+func (pm *procMacro) expand(form *cons) val {
+	if !isList(form) {
+		panic(fmt.Sprintf("%s: invalid syntax %s", pm.name, form.pr()))
+	}
+	return single(pm.proc.call(seqToSlice(form.cdr.(seq))))
+}
+
+// evalDefineMacro evaluates
+//
+//	(define-macro (name param ...) body ...)
+//	(define-macro name procedure)
+//	(defmacro name (param ...) body ...)
+func evalDefineMacro(e env, name string, forms seq) val {
+	items := syntaxItems(name, forms, 2)
+	var keyword symbol
+	var proc val
+	switch target := items[0].(type) {
+	case symbol:
+		keyword = target
+		if name == "defmacro" {
+			proc = evalLambda(e, forms.rest().(seq))
+		} else {
+			if len(items) != 2 {
+				panic(fmt.Sprintf("%s: invalid syntax %s", name, forms.pr()))
+			}
+			proc = single(eval(e, items[1]))
+		}
+	case *cons:
+		s, ok := target.car.(symbol)
+		if !ok || name == "defmacro" {
+			panic(fmt.Sprintf("%s: invalid syntax %s", name, forms.pr()))
+		}
+		keyword = s
+		proc = evalLambda(e, &cons{car: target.cdr, cdr: forms.rest()})
+	default:
+		panic(fmt.Sprintf("%s: invalid syntax %s", name, forms.pr()))
+	}
+	f, ok := proc.(function)
+	if !ok {
+		panic(fmt.Sprintf("%s: not a procedure: %s", name, proc.pr()))
+	}
+	if c, ok := f.(*closure); ok && c.name == "" {
+		c.name = keyword.name
+	}
+	e.define(keyword, &procMacro{name: keyword.name, proc: f})
+	return unspecified{}
+}
+
+type macroRule struct {
+	pattern  val
+	template val
+}
+
+// macros holds all macros ever made, indexed by their id, so that
+// aliases can refer to them.
+var macros = []*macro{coreSyntax}
+
+// coreSyntax is a pseudo-macro whose aliases refer to the keywords of
+// the special forms and derived forms, since they're resolved in an
+// empty environment.  The expansions of derived forms use them, so
+// that they still work if the user binds those keywords as variables.
+var coreSyntax = &macro{name: "core", id: 0, env: globalEnv{}}
+
+// core returns the alias of the keyword name that can't be shadowed.
+func core(name string) symbol {
+	return coreSyntax.alias(symbol{name: name}, 0)
+}
+
+// expansionCounter numbers macro expansions, to make aliases fresh.
+var expansionCounter int
+
+func (m *macro) pr() string {
+	return fmt.Sprintf("#<macro:%s>", m.name)
+}
+
+func (m *macro) equal(other val) bool {
+	return m == other
+}
+
+// An alias is named after the original symbol, followed by a NUL
+// character, the id of the macro and the number of the expansion that
+// introduced it.  An alias of an uninterned symbol shares its
+// identity.
+func (m *macro) alias(s symbol, expansion int) symbol {
+	return symbol{name: fmt.Sprintf("%s\x00%d.%d", s.name, m.id, expansion), u: s.u}
+}
+
+// aliasOf returns the symbol that s is an alias of, and the macro
+// whose expansion introduced it.  The last result is false if s isn't
+// an alias.
+func aliasOf(s symbol) (symbol, *macro, bool) {
+	i := strings.LastIndexByte(s.name, 0)
+	if i < 0 {
+		return s, nil, false
+	}
+	var id, expansion int
+	if _, err := fmt.Sscanf(s.name[i+1:], "%d.%d", &id, &expansion); err != nil || id >= len(macros) {
+		return s, nil, false
+	}
+	return symbol{name: s.name[:i], u: s.u}, macros[id], true
+}
+
+// unalias returns the symbol that v is an alias of, through any
+// number of expansions.  Other values are returned unchanged.
+func unalias(v val) val {
+	s, ok := v.(symbol)
+	if !ok {
+		return v
+	}
+	for {
+		orig, _, isAlias := aliasOf(s)
+		if !isAlias {
+			return s
+		}
+		s = orig
+	}
+}
+
+// isSymbolNamed checks whether v is the symbol name, or an alias
+// of it.
+func isSymbolNamed(v val, name string) bool {
+	return unalias(v) == val(symbol{name: name})
+}
+
+// lookupIdentifier looks up s in e.  If s is an alias that isn't bound
+// in e, the symbol it's an alias of is looked up in the environment
+// of its macro.
+func lookupIdentifier(e env, s symbol) (val, bool) {
+	for {
+		if v, ok := e.lookup(s); ok {
+			return v, true
+		}
+		orig, m, isAlias := aliasOf(s)
+		if !isAlias {
+			return nil, false
+		}
+		e, s = m.env, orig
+	}
+}
+
+// setIdentifier is the set! counterpart of lookupIdentifier.
+func setIdentifier(e env, s symbol, v val) bool {
+	for {
+		if e.set(s, v) {
+			return true
+		}
+		orig, m, isAlias := aliasOf(s)
+		if !isAlias {
+			return false
+		}
+		e, s = m.env, orig
+	}
+}
+
+// containsAlias checks whether v contains an alias.
+func containsAlias(v val, visited map[val]bool) bool {
+	switch v := v.(type) {
+	case symbol:
+		_, _, isAlias := aliasOf(v)
+		return isAlias
+	case *cons:
+		if visited[v] {
+			return false
+		}
+		visited[v] = true
+		return containsAlias(v.car, visited) || containsAlias(v.cdr, visited)
+	case *vector:
+		if visited[v] {
+			return false
+		}
+		visited[v] = true
+		for _, item := range v.items {
+			if containsAlias(item, visited) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// macroexpand1 returns the expansion of form if it's the use of a
+// macro in e.  The last result is false if it isn't.
+func macroexpand1(e env, form val) (val, bool) {
+	c, ok := form.(*cons)
+	if !ok {
+		return form, false
+	}
+	head, ok := c.car.(symbol)
+	if !ok {
+		return form, false
+	}
+	binding, _ := lookupIdentifier(e, head)
+	m, ok := binding.(transformer)
+	if !ok {
+		return form, false
+	}
+	return m.expand(c), true
+}
+
+// stripAliases returns v with all aliases replaced by the symbols
+// they're aliases of.  Parts of v that don't contain aliases are
+// shared, not copied.
+func stripAliases(v val) val {
+	if !containsAlias(v, map[val]bool{}) {
+		return v
+	}
+	switch v := v.(type) {
+	case symbol:
+		return unalias(v)
+	case *cons:
+		return &cons{car: stripAliases(v.car), cdr: stripAliases(v.cdr), loc: v.loc}
+	case *vector:
+		items := make([]val, len(v.items))
+		for i, item := range v.items {
+			items[i] = stripAliases(item)
+		}
+		return &vector{items: items}
+	}
+	return v
+}
+
+// stripQuotedAliases strips the aliases from the quoted data and
+// vector literals in the expansion v, since they're data, not code.
+// The templates of macros that the expansion defines are left alone,
+// because they're stripped when those macros are expanded.
+func stripQuotedAliases(v val, visited map[val]bool) val {
+	switch vv := v.(type) {
+	case *cons:
+		if visited[vv] || isSymbolNamed(vv.car, "syntax-rules") {
+			return v
+		}
+		visited[vv] = true
+		if rest, ok := vv.cdr.(*cons); ok && isSymbolNamed(vv.car, "quote") {
+			rest.car = stripAliases(rest.car)
+			return v
+		}
+		vv.car = stripQuotedAliases(vv.car, visited)
+		vv.cdr = stripQuotedAliases(vv.cdr, visited)
+	case *vector:
+		return stripAliases(vv)
+	}
+	return v
+}
+
+// evalDefineSyntax evaluates
+//
+//	(define-syntax name (syntax-rules ...))
+func evalDefineSyntax(e env, forms seq) val {
+	items := syntaxItems("define-syntax", forms, 2)
+	name, ok := items[0].(symbol)
+	if !ok || len(items) != 2 {
+		panic(fmt.Sprintf("define-syntax: invalid syntax %s", forms.pr()))
+	}
+	e.define(name, newMacro(unalias(name).(symbol).name, items[1], e))
+	return unspecified{}
+}
+
+// evalLetSyntax evaluates
+//
+//	(let-syntax ((name (syntax-rules ...)) ...) body ...)
+//
+// and `letrec-syntax`, whose macros can refer to each other.
+func evalLetSyntax(e env, name string, forms seq) val {
+	items := syntaxItems(name, forms, 2)
+	frame := newLocalEnv(e)
+	macroEnv := e
+	if name == "letrec-syntax" {
+		macroEnv = frame
+	}
+	for _, b := range syntaxItems(name, items[0], 0) {
+		binding := syntaxItems(name, b, 2)
+		keyword, ok := binding[0].(symbol)
+		if !ok || len(binding) != 2 {
+			panic(fmt.Sprintf("%s: invalid binding %s", name, b.pr()))
+		}
+		frame.define(keyword, newMacro(unalias(keyword).(symbol).name, binding[1], macroEnv))
+	}
+	return evalBody(frame, forms.rest())
+}
+
+// newMacro makes a macro from the transformer spec
+//
+//	(syntax-rules (literal ...) (pattern template) ...)
+//
+// or, with a custom ellipsis,
+//
+//	(syntax-rules ellipsis (literal ...) (pattern template) ...)
+func newMacro(name string, spec val, e env) *macro {
+	items := syntaxItems("syntax-rules", spec, 2)
+	if !isSymbolNamed(items[0], "syntax-rules") {
+		panic(fmt.Sprintf("%s: unsupported transformer %s", name, spec.pr()))
+	}
+	m := &macro{name: name, id: len(macros), ellipsis: "...", literals: map[string]bool{}, env: e}
+	items = items[1:]
+	if s, ok := items[0].(symbol); ok {
+		m.ellipsis = unalias(s).(symbol).name
+		items = items[1:]
+		if len(items) == 0 {
+			panic(fmt.Sprintf("syntax-rules: invalid syntax %s", spec.pr()))
+		}
+	}
+	for _, l := range syntaxItems("syntax-rules", items[0], 0) {
+		s, ok := l.(symbol)
+		if !ok {
+			panic(fmt.Sprintf("syntax-rules: invalid literal %s", l.pr()))
+		}
+		m.literals[unalias(s).(symbol).name] = true
+	}
+	for _, r := range items[1:] {
+		rule := syntaxItems("syntax-rules", r, 2)
+		if _, ok := rule[0].(*cons); !ok || len(rule) != 2 {
+			panic(fmt.Sprintf("syntax-rules: invalid rule %s", r.pr()))
+		}
+		m.rules = append(m.rules, macroRule{pattern: rule[0], template: rule[1]})
+	}
+	macros = append(macros, m)
+	return m
+}
+
+func (m *macro) isEllipsis(v val) bool {
+	return isSymbolNamed(v, m.ellipsis)
+}
+
+func (m *macro) isLiteral(s symbol) bool {
+	return m.literals[unalias(s).(symbol).name]
+}
+
+// expand returns the expansion of form by the first rule whose
+// pattern matches it.
+func (m *macro) expand(form *cons) val {
+	for _, r := range m.rules {
+		b := map[symbol]*matchTree{}
+		// The keyword in the pattern is ignored.
+		if !m.match(r.pattern.(*cons).cdr, form.cdr, b) {
+			continue
+		}
+		expansionCounter++
+		x := &expansion{m: m, bindings: b, number: expansionCounter, renames: map[symbol]symbol{}}
+		result := stripQuotedAliases(x.instantiate(r.template, false), map[val]bool{})
+		if c, ok := result.(*cons); ok && c.loc == nil {
+			c.loc = form.loc
+		}
+		return result
+	}
+	panic(fmt.Sprintf("%s: no syntax rule matches %s", m.name, stripAliases(form).pr()))
+}
+
+// matchTree is what a pattern variable has matched: a form, or for a
+// variable followed by ellipses, a sequence of matches.
+type matchTree struct {
+	form  val
+	isSeq bool
+	seq   []*matchTree
+}
+
+func (m *macro) match(pattern val, form val, b map[symbol]*matchTree) bool {
+	switch p := pattern.(type) {
+	case symbol:
+		if m.isLiteral(p) {
+			s, ok := form.(symbol)
+			return ok && unalias(s) == unalias(p)
+		}
+		if !isSymbolNamed(p, "_") {
+			b[p] = &matchTree{form: form}
+		}
+		return true
+	case *cons:
+		return m.matchList(p, form, b)
+	case *vector:
+		fv, ok := form.(*vector)
+		return ok && m.matchList(list(p.items...), list(fv.items...), b)
+	case empty:
+		_, ok := form.(empty)
+		return ok
+	}
+	return isAtom(pattern) && pattern.equal(form)
+}
+
+// isAtom checks whether v is a datum that's compared with equal? in
+// patterns, like a string.
+func isAtom(v val) bool {
+	switch v.(type) {
+	case str, char, boolean, keyword:
+		return true
+	}
+	return isNumber(v)
+}
+
+// matchList matches a list pattern, which can contain one element
+// followed by an ellipsis, and can have a dotted tail.
+func (m *macro) matchList(pattern val, form val, b map[symbol]*matchTree) bool {
+	var pre, post []val
+	var repeated val
+	hasEllipsis := false
+	tail := pattern
+	for {
+		c, ok := tail.(*cons)
+		if !ok {
+			break
+		}
+		if next, ok := c.cdr.(*cons); ok && m.isEllipsis(next.car) {
+			if hasEllipsis {
+				panic(fmt.Sprintf("%s: more than one ellipsis in pattern %s", m.name, pattern.pr()))
+			}
+			hasEllipsis, repeated, tail = true, c.car, next.cdr
+			continue
+		}
+		if hasEllipsis {
+			post = append(post, c.car)
+		} else {
+			pre = append(pre, c.car)
+		}
+		tail = c.cdr
+	}
+
+	if !hasEllipsis {
+		for _, p := range pre {
+			c, ok := form.(*cons)
+			if !ok || !m.match(p, c.car, b) {
+				return false
+			}
+			form = c.cdr
+		}
+		return m.match(tail, form, b)
+	}
+
+	items := []val{}
+	formTail := form
+	for {
+		c, ok := formTail.(*cons)
+		if !ok {
+			break
+		}
+		items = append(items, c.car)
+		formTail = c.cdr
+	}
+	if _, ok := tail.(empty); ok {
+		if _, ok := formTail.(empty); !ok {
+			return false
+		}
+	} else if !m.match(tail, formTail, b) {
+		return false
+	}
+	n := len(items) - len(post)
+	if n < len(pre) {
+		return false
+	}
+	for i, p := range pre {
+		if !m.match(p, items[i], b) {
+			return false
+		}
+	}
+	for i, p := range post {
+		if !m.match(p, items[n+i], b) {
+			return false
+		}
+	}
+	subs := []map[symbol]*matchTree{}
+	for _, item := range items[len(pre):n] {
+		sub := map[symbol]*matchTree{}
+		if !m.match(repeated, item, sub) {
+			return false
+		}
+		subs = append(subs, sub)
+	}
+	for _, v := range m.patternVars(repeated, nil) {
+		mt := &matchTree{isSeq: true, seq: []*matchTree{}}
+		for _, sub := range subs {
+			mt.seq = append(mt.seq, sub[v])
+		}
+		b[v] = mt
+	}
+	return true
+}
+
+// patternVars appends the pattern variables in pattern to vars.
+func (m *macro) patternVars(pattern val, vars []symbol) []symbol {
+	switch p := pattern.(type) {
+	case symbol:
+		if !m.isLiteral(p) && !m.isEllipsis(p) && !isSymbolNamed(p, "_") {
+			vars = append(vars, p)
+		}
+	case *cons:
+		vars = m.patternVars(p.car, vars)
+		vars = m.patternVars(p.cdr, vars)
+	case *vector:
+		for _, item := range p.items {
+			vars = m.patternVars(item, vars)
+		}
+	}
+	return vars
+}
+
+// expansion is the state of a single macro expansion.
+type expansion struct {
+	m        *macro
+	bindings map[symbol]*matchTree
+	number   int
+	renames  map[symbol]symbol
+}
+
+// instantiate fills in the template t.  If escaped is set, ellipses
+// are treated as ordinary symbols, as in the template of `(... ...)`.
+func (x *expansion) instantiate(t val, escaped bool) val {
+	switch t := t.(type) {
+	case symbol:
+		if mt, ok := x.bindings[t]; ok {
+			if mt.isSeq {
+				panic(fmt.Sprintf("%s: pattern variable %s used without ellipsis", x.m.name, unalias(t).pr()))
+			}
+			return mt.form
+		}
+		if r, ok := x.renames[t]; ok {
+			return r
+		}
+		r := x.m.alias(t, x.number)
+		x.renames[t] = r
+		return r
+	case *cons:
+		if !escaped && x.m.isEllipsis(t.car) {
+			rest, ok := t.cdr.(*cons)
+			if !ok || rest.cdr != val(empty{}) {
+				panic(fmt.Sprintf("%s: invalid ellipsis escape %s", x.m.name, t.pr()))
+			}
+			return x.instantiate(rest.car, true)
+		}
+		items := []val{}
+		var tail val = t
+		for {
+			c, ok := tail.(*cons)
+			if !ok {
+				break
+			}
+			tail = c.cdr
+			depth := 0
+			for !escaped {
+				next, ok := tail.(*cons)
+				if !ok || !x.m.isEllipsis(next.car) {
+					break
+				}
+				depth++
+				tail = next.cdr
+			}
+			if depth == 0 {
+				items = append(items, x.instantiate(c.car, escaped))
+			} else {
+				items = append(items, x.instantiateRepeated(c.car, depth)...)
+			}
+		}
+		result := x.instantiate(tail, escaped)
+		for i := len(items) - 1; i >= 0; i-- {
+			result = &cons{car: items[i], cdr: result}
+		}
+		return result
+	case *vector:
+		return &vector{items: seqToSlice(x.instantiate(list(t.items...), escaped).(seq))}
+	}
+	return t
+}
+
+// instantiateRepeated fills in the template t, which is followed by
+// depth ellipses, once for each match of its pattern variables.
+func (x *expansion) instantiateRepeated(t val, depth int) []val {
+	vars := []symbol{}
+	n := -1
+	for _, v := range x.m.patternVars(t, nil) {
+		mt, ok := x.bindings[v]
+		if !ok || !mt.isSeq {
+			continue
+		}
+		if n >= 0 && len(mt.seq) != n {
+			panic(fmt.Sprintf("%s: pattern variables in %s matched different numbers of forms", x.m.name, stripAliases(t).pr()))
+		}
+		n = len(mt.seq)
+		vars = append(vars, v)
+	}
+	if n < 0 {
+		panic(fmt.Sprintf("%s: no pattern variable to repeat in %s", x.m.name, stripAliases(t).pr()))
+	}
+	results := []val{}
+	for i := 0; i < n; i++ {
+		sub := &expansion{m: x.m, bindings: map[symbol]*matchTree{}, number: x.number, renames: x.renames}
+		for k, v := range x.bindings {
+			sub.bindings[k] = v
+		}
+		for _, v := range vars {
+			sub.bindings[v] = x.bindings[v].seq[i]
+		}
+		if depth > 1 {
+			results = append(results, sub.instantiateRepeated(t, depth-1)...)
+		} else {
+			results = append(results, sub.instantiate(t, false))
+		}
+	}
+	return results
+}
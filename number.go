@@ -0,0 +1,755 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"math/bits"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type number struct {
+	i int64
+}
+
+func (n number) pr() string {
+	return fmt.Sprintf("%v", n.i)
+}
+
+func (n number) equal(other val) bool {
+	nn, ok := other.(number)
+	if !ok {
+		return false
+	}
+	return n.i == nn.i
+}
+
+// bignum is an integer that doesn't fit into an int64.  Use
+// makeInteger to construct one, so that smaller integers are always
+// represented as number.
+type bignum struct {
+	b *big.Int
+}
+
+func (b bignum) pr() string {
+	return b.b.String()
+}
+
+func (b bignum) equal(other val) bool {
+	bb, ok := other.(bignum)
+	if !ok {
+		return false
+	}
+	return b.b.Cmp(bb.b) == 0
+}
+
+func makeInteger(b *big.Int) val {
+	if b.IsInt64() {
+		return number{b.Int64()}
+	}
+	return bignum{b}
+}
+
+// flonum is an inexact real number.
+type flonum struct {
+	f float64
+}
+
+func (f flonum) pr() string {
+	switch {
+	case math.IsNaN(f.f):
+		return "+nan.0"
+	case math.IsInf(f.f, 1):
+		return "+inf.0"
+	case math.IsInf(f.f, -1):
+		return "-inf.0"
+	}
+	s := strconv.FormatFloat(f.f, 'g', -1, 64)
+	// Make sure the number doesn't read back as an integer.
+	if !strings.ContainsAny(s, ".e") {
+		s += ".0"
+	}
+	return s
+}
+
+func (f flonum) equal(other val) bool {
+	ff, ok := other.(flonum)
+	if !ok {
+		return false
+	}
+	return f.f == ff.f
+}
+
+// rational is an exact non-integer number.  Use makeRational to
+// construct one, so that integers are always represented as number.
+type rational struct {
+	r *big.Rat
+}
+
+func (r rational) pr() string {
+	return r.r.RatString()
+}
+
+func (r rational) equal(other val) bool {
+	rr, ok := other.(rational)
+	if !ok {
+		return false
+	}
+	return r.r.Cmp(rr.r) == 0
+}
+
+func makeRational(r *big.Rat) val {
+	if r.IsInt() {
+		return makeInteger(new(big.Int).Set(r.Num()))
+	}
+	return rational{r}
+}
+
+func isNumber(v val) bool {
+	switch v.(type) {
+	case number, bignum, rational, flonum:
+		return true
+	}
+	return false
+}
+
+func isExact(v val) bool {
+	switch v.(type) {
+	case number, bignum, rational:
+		return true
+	}
+	return false
+}
+
+func toRat(v val) *big.Rat {
+	switch v := v.(type) {
+	case number:
+		return new(big.Rat).SetInt64(v.i)
+	case bignum:
+		return new(big.Rat).SetInt(v.b)
+	case rational:
+		return v.r
+	}
+	panic(fmt.Sprintf("not an exact number: %s", v.pr()))
+}
+
+func toFloat(v val) float64 {
+	switch v := v.(type) {
+	case number:
+		return float64(v.i)
+	case bignum:
+		f, _ := new(big.Float).SetInt(v.b).Float64()
+		return f
+	case rational:
+		f, _ := v.r.Float64()
+		return f
+	case flonum:
+		return v.f
+	}
+	panic(fmt.Sprintf("not a number: %s", v.pr()))
+}
+
+// The arithmetic operations return an inexact result if either
+// argument is inexact, and an exact one otherwise.
+
+func numAdd(a, b val) val {
+	if !isExact(a) || !isExact(b) {
+		return flonum{toFloat(a) + toFloat(b)}
+	}
+	if x, ok := a.(number); ok {
+		if y, ok := b.(number); ok {
+			sum := x.i + y.i
+			// Overflow happened if both operands have the same
+			// sign and the sum's sign differs.
+			if (x.i >= 0) == (y.i >= 0) && (sum >= 0) != (x.i >= 0) {
+				return makeInteger(new(big.Int).Add(big.NewInt(x.i), big.NewInt(y.i)))
+			}
+			return number{sum}
+		}
+	}
+	return makeRational(new(big.Rat).Add(toRat(a), toRat(b)))
+}
+
+func numMul(a, b val) val {
+	if !isExact(a) || !isExact(b) {
+		return flonum{toFloat(a) * toFloat(b)}
+	}
+	if x, ok := a.(number); ok {
+		if y, ok := b.(number); ok {
+			hi, lo := bits.Mul64(abs64(x.i), abs64(y.i))
+			if hi == 0 && lo <= math.MaxInt64 {
+				return number{x.i * y.i}
+			}
+			return makeInteger(new(big.Int).Mul(big.NewInt(x.i), big.NewInt(y.i)))
+		}
+	}
+	return makeRational(new(big.Rat).Mul(toRat(a), toRat(b)))
+}
+
+func numDiv(a, b val) val {
+	if !isExact(a) || !isExact(b) {
+		return flonum{toFloat(a) / toFloat(b)}
+	}
+	y := toRat(b)
+	if y.Sign() == 0 {
+		panic(fmt.Sprintf("division of %s by zero", a.pr()))
+	}
+	return makeRational(new(big.Rat).Quo(toRat(a), y))
+}
+
+// abs64 returns the absolute value of i, which doesn't overflow for
+// math.MinInt64 because it's unsigned.
+func abs64(i int64) uint64 {
+	if i < 0 {
+		return uint64(-i)
+	}
+	return uint64(i)
+}
+
+func numberArg(name string, args []val, i int) val {
+	if !isNumber(args[i]) {
+		panic(fmt.Sprintf("%s: not a number: %s", name, args[i].pr()))
+	}
+	return args[i]
+}
+
+func builtinIsExact(args []val) val {
+	checkArgCount("exact?", args, 1, 1)
+	return boolean{isExact(numberArg("exact?", args, 0))}
+}
+
+func builtinIsInexact(args []val) val {
+	checkArgCount("inexact?", args, 1, 1)
+	return boolean{!isExact(numberArg("inexact?", args, 0))}
+}
+
+// looksNumeric checks whether a token must be read as a number, i.e.
+// whether it starts with a digit, or with a sign and/or a decimal
+// point followed by a digit.  Tokens like `+`, `-`, `...` and `->x`
+// are symbols.
+func looksNumeric(s string) bool {
+	switch s {
+	case "+inf.0", "-inf.0", "+nan.0", "-nan.0":
+		return true
+	}
+	if s != "" && (s[0] == '+' || s[0] == '-') {
+		s = s[1:]
+	}
+	if s != "" && s[0] == '.' {
+		s = s[1:]
+	}
+	return s != "" && s[0] >= '0' && s[0] <= '9'
+}
+
+var integerRegexp = regexp.MustCompile(`^[+-]?\d+$`)
+
+var decimalRegexp = regexp.MustCompile(`^[+-]?(\d+\.?\d*|\.\d+)([eE][+-]?\d+)?$`)
+
+func parseNumber(s string) (val, error) {
+	switch s {
+	case "+inf.0":
+		return flonum{math.Inf(1)}, nil
+	case "-inf.0":
+		return flonum{math.Inf(-1)}, nil
+	case "+nan.0", "-nan.0":
+		return flonum{math.NaN()}, nil
+	}
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return number{i}, nil
+	}
+	if integerRegexp.MatchString(s) {
+		b, _ := new(big.Int).SetString(s, 10)
+		return makeInteger(b), nil
+	}
+	if strings.Contains(s, "/") {
+		return parseRational(s, 10)
+	}
+	if decimalRegexp.MatchString(s) {
+		f, err := strconv.ParseFloat(s, 64)
+		if err == nil {
+			return flonum{f}, nil
+		}
+	}
+	return nil, fmt.Errorf("bad number `%s`", s)
+}
+
+var radixPrefixes = map[rune]int{
+	'b': 2,
+	'o': 8,
+	'd': 10,
+	'x': 16,
+}
+
+// parseNumberToken parses a numeric token in the given radix, unless
+// it starts with a radix prefix like `#x`.  It's used both by the
+// reader and by `string->number`, so they agree on what's a number.
+func parseNumberToken(s string, radix int) (val, error) {
+	if len(s) >= 2 && s[0] == '#' {
+		r, ok := radixPrefixes[unicode.ToLower(rune(s[1]))]
+		if !ok {
+			return nil, fmt.Errorf("bad number `%s`", s)
+		}
+		s, radix = s[2:], r
+	}
+	return parseRadixNumber(s, radix)
+}
+
+// parseRadixNumber parses the number following a radix prefix like
+// `#x`.  Only decimal numbers can be inexact.
+func parseRadixNumber(s string, radix int) (val, error) {
+	if radix == 10 {
+		return parseNumber(s)
+	}
+	if strings.Contains(s, "/") {
+		return parseRational(s, radix)
+	}
+	b, ok := new(big.Int).SetString(s, radix)
+	if !ok {
+		return nil, fmt.Errorf("bad base %d number `%s`", radix, s)
+	}
+	return makeInteger(b), nil
+}
+
+// parseRational parses a fraction like `3/4`.  The result is
+// normalized, so `4/2` gives the integer 2.
+func parseRational(s string, radix int) (val, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) == 2 && parts[1] != "" && parts[1][0] != '+' && parts[1][0] != '-' {
+		num, okNum := new(big.Int).SetString(parts[0], radix)
+		den, okDen := new(big.Int).SetString(parts[1], radix)
+		if okNum && okDen && den.Sign() != 0 {
+			return makeRational(new(big.Rat).SetFrac(num, den)), nil
+		}
+	}
+	return nil, fmt.Errorf("bad number `%s`", s)
+}
+
+func builtinDiv(args []val) val {
+	checkArgCount("/", args, 1, -1)
+	if len(args) == 1 {
+		return numDiv(number{1}, numberArg("/", args, 0))
+	}
+	quot := numberArg("/", args, 0)
+	for i := 1; i < len(args); i++ {
+		quot = numDiv(quot, numberArg("/", args, i))
+	}
+	return quot
+}
+
+func rationalArg(name string, args []val, i int) *big.Rat {
+	if !isExact(args[i]) {
+		panic(fmt.Sprintf("%s: not an exact rational: %s", name, args[i].pr()))
+	}
+	return toRat(args[i])
+}
+
+func builtinNumerator(args []val) val {
+	checkArgCount("numerator", args, 1, 1)
+	return makeInteger(new(big.Int).Set(rationalArg("numerator", args, 0).Num()))
+}
+
+func builtinDenominator(args []val) val {
+	checkArgCount("denominator", args, 1, 1)
+	return makeInteger(new(big.Int).Set(rationalArg("denominator", args, 0).Denom()))
+}
+
+// numNeg returns -a, which is a bignum for the smallest int64.
+func numNeg(a val) val {
+	switch a := a.(type) {
+	case number:
+		if a.i == math.MinInt64 {
+			return makeInteger(new(big.Int).Neg(big.NewInt(a.i)))
+		}
+		return number{-a.i}
+	case bignum:
+		return makeInteger(new(big.Int).Neg(a.b))
+	case rational:
+		return makeRational(new(big.Rat).Neg(a.r))
+	case flonum:
+		return flonum{-a.f}
+	}
+	panic(fmt.Sprintf("not a number: %s", a.pr()))
+}
+
+func numSub(a, b val) val {
+	return numAdd(a, numNeg(b))
+}
+
+func builtinMinus(args []val) val {
+	checkArgCount("-", args, 1, -1)
+	if len(args) == 1 {
+		return numNeg(numberArg("-", args, 0))
+	}
+	diff := numberArg("-", args, 0)
+	for i := 1; i < len(args); i++ {
+		diff = numSub(diff, numberArg("-", args, i))
+	}
+	return diff
+}
+
+func integerArg(name string, args []val, i int) val {
+	switch v := args[i].(type) {
+	case number, bignum:
+		return v
+	case flonum:
+		if !math.IsInf(v.f, 0) && v.f == math.Trunc(v.f) {
+			return v
+		}
+	}
+	panic(fmt.Sprintf("%s: not an integer: %s", name, args[i].pr()))
+}
+
+func toBigInt(v val) *big.Int {
+	switch v := v.(type) {
+	case number:
+		return big.NewInt(v.i)
+	case bignum:
+		return v.b
+	}
+	panic(fmt.Sprintf("not an exact integer: %s", v.pr()))
+}
+
+// integerDivision returns the quotient and remainder of the integer
+// arguments of the builtin called name, truncating the quotient
+// towards zero, so the remainder has the sign of the dividend.
+func integerDivision(name string, args []val) (val, val) {
+	checkArgCount(name, args, 2, 2)
+	a, b := integerArg(name, args, 0), integerArg(name, args, 1)
+	if toFloat(b) == 0 {
+		panic(fmt.Sprintf("division of %s by zero", a.pr()))
+	}
+	if !isExact(a) || !isExact(b) {
+		x, y := toFloat(a), toFloat(b)
+		return flonum{math.Trunc(x / y)}, flonum{math.Mod(x, y)}
+	}
+	if x, ok := a.(number); ok {
+		if y, ok := b.(number); ok && !(x.i == math.MinInt64 && y.i == -1) {
+			return number{x.i / y.i}, number{x.i % y.i}
+		}
+	}
+	q, r := new(big.Int).QuoRem(toBigInt(a), toBigInt(b), new(big.Int))
+	return makeInteger(q), makeInteger(r)
+}
+
+func builtinQuotient(args []val) val {
+	q, _ := integerDivision("quotient", args)
+	return q
+}
+
+func builtinRemainder(args []val) val {
+	_, r := integerDivision("remainder", args)
+	return r
+}
+
+// builtinModulo returns the remainder of flooring division, which has
+// the sign of the divisor.
+func builtinModulo(args []val) val {
+	_, r := integerDivision("modulo", args)
+	if sign(r) != 0 && sign(r) != sign(args[1]) {
+		return numAdd(r, args[1])
+	}
+	return r
+}
+
+func sign(v val) int {
+	switch v := v.(type) {
+	case number:
+		switch {
+		case v.i < 0:
+			return -1
+		case v.i > 0:
+			return 1
+		}
+		return 0
+	case bignum:
+		return v.b.Sign()
+	case rational:
+		return v.r.Sign()
+	}
+	f := toFloat(v)
+	switch {
+	case f < 0:
+		return -1
+	case f > 0:
+		return 1
+	}
+	return 0
+}
+
+// numCompare compares a and b, returning whether they're comparable,
+// which they aren't if either is NaN.
+func numCompare(a, b val) (int, bool) {
+	if x, ok := a.(number); ok {
+		if y, ok := b.(number); ok {
+			switch {
+			case x.i < y.i:
+				return -1, true
+			case x.i > y.i:
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	if !isExact(a) && !isExact(b) {
+		x, y := toFloat(a), toFloat(b)
+		switch {
+		case math.IsNaN(x) || math.IsNaN(y):
+			return 0, false
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	}
+	if f, ok := a.(flonum); ok {
+		c, ok := compareExactFlonum(b, f.f)
+		return -c, ok
+	}
+	if f, ok := b.(flonum); ok {
+		return compareExactFlonum(a, f.f)
+	}
+	return toRat(a).Cmp(toRat(b)), true
+}
+
+// compareExactFlonum compares the exact number x with f.  Finite
+// flonums are converted to exact numbers, since converting x to a
+// flonum would lose precision.
+func compareExactFlonum(x val, f float64) (int, bool) {
+	switch {
+	case math.IsNaN(f):
+		return 0, false
+	case math.IsInf(f, 1):
+		return -1, true
+	case math.IsInf(f, -1):
+		return 1, true
+	}
+	return toRat(x).Cmp(new(big.Rat).SetFloat64(f)), true
+}
+
+// numericComparison returns the builtin called name, which checks
+// whether test holds for the comparison of each pair of consecutive
+// arguments.
+func numericComparison(name string, test func(int) bool) builtin {
+	return builtin{name: name, min: 1, max: -1, f: func(args []val) val {
+		checkArgCount(name, args, 1, -1)
+		for i := range args {
+			numberArg(name, args, i)
+		}
+		for i := 1; i < len(args); i++ {
+			c, ok := numCompare(args[i-1], args[i])
+			if !ok || !test(c) {
+				return boolean{false}
+			}
+		}
+		return boolean{true}
+	}}
+}
+
+// builtinExtremum returns the builtin called name, which returns the
+// argument for which the comparison with each other argument
+// satisfies test.  The result is inexact if any argument is.
+func builtinExtremum(name string, test func(int) bool) builtin {
+	return builtin{name: name, min: 1, max: -1, f: func(args []val) val {
+		checkArgCount(name, args, 1, -1)
+		result, exact := numberArg(name, args, 0), isExact(args[0])
+		for i := 1; i < len(args); i++ {
+			arg := numberArg(name, args, i)
+			exact = exact && isExact(arg)
+			if c, ok := numCompare(arg, result); !ok || test(c) {
+				result = arg
+			}
+		}
+		if !exact {
+			return flonum{toFloat(result)}
+		}
+		return result
+	}}
+}
+
+func builtinAbs(args []val) val {
+	checkArgCount("abs", args, 1, 1)
+	n := numberArg("abs", args, 0)
+	if sign(n) < 0 {
+		return numNeg(n)
+	}
+	return n
+}
+
+// builtinExpt raises a base to a power.  The result is exact if both
+// are exact and the power is an integer, so negative powers give
+// rationals.
+func builtinExpt(args []val) val {
+	checkArgCount("expt", args, 2, 2)
+	base, power := numberArg("expt", args, 0), numberArg("expt", args, 1)
+	if b, ok := power.(bignum); ok && isExact(base) {
+		return exptBignum(base, b.b)
+	}
+	p, isInt := power.(number)
+	if !isInt || !isExact(base) {
+		return flonum{math.Pow(toFloat(base), toFloat(power))}
+	}
+	if p.i < 0 {
+		return numDiv(number{1}, builtinExpt([]val{base, numNeg(p)}))
+	}
+	r := toRat(base)
+	e := big.NewInt(p.i)
+	return makeRational(new(big.Rat).SetFrac(new(big.Int).Exp(r.Num(), e, nil), new(big.Int).Exp(r.Denom(), e, nil)))
+}
+
+// exptBignum raises the exact base to the power p, which doesn't fit
+// into an int64.  Only the powers of 0, 1 and -1 are small enough to
+// compute.
+func exptBignum(base val, p *big.Int) val {
+	switch {
+	case sign(base) == 0:
+		if p.Sign() < 0 {
+			return numDiv(number{1}, base)
+		}
+		return base
+	case base.equal(number{1}):
+		return base
+	case base.equal(number{-1}):
+		if p.Bit(0) == 0 {
+			return number{1}
+		}
+		return base
+	}
+	panic(fmt.Sprintf("expt: exponent too large: %s", p))
+}
+
+// builtinGCDOrLCM returns `gcd` or `lcm`, whose results are
+// non-negative, and inexact if any argument is.
+func builtinGCDOrLCM(name string) builtin {
+	return builtin{name: name, min: 0, max: -1, f: func(args []val) val {
+		result, exact := big.NewInt(0), true
+		if name == "lcm" {
+			result.SetInt64(1)
+		}
+		for i := range args {
+			arg := integerArg(name, args, i)
+			var n *big.Int
+			if f, ok := arg.(flonum); ok {
+				exact = false
+				n, _ = big.NewFloat(f.f).Int(nil)
+			} else {
+				n = new(big.Int).Set(toBigInt(arg))
+			}
+			n.Abs(n)
+			gcd := new(big.Int).GCD(nil, nil, result, n)
+			if name == "gcd" {
+				result = gcd
+			} else if n.Sign() == 0 {
+				result = n
+			} else if result.Sign() != 0 {
+				result = n.Mul(n.Quo(n, gcd), result)
+			}
+		}
+		if !exact {
+			f, _ := new(big.Float).SetInt(result).Float64()
+			return flonum{f}
+		}
+		return makeInteger(result)
+	}}
+}
+
+// builtinSqrt returns an exact result for exact squares of rationals.
+func builtinSqrt(args []val) val {
+	checkArgCount("sqrt", args, 1, 1)
+	n := numberArg("sqrt", args, 0)
+	if sign(n) < 0 {
+		panic(fmt.Sprintf("sqrt: negative argument: %s", n.pr()))
+	}
+	if isExact(n) {
+		r := toRat(n)
+		num, den := new(big.Int).Sqrt(r.Num()), new(big.Int).Sqrt(r.Denom())
+		if new(big.Int).Mul(num, num).Cmp(r.Num()) == 0 && new(big.Int).Mul(den, den).Cmp(r.Denom()) == 0 {
+			return makeRational(new(big.Rat).SetFrac(num, den))
+		}
+	}
+	return flonum{math.Sqrt(toFloat(n))}
+}
+
+func builtinIsNumber(args []val) val {
+	checkArgCount("number?", args, 1, 1)
+	return boolean{isNumber(args[0])}
+}
+
+func builtinIsInteger(args []val) val {
+	checkArgCount("integer?", args, 1, 1)
+	switch v := args[0].(type) {
+	case number, bignum:
+		return boolean{true}
+	case flonum:
+		return boolean{!math.IsInf(v.f, 0) && v.f == math.Trunc(v.f)}
+	}
+	return boolean{false}
+}
+
+// builtinSignTest returns the builtin called name, which checks
+// whether the sign of its argument satisfies test.  NaN has no sign.
+func builtinSignTest(name string, test func(int) bool) builtin {
+	return builtin{name: name, min: 1, max: 1, f: func(args []val) val {
+		checkArgCount(name, args, 1, 1)
+		n := numberArg(name, args, 0)
+		if f, ok := n.(flonum); ok && math.IsNaN(f.f) {
+			return boolean{false}
+		}
+		return boolean{test(sign(n))}
+	}}
+}
+
+// builtinParityTest returns `odd?` or `even?`.
+func builtinParityTest(name string, odd bool) builtin {
+	return builtin{name: name, min: 1, max: 1, f: func(args []val) val {
+		checkArgCount(name, args, 1, 1)
+		_, r := integerDivision(name, []val{integerArg(name, args, 0), number{2}})
+		return boolean{(sign(r) != 0) == odd}
+	}}
+}
+
+func radixArg(name string, args []val, i int) int {
+	if len(args) <= i {
+		return 10
+	}
+	radix := intArg(name, args, i)
+	switch radix {
+	case 2, 8, 10, 16:
+		return int(radix)
+	}
+	panic(fmt.Sprintf("%s: invalid radix %d", name, radix))
+}
+
+// builtinStringToNumber returns the number a string denotes, or #f if
+// it's not a number.
+func builtinStringToNumber(args []val) val {
+	checkArgCount("string->number", args, 1, 2)
+	s, radix := stringArg("string->number", args, 0), radixArg("string->number", args, 1)
+	n, err := parseNumberToken(s, radix)
+	if err != nil {
+		return boolean{false}
+	}
+	return n
+}
+
+// builtinNumberToString writes a number in a radix, which can only be
+// different from 10 for exact numbers.
+func builtinNumberToString(args []val) val {
+	checkArgCount("number->string", args, 1, 2)
+	n, radix := numberArg("number->string", args, 0), radixArg("number->string", args, 1)
+	if radix == 10 {
+		return newStr(n.pr())
+	}
+	if !isExact(n) {
+		panic(fmt.Sprintf("number->string: inexact number in radix %d: %s", radix, n.pr()))
+	}
+	r := toRat(n)
+	s := r.Num().Text(radix)
+	if !r.IsInt() {
+		s += "/" + r.Denom().Text(radix)
+	}
+	return newStr(s)
+}
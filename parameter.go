@@ -0,0 +1,102 @@
+package main
+
+import "fmt"
+
+// parameter is a parameter object, as made by `make-parameter`.
+// Calling it returns its current value, which `parameterize` changes
+// for the dynamic extent of its body.  The converter, if there is
+// one, is applied to the initial value and to each value given in
+// `parameterize`.
+type parameter struct {
+	name      string
+	value     val
+	converter function
+}
+
+func (p *parameter) pr() string {
+	if p.name == "" {
+		return "#<parameter>"
+	}
+	return fmt.Sprintf("#<parameter:%s>", p.name)
+}
+
+func (p *parameter) equal(other val) bool {
+	return p == other
+}
+
+func (p *parameter) call(args []val) val {
+	checkArgCount(p.pr(), args, 0, 0)
+	return p.value
+}
+
+func (p *parameter) procedureName() string {
+	return p.name
+}
+
+func (p *parameter) procedureArity() arity {
+	return arity{0, 0}
+}
+
+func (p *parameter) convert(v val) val {
+	if p.converter == nil {
+		return v
+	}
+	return single(p.converter.call([]val{v}))
+}
+
+func builtinMakeParameter(args []val) val {
+	checkArgCount("make-parameter", args, 1, 2)
+	p := &parameter{}
+	if len(args) == 2 {
+		p.converter = functionArg("make-parameter", args, 1)
+	}
+	p.value = p.convert(args[0])
+	return p
+}
+
+// evalParameterize evaluates
+//
+//	(parameterize ((param value) ...) body ...)
+//
+// The parameters have the new values while the body is evaluated, in
+// a dynamic extent that's left when the body returns, raises an error
+// or invokes a continuation.
+func (m *machine) evalParameterize(e env, forms seq) {
+	if forms.empty() || !isList(forms.first()) {
+		panic("parameterize: invalid bindings")
+	}
+	type binding struct {
+		p     *parameter
+		value val
+	}
+	bindings := []binding{}
+	for _, b := range seqToSlice(forms.first().(seq)) {
+		if !isList(b) || len(seqToSlice(b.(seq))) != 2 {
+			panic(fmt.Sprintf("parameterize: invalid binding %s", b.pr()))
+		}
+		items := seqToSlice(b.(seq))
+		pv := single(eval(e, items[0]))
+		p, ok := pv.(*parameter)
+		if !ok {
+			panic(fmt.Sprintf("parameterize: not a parameter: %s", pv.pr()))
+		}
+		bindings = append(bindings, binding{p, p.convert(single(eval(e, items[1])))})
+	}
+
+	// Entering and leaving the extent swap the values of the
+	// parameters with the ones in the bindings.
+	swapIn := func() {
+		for i := range bindings {
+			b := &bindings[i]
+			b.p.value, b.value = b.value, b.p.value
+		}
+	}
+	swapOut := func() {
+		for i := len(bindings) - 1; i >= 0; i-- {
+			b := &bindings[i]
+			b.p.value, b.value = b.value, b.p.value
+		}
+	}
+	m.enter(newWind(swapIn, swapOut))
+	m.evalBody(e, forms.rest())
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// inputPort is a port that values are read from.  r buffers the
+// input from src.  Reading from an interactive port can wait for
+// input.
+type inputPort struct {
+	name        string
+	r           *bufio.Reader
+	src         io.Reader
+	closer      io.Closer
+	closed      bool
+	interactive bool
+}
+
+// outputPort is a port that values are written to.  Output string
+// ports collect their output in sb.
+type outputPort struct {
+	name   string
+	w      io.Writer
+	sb     *strings.Builder
+	closer io.Closer
+	closed bool
+}
+
+func newInputPort(name string, r io.Reader) *inputPort {
+	p := &inputPort{name: name, r: bufio.NewReader(r), src: r}
+	if c, ok := r.(io.Closer); ok {
+		p.closer = c
+	}
+	return p
+}
+
+func newOutputPort(name string, w io.Writer) *outputPort {
+	p := &outputPort{name: name, w: w}
+	if c, ok := w.(io.Closer); ok {
+		p.closer = c
+	}
+	return p
+}
+
+func newStringInputPort(s string) *inputPort {
+	return newInputPort("string", strings.NewReader(s))
+}
+
+func newStringOutputPort() *outputPort {
+	sb := &strings.Builder{}
+	return &outputPort{name: "string", w: sb, sb: sb}
+}
+
+func (p *inputPort) pr() string {
+	return fmt.Sprintf("#<input-port %s>", p.name)
+}
+
+func (p *inputPort) equal(other val) bool {
+	return p == other
+}
+
+func (p *outputPort) pr() string {
+	return fmt.Sprintf("#<output-port %s>", p.name)
+}
+
+func (p *outputPort) equal(other val) bool {
+	return p == other
+}
+
+func (p *inputPort) close() error {
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	if p.closer != nil {
+		return p.closer.Close()
+	}
+	return nil
+}
+
+func (p *outputPort) close() error {
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	if p.closer != nil {
+		return p.closer.Close()
+	}
+	return nil
+}
+
+// eofObject is returned by the reading procedures at the end of
+// input.
+type eofObject struct{}
+
+func (eofObject) pr() string {
+	return "#<eof>"
+}
+
+func (eofObject) equal(other val) bool {
+	_, ok := other.(eofObject)
+	return ok
+}
+
+// The parameters holding the current ports.  Standard input and
+// output aren't closed when their ports are.
+var (
+	currentInputPort = &parameter{
+		name:      "current-input-port",
+		value:     &inputPort{name: "stdin", r: bufio.NewReader(os.Stdin), src: os.Stdin, interactive: true},
+		converter: builtin{name: "current-input-port", f: checkInputPort, min: 1, max: 1},
+	}
+	currentOutputPort = &parameter{
+		name:      "current-output-port",
+		value:     &outputPort{name: "stdout", w: os.Stdout},
+		converter: builtin{name: "current-output-port", f: checkOutputPort, min: 1, max: 1},
+	}
+	currentErrorPort = &parameter{
+		name:      "current-error-port",
+		value:     &outputPort{name: "stderr", w: os.Stderr},
+		converter: builtin{name: "current-error-port", f: checkOutputPort, min: 1, max: 1},
+	}
+)
+
+func checkInputPort(args []val) val {
+	return inputPortArg("current-input-port", args, 0)
+}
+
+func checkOutputPort(args []val) val {
+	return outputPortArg("current-output-port", args, 0)
+}
+
+// currentOutput returns the current output port.
+func currentOutput() *outputPort {
+	return currentOutputPort.value.(*outputPort)
+}
+
+func inputPortArg(name string, args []val, i int) *inputPort {
+	p, ok := args[i].(*inputPort)
+	if !ok {
+		panic(fmt.Sprintf("%s: not an input port: %s", name, args[i].pr()))
+	}
+	return p
+}
+
+func outputPortArg(name string, args []val, i int) *outputPort {
+	p, ok := args[i].(*outputPort)
+	if !ok {
+		panic(fmt.Sprintf("%s: not an output port: %s", name, args[i].pr()))
+	}
+	return p
+}
+
+func builtinIsPort(args []val) val {
+	checkArgCount("port?", args, 1, 1)
+	switch args[0].(type) {
+	case *inputPort, *outputPort:
+		return boolean{true}
+	}
+	return boolean{false}
+}
+
+func builtinIsInputPort(args []val) val {
+	checkArgCount("input-port?", args, 1, 1)
+	_, ok := args[0].(*inputPort)
+	return boolean{ok}
+}
+
+func builtinIsOutputPort(args []val) val {
+	checkArgCount("output-port?", args, 1, 1)
+	_, ok := args[0].(*outputPort)
+	return boolean{ok}
+}
+
+func builtinIsInputPortOpen(args []val) val {
+	checkArgCount("input-port-open?", args, 1, 1)
+	return boolean{!inputPortArg("input-port-open?", args, 0).closed}
+}
+
+func builtinIsOutputPortOpen(args []val) val {
+	checkArgCount("output-port-open?", args, 1, 1)
+	return boolean{!outputPortArg("output-port-open?", args, 0).closed}
+}
+
+func builtinClosePort(args []val) val {
+	checkArgCount("close-port", args, 1, 1)
+	var err error
+	switch p := args[0].(type) {
+	case *inputPort:
+		err = p.close()
+	case *outputPort:
+		err = p.close()
+	default:
+		panic(fmt.Sprintf("close-port: not a port: %s", args[0].pr()))
+	}
+	if err != nil {
+		panic(fmt.Sprintf("close-port: %s", err))
+	}
+	return unspecified{}
+}
+
+func builtinCloseInputPort(args []val) val {
+	checkArgCount("close-input-port", args, 1, 1)
+	if err := inputPortArg("close-input-port", args, 0).close(); err != nil {
+		panic(fmt.Sprintf("close-input-port: %s", err))
+	}
+	return unspecified{}
+}
+
+func builtinCloseOutputPort(args []val) val {
+	checkArgCount("close-output-port", args, 1, 1)
+	if err := outputPortArg("close-output-port", args, 0).close(); err != nil {
+		panic(fmt.Sprintf("close-output-port: %s", err))
+	}
+	return unspecified{}
+}
+
+func builtinOpenInputString(args []val) val {
+	checkArgCount("open-input-string", args, 1, 1)
+	return newStringInputPort(stringArg("open-input-string", args, 0))
+}
+
+func builtinOpenOutputString(args []val) val {
+	checkArgCount("open-output-string", args, 0, 0)
+	return newStringOutputPort()
+}
+
+func builtinGetOutputString(args []val) val {
+	checkArgCount("get-output-string", args, 1, 1)
+	p := outputPortArg("get-output-string", args, 0)
+	if p.sb == nil {
+		panic(fmt.Sprintf("get-output-string: not a string port: %s", p.pr()))
+	}
+	return newStr(p.sb.String())
+}
+
+func builtinEOFObject(args []val) val {
+	checkArgCount("eof-object", args, 0, 0)
+	return eofObject{}
+}
+
+func builtinIsEOFObject(args []val) val {
+	checkArgCount("eof-object?", args, 1, 1)
+	_, ok := args[0].(eofObject)
+	return boolean{ok}
+}
+
+// readingPort returns the optional input port argument at index i,
+// which defaults to the current input port, and must be open.
+func readingPort(name string, args []val, i int) *inputPort {
+	p := currentInputPort.value.(*inputPort)
+	if len(args) > i {
+		p = inputPortArg(name, args, i)
+	}
+	if p.closed {
+		panic(fmt.Sprintf("%s: port is closed: %s", name, p.pr()))
+	}
+	return p
+}
+
+// readRune reads the next character from p, for the builtin called
+// name.  It returns false at the end of the input.
+func (p *inputPort) readRune(name string) (rune, bool) {
+	r, _, err := p.r.ReadRune()
+	if err == io.EOF {
+		return 0, false
+	}
+	if err != nil {
+		panic(fmt.Sprintf("%s: %s", name, err))
+	}
+	return r, true
+}
+
+// unread puts s back in front of the input that hasn't been read yet:
+// the input buffered by r, followed by the rest of src.  Nested
+// MultiReaders are flattened as they're read, so they don't pile up.
+func (p *inputPort) unread(s string) {
+	buffered, _ := p.r.Peek(p.r.Buffered())
+	p.src = io.MultiReader(strings.NewReader(s+string(buffered)), p.src)
+	p.r = bufio.NewReader(p.src)
+}
+
+// readDatum reads the next datum from p, for the builtin called name.
+// It returns false at the end of the input.  The reader reads whole
+// lines, so the rest of the line is put back for the other reading
+// procedures.
+func (p *inputPort) readDatum(name string) (val, bool) {
+	dr := &datumReader{r: p.r, ls: newLexState("")}
+	v, err := dr.next()
+	if rest := dr.ls.remaining(); rest != "" {
+		p.unread(rest)
+	}
+	if err == io.EOF {
+		return nil, false
+	}
+	if err != nil {
+		panic(fmt.Sprintf("%s: %s", name, err))
+	}
+	return v, true
+}
+
+func builtinRead(args []val) val {
+	checkArgCount("read", args, 0, 1)
+	v, ok := readingPort("read", args, 0).readDatum("read")
+	if !ok {
+		return eofObject{}
+	}
+	return v
+}
+
+func builtinReadChar(args []val) val {
+	checkArgCount("read-char", args, 0, 1)
+	r, ok := readingPort("read-char", args, 0).readRune("read-char")
+	if !ok {
+		return eofObject{}
+	}
+	return char{r}
+}
+
+func builtinPeekChar(args []val) val {
+	checkArgCount("peek-char", args, 0, 1)
+	p := readingPort("peek-char", args, 0)
+	r, ok := p.readRune("peek-char")
+	if !ok {
+		return eofObject{}
+	}
+	p.r.UnreadRune()
+	return char{r}
+}
+
+// builtinReadLine reads the characters up to the end of the line,
+// which isn't included.
+func builtinReadLine(args []val) val {
+	checkArgCount("read-line", args, 0, 1)
+	line, err := readingPort("read-line", args, 0).r.ReadString('\n')
+	if err == io.EOF && line == "" {
+		return eofObject{}
+	}
+	if err != nil && err != io.EOF {
+		panic(fmt.Sprintf("read-line: %s", err))
+	}
+	line = strings.TrimSuffix(line, "\n")
+	return newStr(strings.TrimSuffix(line, "\r"))
+}
+
+// builtinIsCharReady checks whether reading a character wouldn't have
+// to wait, which only an interactive port can.
+func builtinIsCharReady(args []val) val {
+	checkArgCount("char-ready?", args, 0, 1)
+	p := readingPort("char-ready?", args, 0)
+	return boolean{!p.interactive || p.r.Buffered() > 0}
+}
+
+// writingPort returns the optional output port argument at index i,
+// which defaults to the current output port, and must be open.
+func writingPort(name string, args []val, i int) *outputPort {
+	p := currentOutput()
+	if len(args) > i {
+		p = outputPortArg(name, args, i)
+	}
+	if p.closed {
+		panic(fmt.Sprintf("%s: port is closed: %s", name, p.pr()))
+	}
+	return p
+}
+
+// writeString writes s to p, for the builtin called name.
+func (p *outputPort) writeString(name string, s string) {
+	if _, err := io.WriteString(p.w, s); err != nil {
+		panic(fmt.Sprintf("%s: %s", name, err))
+	}
+}
+
+func builtinDisplay(args []val) val {
+	checkArgCount("display", args, 1, 2)
+	writingPort("display", args, 1).writeString("display", display(args[0]))
+	return unspecified{}
+}
+
+func builtinWrite(args []val) val {
+	checkArgCount("write", args, 1, 2)
+	writingPort("write", args, 1).writeString("write", args[0].pr())
+	return unspecified{}
+}
+
+func builtinNewline(args []val) val {
+	checkArgCount("newline", args, 0, 1)
+	writingPort("newline", args, 0).writeString("newline", "\n")
+	return unspecified{}
+}
+
+// builtinWriteString writes the characters of a string, optionally
+// restricted to a start and end index, without quotes.
+func builtinWriteString(args []val) val {
+	checkArgCount("write-string", args, 1, 4)
+	rs := []rune(stringArg("write-string", args, 0))
+	p := writingPort("write-string", args, 1)
+	start, end := rangeArgs("write-string", len(rs), args, 2)
+	p.writeString("write-string", string(rs[start:end]))
+	return unspecified{}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// prettyBodyForms gives, for special forms whose bodies should be
+// indented, the number of subforms that go on the same line as the
+// keyword.
+var prettyBodyForms = map[string]int{
+	"begin":         0,
+	"define":        1,
+	"define-syntax": 1,
+	"define-macro":  1,
+	"defmacro":      2,
+	"lambda":        1,
+	"let":           1,
+	"let*":          1,
+	"letrec":        1,
+	"letrec*":       1,
+	"let-values":    1,
+	"let*-values":   1,
+	"define-values": 1,
+	"let-syntax":    1,
+	"letrec-syntax": 1,
+	"syntax-rules":  1,
+	"parameterize":  1,
+	"when":          1,
+	"unless":        1,
+	"case":          1,
+	"do":            2,
+	"guard":         1,
+}
+
+const defaultPrettyWidth = 79
+
+type prettyPrinter struct {
+	b     strings.Builder
+	width int
+	col   int
+
+	// labels and nextLabel are like those of printer, for all of
+	// the value being printed, so that cycles are labelled like by
+	// `write`.
+	labels    map[val]int
+	nextLabel int
+}
+
+// prettyPrint returns the written representation of v, broken into
+// lines that are at most width characters wide where possible.
+func prettyPrint(v val, width int) string {
+	p := &printer{labels: map[val]int{}}
+	p.findCycles(v, map[val]bool{}, map[val]bool{})
+	pp := &prettyPrinter{width: width, labels: p.labels}
+	pp.print(v)
+	return pp.b.String()
+}
+
+// flat returns the written representation of v on one line, and the
+// printer that wrote it, which holds the labels it has printed.
+func (pp *prettyPrinter) flat(v val) (string, *printer) {
+	var b strings.Builder
+	p := &printer{w: bufio.NewWriter(&b), labels: make(map[val]int, len(pp.labels)), nextLabel: pp.nextLabel}
+	for lv, n := range pp.labels {
+		p.labels[lv] = n
+	}
+	p.print(v)
+	p.w.Flush()
+	return b.String(), p
+}
+
+// printLabel prints the label for v if it needs one, like
+// printer.printLabel.
+func (pp *prettyPrinter) printLabel(v val) bool {
+	n, ok := pp.labels[v]
+	if !ok {
+		return false
+	}
+	if n >= 0 {
+		pp.write("#" + strconv.Itoa(n) + "#")
+		return true
+	}
+	n = pp.nextLabel
+	pp.nextLabel++
+	pp.labels[v] = n
+	pp.write("#" + strconv.Itoa(n) + "=")
+	return false
+}
+
+// listItems returns the elements of the list c, unless it's improper
+// or one of its tails has a label, in which case it's printed flat.
+func (pp *prettyPrinter) listItems(c *cons) ([]val, bool) {
+	items := []val{c.car}
+	for tail := c.cdr; ; {
+		switch t := tail.(type) {
+		case empty:
+			return items, true
+		case *cons:
+			if _, labelled := pp.labels[t]; labelled {
+				return nil, false
+			}
+			items = append(items, t.car)
+			tail = t.cdr
+		default:
+			return nil, false
+		}
+	}
+}
+
+func (pp *prettyPrinter) write(s string) {
+	pp.b.WriteString(s)
+	if i := strings.LastIndexByte(s, '\n'); i >= 0 {
+		pp.col = len([]rune(s[i+1:]))
+	} else {
+		pp.col += len([]rune(s))
+	}
+}
+
+func (pp *prettyPrinter) newline(indent int) {
+	pp.write("\n" + strings.Repeat(" ", indent))
+}
+
+func (pp *prettyPrinter) print(v val) {
+	flat, p := pp.flat(v)
+	if pp.col+len([]rune(flat)) <= pp.width {
+		pp.write(flat)
+		pp.labels, pp.nextLabel = p.labels, p.nextLabel
+		return
+	}
+	switch v := v.(type) {
+	case *cons:
+		items, ok := pp.listItems(v)
+		if !ok {
+			pp.write(flat)
+			pp.labels, pp.nextLabel = p.labels, p.nextLabel
+			return
+		}
+		if pp.printLabel(v) {
+			return
+		}
+		pp.printList(items)
+	case *vector:
+		if pp.printLabel(v) {
+			return
+		}
+		pp.write("#(")
+		pp.printAligned(v.items, pp.col)
+		pp.write(")")
+	default:
+		pp.write(flat)
+		pp.labels, pp.nextLabel = p.labels, p.nextLabel
+	}
+}
+
+// printAligned prints each item on its own line, starting at the
+// current column and indented to col.
+func (pp *prettyPrinter) printAligned(items []val, col int) {
+	for i, item := range items {
+		if i > 0 {
+			pp.newline(col)
+		}
+		pp.print(item)
+	}
+}
+
+func (pp *prettyPrinter) printList(items []val) {
+	col := pp.col
+	pp.write("(")
+	head, ok := items[0].(symbol)
+	if !ok {
+		pp.printAligned(items, col+1)
+		pp.write(")")
+		return
+	}
+
+	pp.print(head)
+	args := items[1:]
+	if n, ok := prettyBodyForms[head.name]; ok {
+		if head.name == "let" && len(args) > 0 {
+			if _, named := args[0].(symbol); named {
+				n++
+			}
+		}
+		for n > 0 && len(args) > 0 {
+			pp.write(" ")
+			pp.print(args[0])
+			args = args[1:]
+			n--
+		}
+		for _, arg := range args {
+			pp.newline(col + 2)
+			pp.print(arg)
+		}
+	} else if len(args) > 0 {
+		// Everything else, including `if`, gets its arguments
+		// aligned with the first one.
+		pp.write(" ")
+		pp.printAligned(args, pp.col)
+	}
+	pp.write(")")
+}
+
+func builtinPP(args []val) val {
+	if len(args) < 1 || len(args) > 2 {
+		panic("pp expects 1 or 2 arguments")
+	}
+	width := defaultPrettyWidth
+	if len(args) == 2 {
+		n, ok := args[1].(number)
+		if !ok || n.i <= 0 {
+			panic(fmt.Sprintf("pp: invalid width %s", args[1].pr()))
+		}
+		width = int(n.i)
+	}
+	fmt.Fprintln(currentOutput().w, prettyPrint(args[0], width))
+	return unspecified{}
+}
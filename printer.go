@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// printer prints compound values directly to a writer, so that
+// printing large structures doesn't build large strings.  Conses,
+// vectors and boxes that are part of a cycle are labelled, as in
+// `#0=(1 . #0#)`, so that printing circular structure terminates.
+// Records are labelled the same way.
+type printer struct {
+	w       *bufio.Writer
+	display bool
+
+	// labels maps the values that need a label to their label
+	// number, or to -1 if they haven't been printed yet.
+	labels    map[val]int
+	nextLabel int
+}
+
+// printTo writes the written or, if display is set, the displayed
+// representation of v to w.
+func printTo(w io.Writer, v val, display bool) error {
+	p := &printer{w: bufio.NewWriter(w), display: display, labels: map[val]int{}}
+	p.findCycles(v, map[val]bool{}, map[val]bool{})
+	p.print(v)
+	return p.w.Flush()
+}
+
+// write writes the written representation of v to w.
+func write(w io.Writer, v val) error {
+	return printTo(w, v, false)
+}
+
+func printString(v val, display bool) string {
+	var b strings.Builder
+	printTo(&b, v, display)
+	return b.String()
+}
+
+// findCycles does a depth-first search for values that can reach
+// themselves.  inProgress holds the values on the current search
+// path, done those that have been searched completely.  The cdrs of
+// lists and the contents of boxes are followed iteratively so that
+// long chains don't exhaust the stack.
+func (p *printer) findCycles(v val, inProgress map[val]bool, done map[val]bool) {
+	path := []val{}
+	for {
+		switch v.(type) {
+		case *cons, *vector, *box, *record:
+		default:
+			v = nil
+		}
+		if v == nil || done[v] {
+			break
+		}
+		if inProgress[v] {
+			p.labels[v] = -1
+			break
+		}
+		inProgress[v] = true
+		path = append(path, v)
+		if c, ok := v.(*cons); ok {
+			p.findCycles(c.car, inProgress, done)
+			v = c.cdr
+			continue
+		}
+		if b, ok := v.(*box); ok {
+			v = b.v
+			continue
+		}
+		if r, ok := v.(*record); ok {
+			for _, f := range r.fields {
+				p.findCycles(f, inProgress, done)
+			}
+			break
+		}
+		for _, item := range v.(*vector).items {
+			p.findCycles(item, inProgress, done)
+		}
+		break
+	}
+	for _, v := range path {
+		delete(inProgress, v)
+		done[v] = true
+	}
+}
+
+// printLabel prints the label for v if it needs one.  It returns
+// whether v has already been printed, in which case the reference
+// `#n#` has been printed and v must not be printed again.
+func (p *printer) printLabel(v val) bool {
+	n, ok := p.labels[v]
+	if !ok {
+		return false
+	}
+	if n >= 0 {
+		p.w.WriteString("#" + strconv.Itoa(n) + "#")
+		return true
+	}
+	n = p.nextLabel
+	p.nextLabel++
+	p.labels[v] = n
+	p.w.WriteString("#" + strconv.Itoa(n) + "=")
+	return false
+}
+
+func (p *printer) print(v val) {
+	switch v := v.(type) {
+	case *cons:
+		if p.printLabel(v) {
+			return
+		}
+		p.w.WriteByte('(')
+		p.print(v.car)
+		tail := v.cdr
+		for {
+			c, ok := tail.(*cons)
+			if !ok {
+				break
+			}
+			if _, labelled := p.labels[c]; labelled {
+				break
+			}
+			p.w.WriteByte(' ')
+			p.print(c.car)
+			tail = c.cdr
+		}
+		if _, ok := tail.(empty); !ok {
+			p.w.WriteString(" . ")
+			p.print(tail)
+		}
+		p.w.WriteByte(')')
+	case *vector:
+		if p.printLabel(v) {
+			return
+		}
+		p.w.WriteString("#(")
+		for i, item := range v.items {
+			if i > 0 {
+				p.w.WriteByte(' ')
+			}
+			p.print(item)
+		}
+		p.w.WriteByte(')')
+	case *box:
+		if p.printLabel(v) {
+			return
+		}
+		p.w.WriteString("#&")
+		p.print(v.v)
+	case *record:
+		if p.printLabel(v) {
+			return
+		}
+		p.w.WriteString("#<" + v.rtype.name)
+		for i, f := range v.rtype.fields {
+			p.w.WriteString(" " + f + ": ")
+			p.print(v.fields[i])
+		}
+		p.w.WriteByte('>')
+	default:
+		if p.display {
+			p.w.WriteString(display(v))
+		} else {
+			p.w.WriteString(v.pr())
+		}
+	}
+}
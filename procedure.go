@@ -0,0 +1,309 @@
+package main
+
+import "fmt"
+
+// closure is a procedure created by `lambda`.  It evaluates its body
+// in a new frame, on top of the environment it was created in, that
+// binds the parameters to the arguments.  Optional parameters that
+// don't get an argument are bound to the value of their default
+// expression, or #f, and keyword parameters are bound to the values
+// following their keywords.  If the closure has a rest parameter, the
+// arguments after the required and optional ones are bound to it as a
+// list.  The names defined at the start of the body are bound in the
+// frame from the beginning, so they have `letrec*` semantics.
+// The body is compiled when the closure is first called.
+type closure struct {
+	name      string
+	params    []symbol
+	optionals []optionalParam
+	keys      []optionalParam
+	rest      symbol
+	variadic  bool
+	defines   []symbol
+	body      seq
+	env       env
+	code      *compiledBody
+}
+
+// optionalParam is a parameter that may be omitted, together with
+// the form that computes its default value, which is nil if the
+// default is #f.
+type optionalParam struct {
+	name symbol
+	init val
+}
+
+// lambdaListMarker is one of `#!optional`, `#!key` and `#!rest`, which
+// separate the kinds of parameters in a lambda list.
+type lambdaListMarker struct {
+	name string
+}
+
+func (m lambdaListMarker) pr() string {
+	return "#!" + m.name
+}
+
+func (m lambdaListMarker) equal(other val) bool {
+	om, ok := other.(lambdaListMarker)
+	return ok && m.name == om.name
+}
+
+func (c *closure) pr() string {
+	if c.name == "" {
+		return fmt.Sprintf("#<procedure (%s)>", c.procedureArity())
+	}
+	return fmt.Sprintf("#<procedure:%s (%s)>", c.name, c.procedureArity())
+}
+
+func (c *closure) equal(other val) bool {
+	return c == other
+}
+
+func (c *closure) procedureName() string {
+	return c.name
+}
+
+func (c *closure) procedureArity() arity {
+	n := len(c.params)
+	if c.variadic || len(c.keys) > 0 {
+		return arity{n, -1}
+	}
+	return arity{n, n + len(c.optionals)}
+}
+
+func (c *closure) call(args []val) val {
+	return callInMachine(c, args)
+}
+
+// bind returns a new frame for evaluating the body of c with the
+// parameters bound to args.
+func (c *closure) bind(args []val) env {
+	name := c.name
+	if name == "" {
+		name = "#<procedure>"
+	}
+	a := c.procedureArity()
+	checkArgCount(name, args, a.min, a.max)
+	frame := newLocalEnv(c.env)
+	for i, param := range c.params {
+		frame.define(param, args[i])
+	}
+	args = args[len(c.params):]
+	for _, o := range c.optionals {
+		if len(args) > 0 {
+			if _, ok := args[0].(keyword); !ok || len(c.keys) == 0 {
+				frame.define(o.name, args[0])
+				args = args[1:]
+				continue
+			}
+		}
+		frame.define(o.name, o.defaultValue(frame))
+	}
+	if c.variadic {
+		frame.define(c.rest, list(args...))
+	}
+	if len(c.keys) > 0 {
+		c.bindKeys(name, frame, args)
+	}
+	for _, d := range c.defines {
+		frame.define(d, unassigned{})
+	}
+	return frame
+}
+
+// bindKeys binds the keyword parameters of c in frame to the values
+// following their keywords in args.
+func (c *closure) bindKeys(name string, frame env, args []val) {
+	keyArgs := map[string]val{}
+	for ; len(args) > 0; args = args[2:] {
+		k, ok := args[0].(keyword)
+		if !ok {
+			if c.variadic {
+				break
+			}
+			panic(fmt.Sprintf("%s: not a keyword: %s", name, args[0].pr()))
+		}
+		if len(args) < 2 {
+			panic(fmt.Sprintf("%s: missing value for keyword %s", name, k.pr()))
+		}
+		if _, ok := keyArgs[k.name]; !ok {
+			keyArgs[k.name] = args[1]
+		}
+	}
+	for _, o := range c.keys {
+		if v, ok := keyArgs[unalias(o.name).(symbol).name]; ok {
+			frame.define(o.name, v)
+			delete(keyArgs, unalias(o.name).(symbol).name)
+		} else {
+			frame.define(o.name, o.defaultValue(frame))
+		}
+	}
+	if !c.variadic {
+		for k := range keyArgs {
+			panic(fmt.Sprintf("%s: unknown keyword %s", name, keyword{k}.pr()))
+		}
+	}
+}
+
+// defaultValue evaluates the default value of o in the frame that
+// binds the parameters before it.
+func (o optionalParam) defaultValue(frame env) val {
+	if o.init == nil {
+		return boolean{false}
+	}
+	return single(eval(frame, o.init))
+}
+
+// evalLambda evaluates
+//
+//	(lambda (param ... [#!optional opt ...] [#!key key ...] [#!rest rest]) body ...)
+//	(lambda (param ... . rest) body ...)
+//	(lambda rest body ...)
+//
+// where an optional or keyword parameter is either a name or a list
+// of a name and the expression for its default value.
+func evalLambda(e env, forms seq) val {
+	if forms.empty() || forms.rest().empty() {
+		panic("lambda: missing parameters or body")
+	}
+	c := &closure{params: []symbol{}, body: forms.rest(), env: e, code: &compiledBody{}}
+	seen := map[symbol]bool{}
+	param := func(p val) symbol {
+		s, ok := p.(symbol)
+		if !ok {
+			panic(fmt.Sprintf("lambda: invalid parameter %s", p.pr()))
+		}
+		if seen[s] {
+			panic(fmt.Sprintf("lambda: duplicate parameter %s", s.name))
+		}
+		seen[s] = true
+		return s
+	}
+	optional := func(p val) optionalParam {
+		if pc, ok := p.(*cons); ok {
+			if !isList(pc) || len(seqToSlice(pc)) != 2 {
+				panic(fmt.Sprintf("lambda: invalid parameter %s", p.pr()))
+			}
+			return optionalParam{name: param(pc.car), init: pc.rest().first()}
+		}
+		return optionalParam{name: param(p)}
+	}
+	// The kinds of parameters must come in this order.
+	kinds := []string{"required", "optional", "key", "rest"}
+	kind := 0
+	ps := forms.first()
+	for {
+		if p, ok := ps.(*cons); ok {
+			if m, ok := p.car.(lambdaListMarker); ok {
+				next := kind + 1
+				for next < len(kinds) && kinds[next] != m.name {
+					next++
+				}
+				if next == len(kinds) {
+					panic(fmt.Sprintf("lambda: misplaced %s", m.pr()))
+				}
+				kind = next
+				ps = p.cdr
+				if m.name == "rest" {
+					rest, ok := ps.(*cons)
+					if !ok || rest.cdr != val(empty{}) {
+						panic("lambda: #!rest must be followed by exactly one parameter")
+					}
+					c.rest = param(rest.car)
+					c.variadic = true
+					break
+				}
+				continue
+			}
+			switch kinds[kind] {
+			case "required":
+				c.params = append(c.params, param(p.car))
+			case "optional":
+				c.optionals = append(c.optionals, optional(p.car))
+			case "key":
+				c.keys = append(c.keys, optional(p.car))
+			}
+			ps = p.cdr
+			continue
+		}
+		if _, ok := ps.(empty); !ok {
+			c.rest = param(ps)
+			c.variadic = true
+		}
+		break
+	}
+	if !isList(forms.rest()) {
+		panic("lambda: invalid body")
+	}
+	c.defines, _ = definedNames(c.body)
+	return c
+}
+
+// definedNames returns the names defined by the definitions at the
+// start of body, including those in `begin` forms, and whether the
+// body consists of nothing but definitions.
+func definedNames(body seq) ([]symbol, bool) {
+	names := []symbol{}
+	for ; !body.empty(); body = body.rest() {
+		form, ok := body.first().(*cons)
+		if !ok {
+			return names, false
+		}
+		switch {
+		case isSymbolNamed(form.car, "define"):
+			target := val(nil)
+			if t, ok := form.cdr.(*cons); ok {
+				target = t.car
+			}
+			if t, ok := target.(*cons); ok {
+				target = t.car
+			}
+			if s, ok := target.(symbol); ok {
+				names = append(names, s)
+			}
+		case isSymbolNamed(form.car, "define-values"):
+			if t, ok := form.cdr.(*cons); ok {
+				_, formals, _ := renameFormals("define-values", t.car)
+				for _, f := range formals {
+					names = append(names, f.(symbol))
+				}
+			}
+		case isSymbolNamed(form.car, "begin") && isList(form):
+			inner, all := definedNames(form.rest())
+			names = append(names, inner...)
+			if !all {
+				return names, false
+			}
+		default:
+			return names, false
+		}
+	}
+	return names, true
+}
+
+// builtinProcedureName returns the name of a procedure as a symbol,
+// or #f if it's anonymous.
+func builtinProcedureName(args []val) val {
+	checkArgCount("procedure-name", args, 1, 1)
+	name := functionArg("procedure-name", args, 0).procedureName()
+	if name == "" {
+		return boolean{false}
+	}
+	return symbol{name: name}
+}
+
+// builtinProcedureArity returns the number of arguments a procedure
+// takes if it's fixed, and otherwise a pair of the minimum and the
+// maximum, which is #f if there's no limit.
+func builtinProcedureArity(args []val) val {
+	checkArgCount("procedure-arity", args, 1, 1)
+	a := functionArg("procedure-arity", args, 0).procedureArity()
+	if a.min == a.max {
+		return number{int64(a.min)}
+	}
+	var max val = boolean{false}
+	if a.max >= 0 {
+		max = number{int64(a.max)}
+	}
+	return &cons{car: number{int64(a.min)}, cdr: max}
+}
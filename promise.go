@@ -0,0 +1,66 @@
+package main
+
+import "fmt"
+
+// promise is a value that's computed when it's first forced and
+// remembered after that.  Promises created with `delay-force` are
+// lazy: their expression evaluates to another promise, which is forced
+// in turn, without growing the stack.
+type promise struct {
+	done  bool
+	value val
+	expr  val
+	env   env
+	lazy  bool
+}
+
+func (p *promise) pr() string {
+	return "#<promise>"
+}
+
+func (p *promise) equal(other val) bool {
+	return p == other
+}
+
+func (p *promise) force() val {
+	for !p.done {
+		v := eval(p.env, p.expr)
+		// Forcing the expression might have forced p, too.
+		if p.done {
+			break
+		}
+		if !p.lazy {
+			p.done, p.value = true, v
+			break
+		}
+		q, ok := v.(*promise)
+		if !ok {
+			panic(fmt.Sprintf("delay-force: not a promise: %s", v.pr()))
+		}
+		p.done, p.value, p.expr, p.env, p.lazy = q.done, q.value, q.expr, q.env, q.lazy
+	}
+	p.expr, p.env = nil, nil
+	return p.value
+}
+
+func builtinForce(args []val) val {
+	checkArgCount("force", args, 1, 1)
+	if p, ok := args[0].(*promise); ok {
+		return p.force()
+	}
+	return args[0]
+}
+
+func builtinMakePromise(args []val) val {
+	checkArgCount("make-promise", args, 1, 1)
+	if p, ok := args[0].(*promise); ok {
+		return p
+	}
+	return &promise{done: true, value: args[0]}
+}
+
+func builtinIsPromise(args []val) val {
+	checkArgCount("promise?", args, 1, 1)
+	_, ok := args[0].(*promise)
+	return boolean{ok}
+}
@@ -0,0 +1,110 @@
+package main
+
+import "fmt"
+
+// The procedures used by the expansion of quasiquote.  They're put
+// into the expansion as values, so they can't be shadowed.
+var (
+	qqCons = builtin{name: "cons", min: 2, max: 2, f: func(args []val) val {
+		return &cons{car: args[0], cdr: args[1]}
+	}}
+	qqAppend = builtin{name: "append", min: 2, max: 2, f: func(args []val) val {
+		if !isList(args[0]) {
+			panic(fmt.Sprintf("unquote-splicing: not a list: %s", args[0].pr()))
+		}
+		items := seqToSlice(args[0].(seq))
+		result := args[1]
+		for i := len(items) - 1; i >= 0; i-- {
+			result = &cons{car: items[i], cdr: result}
+		}
+		return result
+	}}
+	qqListToVector = builtin{name: "list->vector", f: builtinListToVector, min: 1, max: 1}
+)
+
+// abbreviated returns the datum x if v is the list `(name x)`.
+func abbreviated(v val, name string) (val, bool) {
+	c, ok := v.(*cons)
+	if !ok || !isSymbolNamed(c.car, name) {
+		return nil, false
+	}
+	rest, ok := c.cdr.(*cons)
+	if !ok {
+		return nil, false
+	}
+	if _, ok := rest.cdr.(empty); !ok {
+		return nil, false
+	}
+	return rest.car, true
+}
+
+// quoted returns a form that evaluates to the datum v.
+func quoted(v val) val {
+	return list(core("quote"), stripAliases(v))
+}
+
+// callValue returns a form that calls the procedure f with the
+// results of the arguments forms.
+func callValue(f builtin, args ...val) val {
+	return &cons{car: quoted(f), cdr: list(args...)}
+}
+
+// expandQuasiquote expands `(quasiquote template)` into code that
+// builds the template.
+func expandQuasiquote(form *cons) val {
+	items := syntaxItems("quasiquote", form, 2)
+	if len(items) != 2 {
+		panic(fmt.Sprintf("quasiquote: invalid syntax %s", form.pr()))
+	}
+	expansion, constant := expandTemplate(items[1], 1)
+	if c, ok := expansion.(*cons); ok && !constant {
+		c.loc = form.loc
+	}
+	return expansion
+}
+
+// expandTemplate expands a quasiquote template at nesting level
+// depth.  It also returns whether the template is constant, i.e.
+// contains nothing to evaluate, in which case the expansion simply
+// quotes it.
+func expandTemplate(t val, depth int) (val, bool) {
+	if x, ok := abbreviated(t, "unquote"); ok {
+		if depth == 1 {
+			return x, false
+		}
+		return expandNested(t, "unquote", x, depth-1)
+	}
+	if x, ok := abbreviated(t, "quasiquote"); ok {
+		return expandNested(t, "quasiquote", x, depth+1)
+	}
+	switch t := t.(type) {
+	case *cons:
+		if x, ok := abbreviated(t.car, "unquote-splicing"); ok && depth == 1 {
+			rest, _ := expandTemplate(t.cdr, depth)
+			return callValue(qqAppend, x, rest), false
+		}
+		car, carConstant := expandTemplate(t.car, depth)
+		cdr, cdrConstant := expandTemplate(t.cdr, depth)
+		if carConstant && cdrConstant {
+			return quoted(t), true
+		}
+		return callValue(qqCons, car, cdr), false
+	case *vector:
+		items, constant := expandTemplate(list(t.items...), depth)
+		if constant {
+			return quoted(t), true
+		}
+		return callValue(qqListToVector, items), false
+	}
+	return quoted(t), true
+}
+
+// expandNested expands the template `(name x)`, where x is at nesting
+// level depth.
+func expandNested(t val, name string, x val, depth int) (val, bool) {
+	inner, constant := expandTemplate(x, depth)
+	if constant {
+		return quoted(t), true
+	}
+	return callValue(qqCons, quoted(symbol{name: name}), callValue(qqCons, inner, quoted(empty{}))), false
+}
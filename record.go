@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// recordType is the type of records defined with
+// `define-record-type`.  Each definition creates a new type, even if
+// the name is reused.
+type recordType struct {
+	name   string
+	fields []string
+}
+
+func (rt *recordType) pr() string {
+	return fmt.Sprintf("#<record-type %s>", rt.name)
+}
+
+func (rt *recordType) equal(other val) bool {
+	return rt == other
+}
+
+// record is an instance of a record type.
+type record struct {
+	rtype  *recordType
+	fields []val
+}
+
+func (r *record) pr() string {
+	return printString(r, false)
+}
+
+func (r *record) display() string {
+	return printString(r, true)
+}
+
+func (r *record) equal(other val) bool {
+	return r == other
+}
+
+// recordSyntax returns the items of a list that's part of a
+// `define-record-type` form.
+func recordSyntax(v val, what string) []val {
+	if !isList(v) {
+		panic(fmt.Sprintf("define-record-type: invalid %s: %s", what, v.pr()))
+	}
+	return seqToSlice(v.(seq))
+}
+
+func recordSymbol(v val, what string) symbol {
+	s, ok := v.(symbol)
+	if !ok {
+		panic(fmt.Sprintf("define-record-type: invalid %s: %s", what, v.pr()))
+	}
+	return s
+}
+
+// evalDefineRecordType evaluates
+//
+//	(define-record-type <name>
+//	  (constructor field ...)
+//	  predicate
+//	  (field accessor [modifier]) ...)
+//
+// The constructor can also be a symbol, in which case it takes all
+// the fields, or #f, in which case no constructor is defined.
+func evalDefineRecordType(e env, forms seq) val {
+	items := recordSyntax(forms, "syntax")
+	if len(items) < 3 {
+		panic(fmt.Sprintf("define-record-type: invalid syntax: %s", forms.pr()))
+	}
+	typeName := recordSymbol(items[0], "type name")
+	rt := &recordType{name: strings.TrimSuffix(strings.TrimPrefix(typeName.name, "<"), ">")}
+	var defs []builtin
+
+	fieldIndex := map[string]int{}
+	for _, spec := range items[3:] {
+		specItems := recordSyntax(spec, "field spec")
+		if len(specItems) < 1 || len(specItems) > 3 {
+			panic(fmt.Sprintf("define-record-type: invalid field spec: %s", spec.pr()))
+		}
+		field := recordSymbol(specItems[0], "field name")
+		if _, ok := fieldIndex[field.name]; ok {
+			panic(fmt.Sprintf("define-record-type: duplicate field %s", field.name))
+		}
+		i := len(rt.fields)
+		fieldIndex[field.name] = i
+		rt.fields = append(rt.fields, field.name)
+		if len(specItems) > 1 {
+			defs = append(defs, recordAccessor(rt, recordSymbol(specItems[1], "accessor name").name, i))
+		}
+		if len(specItems) > 2 {
+			defs = append(defs, recordModifier(rt, recordSymbol(specItems[2], "modifier name").name, i))
+		}
+	}
+
+	switch ctor := items[1].(type) {
+	case boolean:
+		if ctor.b {
+			panic("define-record-type: invalid constructor spec: #t")
+		}
+	case symbol:
+		defs = append(defs, recordConstructor(rt, ctor.name, nil))
+	default:
+		ctorItems := recordSyntax(ctor, "constructor spec")
+		if len(ctorItems) == 0 {
+			panic("define-record-type: invalid constructor spec: ()")
+		}
+		name := recordSymbol(ctorItems[0], "constructor name")
+		indexes := []int{}
+		for _, f := range ctorItems[1:] {
+			i, ok := fieldIndex[recordSymbol(f, "field name").name]
+			if !ok {
+				panic(fmt.Sprintf("define-record-type: unknown field %s", f.pr()))
+			}
+			indexes = append(indexes, i)
+		}
+		defs = append(defs, recordConstructor(rt, name.name, indexes))
+	}
+
+	defs = append(defs, recordPredicate(rt, recordSymbol(items[2], "predicate name").name))
+
+	e.define(typeName, rt)
+	for _, b := range defs {
+		e.define(symbol{name: b.name}, b)
+	}
+	return unspecified{}
+}
+
+// recordConstructor returns a constructor that initializes the
+// fields with the given indexes from its arguments, or all fields if
+// indexes is nil.  Other fields are unspecified.
+func recordConstructor(rt *recordType, name string, indexes []int) builtin {
+	n := len(indexes)
+	if indexes == nil {
+		n = len(rt.fields)
+	}
+	return builtin{name: name, id: &builtinID{}, min: n, max: n, f: func(args []val) val {
+		r := &record{rtype: rt, fields: make([]val, len(rt.fields))}
+		for i := range r.fields {
+			r.fields[i] = unspecified{}
+		}
+		if indexes == nil {
+			checkArgCount(name, args, len(rt.fields), len(rt.fields))
+			copy(r.fields, args)
+			return r
+		}
+		checkArgCount(name, args, len(indexes), len(indexes))
+		for i, arg := range args {
+			r.fields[indexes[i]] = arg
+		}
+		return r
+	}}
+}
+
+func recordPredicate(rt *recordType, name string) builtin {
+	return builtin{name: name, id: &builtinID{}, min: 1, max: 1, f: func(args []val) val {
+		checkArgCount(name, args, 1, 1)
+		r, ok := args[0].(*record)
+		return boolean{ok && r.rtype == rt}
+	}}
+}
+
+func recordArg(rt *recordType, name string, args []val, i int) *record {
+	r, ok := args[i].(*record)
+	if !ok || r.rtype != rt {
+		panic(fmt.Sprintf("%s: not a %s: %s", name, rt.name, args[i].pr()))
+	}
+	return r
+}
+
+func recordAccessor(rt *recordType, name string, field int) builtin {
+	return builtin{name: name, id: &builtinID{}, min: 1, max: 1, f: func(args []val) val {
+		checkArgCount(name, args, 1, 1)
+		return recordArg(rt, name, args, 0).fields[field]
+	}}
+}
+
+func recordModifier(rt *recordType, name string, field int) builtin {
+	return builtin{name: name, id: &builtinID{}, min: 2, max: 2, f: func(args []val) val {
+		checkArgCount(name, args, 2, 2)
+		recordArg(rt, name, args, 0).fields[field] = args[1]
+		return unspecified{}
+	}}
+}
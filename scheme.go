@@ -1,10 +1,18 @@
 package main
 
 import (
-	"errors"
+	"bufio"
+	"bytes"
 	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime/debug"
 	"strconv"
+	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
 // seq
@@ -12,11 +20,27 @@ import (
 // bool
 // symbol
 
+// The pr method of a val returns its written representation, which
+// reads back as an equal value.
 type val interface {
 	pr() string
 	equal(val) bool
 }
 
+// displayer is implemented by values whose displayed, human-readable
+// representation differs from the written one, like strings, which
+// are displayed without quotes.
+type displayer interface {
+	display() string
+}
+
+func display(v val) string {
+	if d, ok := v.(displayer); ok {
+		return d.display()
+	}
+	return v.pr()
+}
+
 type seq interface {
 	pr() string
 	equal(val) bool
@@ -50,27 +74,25 @@ func (e empty) rest() seq {
 	panic("rest called on empty")
 }
 
+// The cdr of a cons is usually a seq, but for improper lists like
+// `(1 . 2)` it can be any val.  Lists read from source have the
+// location of their opening parenthesis in loc.
 type cons struct {
 	car val
-	cdr seq
+	cdr val
+	loc *srcLoc
 }
 
 func (c *cons) pr() string {
-	s := fmt.Sprintf("(%s", c.car.pr())
-	seq := c.rest()
-	for !seq.empty() {
-		s = fmt.Sprintf("%s %s", s, seq.first().pr())
-		seq = seq.rest()
-	}
-	return fmt.Sprintf("%s)", s)
+	return printString(c, false)
+}
+
+func (c *cons) display() string {
+	return printString(c, true)
 }
 
 func (c *cons) equal(other val) bool {
-	cc, ok := other.(*cons)
-	if !ok {
-		return false
-	}
-	return c.car.equal(cc.car) && c.cdr.equal(cc.cdr)
+	return isEqual(c, other)
 }
 
 func (c *cons) empty() bool {
@@ -82,39 +104,213 @@ func (c *cons) first() val {
 }
 
 func (c *cons) rest() seq {
-	return c.cdr
+	s, ok := c.cdr.(seq)
+	if !ok {
+		panic(fmt.Sprintf("rest called on improper list %s", c.pr()))
+	}
+	return s
+}
+
+func list(vs ...val) seq {
+	var l seq = empty{}
+	for i := len(vs) - 1; i >= 0; i-- {
+		l = &cons{car: vs[i], cdr: l}
+	}
+	return l
+}
+
+// isList checks whether v is a proper list, i.e. a chain of conses
+// ending in ().  Circular lists are not proper lists.
+func isList(v val) bool {
+	slow := v
+	for {
+		for i := 0; i < 2; i++ {
+			switch vv := v.(type) {
+			case empty:
+				return true
+			case *cons:
+				v = vv.cdr
+			default:
+				return false
+			}
+		}
+		slow = slow.(*cons).cdr
+		if slow == v {
+			return false
+		}
+	}
+}
+
+type vector struct {
+	items []val
+}
+
+func (v *vector) pr() string {
+	return printString(v, false)
+}
+
+func (v *vector) display() string {
+	return printString(v, true)
+}
+
+func (v *vector) equal(other val) bool {
+	return isEqual(v, other)
+}
+
+type bytevector struct {
+	b []byte
+}
+
+func (bv *bytevector) pr() string {
+	parts := make([]string, len(bv.b))
+	for i, b := range bv.b {
+		parts[i] = strconv.Itoa(int(b))
+	}
+	return "#u8(" + strings.Join(parts, " ") + ")"
+}
+
+func (bv *bytevector) equal(other val) bool {
+	bbv, ok := other.(*bytevector)
+	if !ok {
+		return false
+	}
+	return bytes.Equal(bv.b, bbv.b)
 }
 
 type symbol struct {
 	name string
+	// u is the identity of an uninterned symbol, and nil for
+	// interned ones.
+	u *uninterned
+}
+
+func (s symbol) display() string {
+	return s.name
 }
 
 func (s symbol) pr() string {
+	if symbolNeedsBars(s.name) {
+		return escapeDelimited(s.name, '|')
+	}
 	return s.name
 }
 
+// symbolNeedsBars checks whether a symbol must be printed as `|...|`
+// to read back as the same symbol.
+func symbolNeedsBars(name string) bool {
+	if name == "" || name == "." || name[0] == '#' || looksNumeric(name) {
+		return true
+	}
+	for _, c := range name {
+		if isDelimiter(c) || c == '\'' || c == '`' || c == ',' || c == '\\' {
+			return true
+		}
+	}
+	return false
+}
+
 func (s symbol) equal(other val) bool {
 	ss, ok := other.(symbol)
+	return ok && s == ss
+}
+
+// str is a string.  Strings are mutable, so a str refers to its
+// characters, which its copies share.  Use newStr to construct one.
+// The strings the reader returns are immutable, so that string
+// literals, which are shared by every evaluation of the code they
+// appear in, can't be changed.
+type str struct {
+	*strChars
+}
+
+type strChars struct {
+	s         string
+	immutable bool
+}
+
+func newStr(s string) str {
+	return str{&strChars{s: s}}
+}
+
+func newImmutableStr(s string) str {
+	return str{&strChars{s: s, immutable: true}}
+}
+
+// escapeDelimited is the inverse of lexState.readDelimited.
+func escapeDelimited(s string, close rune) string {
+	var b strings.Builder
+	b.WriteRune(close)
+	for _, c := range s {
+		switch c {
+		case close, '\\':
+			b.WriteByte('\\')
+			b.WriteRune(c)
+		case '\n':
+			b.WriteString("\\n")
+		case '\t':
+			b.WriteString("\\t")
+		default:
+			b.WriteRune(c)
+		}
+	}
+	b.WriteRune(close)
+	return b.String()
+}
+
+func (s str) pr() string {
+	return escapeDelimited(s.s, '"')
+}
+
+func (s str) display() string {
+	return s.s
+}
+
+func (s str) equal(other val) bool {
+	ss, ok := other.(str)
 	if !ok {
 		return false
 	}
-	return s.name == ss.name
+	return s.s == ss.s
+}
+
+type char struct {
+	r rune
 }
 
-type number struct {
-	i int64
+var charNames = map[string]rune{
+	"alarm":     '\a',
+	"backspace": '\b',
+	"delete":    0x7f,
+	"escape":    0x1b,
+	"newline":   '\n',
+	"null":      0,
+	"return":    '\r',
+	"space":     ' ',
+	"tab":       '\t',
 }
 
-func (n number) pr() string {
-	return fmt.Sprintf("%v", n.i)
+func (c char) pr() string {
+	for name, r := range charNames {
+		if r == c.r {
+			return "#\\" + name
+		}
+	}
+	if !unicode.IsPrint(c.r) {
+		return fmt.Sprintf("#\\x%x", c.r)
+	}
+	return "#\\" + string(c.r)
+}
+
+func (c char) display() string {
+	return string(c.r)
 }
 
-func (n number) equal(other val) bool {
-	nn, ok := other.(number)
+func (c char) equal(other val) bool {
+	cc, ok := other.(char)
 	if !ok {
 		return false
 	}
-	return n.i == nn.i
+	return c.r == cc.r
 }
 
 type boolean struct {
@@ -137,6 +333,23 @@ func (b boolean) equal(other val) bool {
 	return b.b == bb.b
 }
 
+// unspecified is the value of expressions whose value isn't
+// specified, such as procedures that are only called for their side
+// effects.
+type unspecified struct {
+}
+
+func (u unspecified) pr() string {
+	return "#<unspecified>"
+}
+
+func (u unspecified) equal(other val) bool {
+	_, ok := other.(unspecified)
+	return ok
+}
+
+// isTrue checks whether v counts as true in a condition.  Only #f is
+// false; everything else, including () and 0, is true.
 func isTrue(v val) bool {
 	b, ok := v.(boolean)
 	if ok {
@@ -145,30 +358,264 @@ func isTrue(v val) bool {
 	return true
 }
 
+// eqv checks whether a and b are the same object, as Scheme's
+// `eqv?` does.  Numbers and other atoms are compared by value,
+// mutable compound values by identity.  Flonums are compared by their
+// bits, so 0.0 and -0.0 differ, and NaNs are the same as themselves.
+func eqv(a val, b val) bool {
+	switch a := a.(type) {
+	case *cons, *vector, *bytevector, *box:
+		return a == b
+	case str:
+		bs, ok := b.(str)
+		return ok && a.strChars == bs.strChars
+	case flonum:
+		bf, ok := b.(flonum)
+		return ok && math.Float64bits(a.f) == math.Float64bits(bf.f)
+	}
+	return a.equal(b)
+}
+
+// isEqual compares pairs, vectors and boxes by structure, and
+// everything else with their equal method.  It terminates on circular
+// structures.
+func isEqual(a, b val) bool {
+	return equalIn(a, b, map[[2]val]bool{})
+}
+
+// equalIn compares a and b like isEqual.  seen holds the pairs of
+// compound values that are being compared already.  Comparing one of
+// them again doesn't find a difference that the first comparison
+// won't find, so they're taken to be equal.  The cdrs of lists and
+// the contents of boxes are compared iteratively.
+func equalIn(a, b val, seen map[[2]val]bool) bool {
+	for {
+		switch a.(type) {
+		case *cons, *vector, *box:
+			if a == b || seen[[2]val{a, b}] {
+				return true
+			}
+			seen[[2]val{a, b}] = true
+		}
+		switch x := a.(type) {
+		case *cons:
+			y, ok := b.(*cons)
+			if !ok || !equalIn(x.car, y.car, seen) {
+				return false
+			}
+			a, b = x.cdr, y.cdr
+		case *box:
+			y, ok := b.(*box)
+			if !ok {
+				return false
+			}
+			a, b = x.v, y.v
+		case *vector:
+			y, ok := b.(*vector)
+			if !ok || len(x.items) != len(y.items) {
+				return false
+			}
+			for i, item := range x.items {
+				if !equalIn(item, y.items[i], seen) {
+					return false
+				}
+			}
+			return true
+		case flonum:
+			return eqv(a, b)
+		default:
+			return a.equal(b)
+		}
+	}
+}
+
+// builtinIsEq implements `eq?`.  Since numbers and characters are
+// values, not objects, it's the same as `eqv?`.
+func builtinIsEq(args []val) val {
+	checkArgCount("eq?", args, 2, 2)
+	return boolean{eqv(args[0], args[1])}
+}
+
+func builtinIsEqv(args []val) val {
+	checkArgCount("eqv?", args, 2, 2)
+	return boolean{eqv(args[0], args[1])}
+}
+
+// builtinIsEqual compares pairs, vectors, bytevectors, boxes and
+// strings by structure, and everything else like `eqv?`.
+func builtinIsEqual(args []val) val {
+	checkArgCount("equal?", args, 2, 2)
+	return boolean{isEqual(args[0], args[1])}
+}
+
+func builtinNot(args []val) val {
+	checkArgCount("not", args, 1, 1)
+	return boolean{!isTrue(args[0])}
+}
+
+func builtinBooleanEqual(args []val) val {
+	checkArgCount("boolean=?", args, 2, -1)
+	for _, arg := range args {
+		if _, ok := arg.(boolean); !ok {
+			panic(fmt.Sprintf("boolean=?: not a boolean: %s", arg.pr()))
+		}
+	}
+	for _, arg := range args[1:] {
+		if arg != args[0] {
+			return boolean{false}
+		}
+	}
+	return boolean{true}
+}
+
+// builtinTypePredicate returns the builtin called name, which checks
+// whether its argument is of the type that test checks for.
+func builtinTypePredicate(name string, test func(v val) bool) builtin {
+	return builtin{name: name, min: 1, max: 1, f: func(args []val) val {
+		checkArgCount(name, args, 1, 1)
+		return boolean{test(args[0])}
+	}}
+}
+
 type function interface {
 	call([]val) val
+	// procedureName returns the name of the procedure, or "" if
+	// it's anonymous.
+	procedureName() string
+	procedureArity() arity
+}
+
+// arity is the number of arguments a procedure takes.  max is -1
+// if there's no upper limit.
+type arity struct {
+	min, max int
 }
 
+func (a arity) String() string {
+	switch {
+	case a.max < 0:
+		return fmt.Sprintf("%d+", a.min)
+	case a.min == a.max:
+		return fmt.Sprintf("%d", a.min)
+	default:
+		return fmt.Sprintf("%d-%d", a.min, a.max)
+	}
+}
+
+// builtin is a procedure implemented in Go.  It takes between min and
+// max arguments, with max being -1 if there's no upper limit.  Most
+// builtins compute their result with f.  Builtins that have to work on
+// the machine's stack, like `call/cc`, have control instead, which
+// arranges what the machine does next.  Builtins that are made at run
+// time, like record accessors, have an id, which distinguishes them
+// from the other builtins with the same name.
 type builtin struct {
-	name string
-	f    func([]val) val
+	name     string
+	f        func([]val) val
+	control  func(m *machine, args []val)
+	min, max int
+	id       *builtinID
+}
+
+// builtinID is the identity of a builtin made at run time.  It isn't
+// empty, because pointers to distinct empty values can be equal.
+type builtinID struct {
+	_ byte
 }
 
 func (b builtin) pr() string {
-	return fmt.Sprintf("#<function:%s>", b.name)
+	return fmt.Sprintf("#<procedure:%s (%s)>", b.name, b.procedureArity())
+}
+
+func (b builtin) procedureName() string {
+	return b.name
+}
+
+func (b builtin) procedureArity() arity {
+	return arity{b.min, b.max}
 }
 
+// equal checks whether other is the same builtin.  Builtins are
+// compared by name and id, since functions can't be compared.
 func (b builtin) equal(other val) bool {
-	panic("you should not compare functions!")
+	ob, ok := other.(builtin)
+	return ok && b.name == ob.name && b.id == ob.id
 }
 
 func (b builtin) call(args []val) val {
+	if b.control != nil {
+		return callInMachine(b, args)
+	}
+	checkArgCount(b.name, args, b.min, b.max)
 	return b.f(args)
 }
 
 type lexState struct {
-	s   string
-	pos int
+	s    string
+	pos  int
+	file string
+	line int
+	col  int
+
+	// labels holds the datums labelled with `#n=`.  It's shared
+	// between all copies of a lexState.
+	labels map[int]val
+	// depth is the number of datums currently being read.
+	depth int
+}
+
+func newLexState(s string) lexState {
+	return newFileLexState("", s)
+}
+
+func newFileLexState(file string, s string) lexState {
+	return lexState{s: s, pos: 0, file: file, line: 1, col: 1, labels: map[int]val{}}
+}
+
+func (ls lexState) loc() *srcLoc {
+	return &srcLoc{file: ls.file, line: ls.line, col: ls.col}
+}
+
+// srcLoc is a position in a source file.  Lines and columns start
+// at 1.  The file name is empty for code that wasn't read from a
+// file.
+type srcLoc struct {
+	file string
+	line int
+	col  int
+}
+
+func (l *srcLoc) String() string {
+	if l.file == "" {
+		return fmt.Sprintf("%d:%d", l.line, l.col)
+	}
+	return fmt.Sprintf("%s:%d:%d", l.file, l.line, l.col)
+}
+
+// ReadError is a syntax error at a specific position in the input.
+// Lines and columns start at 1.
+type ReadError struct {
+	File string
+	Line int
+	Col  int
+	Msg  string
+
+	// eos is set if the error was caused by running out of input,
+	// in which case more input might fix it.
+	eos bool
+}
+
+func (e *ReadError) Error() string {
+	loc := &srcLoc{file: e.File, line: e.Line, col: e.Col}
+	return fmt.Sprintf("%s: %s", loc, e.Msg)
+}
+
+func (ls lexState) errorf(format string, args ...interface{}) error {
+	return &ReadError{File: ls.file, Line: ls.line, Col: ls.col, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (ls lexState) eosError(msg string) error {
+	return &ReadError{File: ls.file, Line: ls.line, Col: ls.col, Msg: msg, eos: true}
 }
 
 func (ls lexState) isEOS() bool {
@@ -179,14 +626,24 @@ func (ls lexState) advance() lexState {
 	if ls.isEOS() {
 		panic("Advancing beyond EOS")
 	}
-	return lexState{s: ls.s, pos: ls.pos + 1}
+	r, size := utf8.DecodeRuneInString(ls.s[ls.pos:])
+	next := ls
+	next.pos += size
+	if r == '\n' {
+		next.line++
+		next.col = 1
+	} else {
+		next.col++
+	}
+	return next
 }
 
 func (ls lexState) current() rune {
 	if ls.isEOS() {
 		panic("Advancing beyond EOS")
 	}
-	return rune(ls.s[ls.pos])
+	r, _ := utf8.DecodeRuneInString(ls.s[ls.pos:])
+	return r
 }
 
 func (ls lexState) skipWhile(pred func(rune) bool) lexState {
@@ -200,6 +657,59 @@ func (ls lexState) skipWS() lexState {
 	return ls.skipWhile(func(c rune) bool { return unicode.IsSpace(c) })
 }
 
+func isDelimiter(c rune) bool {
+	return unicode.IsSpace(c) || c == '(' || c == ')' || c == '"' || c == ';' || c == '|'
+}
+
+func (ls lexState) lookingAt(prefix string) bool {
+	return strings.HasPrefix(ls.s[ls.pos:], prefix)
+}
+
+// skipBlockComment skips a possibly nested `#| ... |#` comment.  The
+// lexer must be positioned after the opening `#|`.
+func (ls lexState) skipBlockComment() (lexState, error) {
+	depth := 1
+	for depth > 0 {
+		if ls.isEOS() {
+			return ls, ls.eosError("EOS in block comment")
+		}
+		if ls.lookingAt("|#") {
+			depth--
+			ls = ls.advance().advance()
+		} else if ls.lookingAt("#|") {
+			depth++
+			ls = ls.advance().advance()
+		} else {
+			ls = ls.advance()
+		}
+	}
+	return ls, nil
+}
+
+// skipAtmosphere skips whitespace and comments, including datum
+// comments, which is why it can fail.
+func (ls lexState) skipAtmosphere() (lexState, error) {
+	for {
+		ls = ls.skipWS()
+		if ls.isEOS() {
+			return ls, nil
+		}
+		var err error
+		if ls.current() == ';' {
+			ls = ls.skipWhile(func(c rune) bool { return c != '\n' })
+		} else if ls.lookingAt("#|") {
+			ls, err = ls.advance().advance().skipBlockComment()
+		} else if ls.lookingAt("#;") {
+			_, ls, err = ls.advance().advance().read()
+		} else {
+			return ls, nil
+		}
+		if err != nil {
+			return ls, err
+		}
+	}
+}
+
 func getToken(start lexState, end lexState) string {
 	if start.s != end.s {
 		panic("Can't get token from two different strings")
@@ -207,209 +717,1296 @@ func getToken(start lexState, end lexState) string {
 	return start.s[start.pos:end.pos]
 }
 
-func (ls lexState) readSeq() (seq, lexState, error) {
-	ls = ls.skipWS()
-	c := ls.current()
-	if c == ')' {
-		ls = ls.advance()
-		return empty{}, ls, nil
-	}
-	car, ls, err := ls.read()
-	if err != nil {
-		return nil, ls, err
-	}
-	cdr, ls, err := ls.readSeq()
-	if err != nil {
-		return nil, ls, err
+// isDot checks whether the lexer is at a lone `.`, which introduces
+// the tail of a dotted list.
+func (ls lexState) isDot() bool {
+	if ls.isEOS() || ls.current() != '.' {
+		return false
 	}
-	return &cons{car: car, cdr: cdr}, ls, nil
+	next := ls.advance()
+	return next.isEOS() || isDelimiter(next.current())
 }
 
-func (ls lexState) read() (val, lexState, error) {
-	ls = ls.skipWS()
-	if ls.isEOS() {
-		return nil, ls, errors.New("EOS")
-	}
-	c := ls.current()
-	if c == '#' {
-		ls = ls.advance()
+func (ls lexState) readSeq() (seq, lexState, error) {
+	items := []val{}
+	var tail val = empty{}
+	for {
+		var err error
+		ls, err = ls.skipAtmosphere()
+		if err != nil {
+			return nil, ls, err
+		}
 		if ls.isEOS() {
-			return nil, ls, errors.New("EOS")
+			return nil, ls, ls.eosError("EOS")
 		}
-		c = ls.current()
-		ls = ls.advance()
-		if c == 't' {
-			return boolean{true}, ls, nil
+		if ls.current() == ')' {
+			ls = ls.advance()
+			break
 		}
-		if c == 'f' {
-			return boolean{false}, ls, nil
+		if len(items) > 0 && ls.isDot() {
+			tail, ls, err = ls.advance().read()
+			if err != nil {
+				return nil, ls, err
+			}
+			ls, err = ls.skipAtmosphere()
+			if err != nil {
+				return nil, ls, err
+			}
+			if ls.isEOS() {
+				return nil, ls, ls.eosError("EOS")
+			}
+			if ls.current() != ')' {
+				return nil, ls, ls.errorf("expected `)` after dotted tail")
+			}
+			ls = ls.advance()
+			break
 		}
-		return nil, ls, errors.New("No boolean")
-	}
-	if c == '(' {
-		ls = ls.advance()
-		return ls.readSeq()
+		var item val
+		item, ls, err = ls.read()
+		if err != nil {
+			return nil, ls, err
+		}
+		items = append(items, item)
 	}
-	if c == ')' {
-		return nil, ls, errors.New("unexpected `)`")
+	if len(items) == 0 {
+		return empty{}, ls, nil
 	}
-	els := ls.skipWhile(func(c rune) bool {
-		return !unicode.IsSpace(c) && c != '(' && c != ')'
-	})
-	// FIXME: Actually check whether the string contains any
-	// nondigits.
-	s := getToken(ls, els)
-	num, err := strconv.ParseInt(s, 10, 64)
-	if err != nil {
-		return symbol{name: s}, els, nil
+	l := &cons{car: items[len(items)-1], cdr: tail}
+	for i := len(items) - 2; i >= 0; i-- {
+		l = &cons{car: items[i], cdr: l}
 	}
-	return number{num}, els, nil
+	return l, ls, nil
 }
 
-func read(s string) (val, error) {
-	ls := lexState{s: s, pos: 0}
-	v, _, err := ls.read()
-	return v, err
+// readDelimited reads the characters up to the closing delimiter
+// `close`, processing escapes.  It's used for strings and `|...|`
+// symbols.  The lexer must be positioned after the opening delimiter.
+func (ls lexState) readDelimited(close rune, what string) (string, lexState, error) {
+	var b strings.Builder
+	for {
+		if ls.isEOS() {
+			return "", ls, ls.eosError("EOS in " + what)
+		}
+		here := ls
+		c := ls.current()
+		ls = ls.advance()
+		if c == close {
+			return b.String(), ls, nil
+		}
+		if c == '\\' {
+			if ls.isEOS() {
+				return "", ls, ls.eosError("EOS in " + what)
+			}
+			c = ls.current()
+			ls = ls.advance()
+			switch c {
+			case 'n':
+				c = '\n'
+			case 't':
+				c = '\t'
+			case close, '\\':
+			default:
+				return "", ls, here.errorf("unknown escape `\\%c` in %s", c, what)
+			}
+		}
+		b.WriteRune(c)
+	}
 }
 
-func readTest(s string) val {
-	v, err := read(s)
+func (ls lexState) readString() (val, lexState, error) {
+	s, ls, err := ls.readDelimited('"', "string")
 	if err != nil {
-		panic("could not read")
+		return nil, ls, err
 	}
-	fmt.Printf("`%s` => %s\n", s, v.pr())
-	return v
+	return newImmutableStr(s), ls, nil
 }
 
-func get1(s seq) val {
-	v := s.first()
-
-	if !s.rest().empty() {
-		panic("Too many items in seq")
+func (ls lexState) readChar() (val, lexState, error) {
+	if ls.isEOS() {
+		return nil, ls, ls.eosError("EOS in character")
 	}
-
-	return v
-}
-
-func get3(s seq) (val, val, val) {
-	v1 := s.first()
-	s = s.rest()
-	v2 := s.first()
-	s = s.rest()
-	v3 := s.first()
-	s = s.rest()
-
-	if !s.empty() {
-		panic(fmt.Sprintf("Too many items in seq: %s", s.pr()))
+	// The first character is always part of the literal, even if
+	// it's a delimiter, as in `#\(`.
+	els := ls.advance().skipWhile(func(c rune) bool {
+		return !isDelimiter(c)
+	})
+	name := getToken(ls, els)
+	if utf8.RuneCountInString(name) == 1 {
+		r, _ := utf8.DecodeRuneInString(name)
+		return char{r}, els, nil
 	}
-
-	return v1, v2, v3
+	if r, ok := charNames[name]; ok {
+		return char{r}, els, nil
+	}
+	if name[0] == 'x' {
+		r, err := strconv.ParseInt(name[1:], 16, 32)
+		if err == nil {
+			return char{rune(r)}, els, nil
+		}
+	}
+	return nil, els, ls.errorf("unknown character `#\\%s`", name)
 }
 
-type env interface {
-	lookup(s symbol) (val, bool)
+// labelPlaceholder stands for a labelled datum while that datum is
+// still being read, as in `#0=(a . #0#)`.
+type labelPlaceholder struct {
+	n int
 }
 
-type globalEnv map[string]val
+func (p *labelPlaceholder) pr() string {
+	return fmt.Sprintf("#%d#", p.n)
+}
 
-func (ge globalEnv) lookup(s symbol) (val, bool) {
-	v, ok := ge[s.name]
-	return v, ok
+func (p *labelPlaceholder) equal(other val) bool {
+	return p == other
 }
 
-func evalApplication(e env, fform val, argForms seq) val {
-	vf := eval(e, fform)
-	f, ok := vf.(function)
-	if !ok {
-		panic(fmt.Sprintf("cannot apply non-function %s", vf.pr()))
+// readLabel reads a datum label definition `#n=datum` or reference
+// `#n#`.  The lexer must be positioned after the `#`.
+func (ls lexState) readLabel() (val, lexState, error) {
+	start := ls
+	els := ls.skipWhile(func(c rune) bool { return c >= '0' && c <= '9' })
+	n, err := strconv.Atoi(getToken(ls, els))
+	if err != nil {
+		return nil, els, start.errorf("bad datum label")
 	}
-	args := []val{}
-	for !argForms.empty() {
-		argForm := argForms.first()
-		arg := eval(e, argForm)
-		args = append(args, arg)
-
-		argForms = argForms.rest()
+	if els.isEOS() {
+		return nil, els, els.eosError("EOS")
 	}
-	return f.call(args)
-}
-
-func eval(e env, v val) val {
-	switch v := v.(type) {
-	case boolean:
-		return v
-	case number:
-		return v
-	case symbol:
-		res, ok := e.lookup(v)
+	c := els.current()
+	ls = els.advance()
+	switch c {
+	case '#':
+		v, ok := ls.labels[n]
 		if !ok {
-			panic(fmt.Sprintf("unbound %s", v.name))
+			return nil, ls, start.errorf("undefined datum label #%d#", n)
 		}
-		return res
-	case seq:
-		head := v.first()
-		switch head := head.(type) {
-		case symbol:
-			switch head.name {
-			case "if":
-				cond, cons, alt := get3(v.rest())
-				if isTrue(eval(e, cond)) {
-					return eval(e, cons)
-				} else {
-					return eval(e, alt)
-				}
-			case "quote":
-				quotee := get1(v.rest())
-				return quotee
-			default:
-				return evalApplication(e, head, v.rest())
-			}
+		return v, ls, nil
+	case '=':
+		p := &labelPlaceholder{n: n}
+		ls.labels[n] = p
+		v, ls, err := ls.read()
+		if err != nil {
+			return nil, ls, err
+		}
+		if v == val(p) {
+			return nil, ls, start.errorf("datum label #%d= refers to itself", n)
+		}
+		ls.labels[n] = v
+		return replacePlaceholder(v, p, v, map[val]bool{}), ls, nil
+	}
+	return nil, ls, start.errorf("expected `=` or `#` after datum label")
+}
+
+// replacePlaceholder replaces all occurrences of p in v with
+// replacement, mutating v in place.
+func replacePlaceholder(v val, p *labelPlaceholder, replacement val, visited map[val]bool) val {
+	if v == val(p) {
+		return replacement
+	}
+	switch vv := v.(type) {
+	case *cons:
+		if visited[vv] {
+			return v
+		}
+		visited[vv] = true
+		vv.car = replacePlaceholder(vv.car, p, replacement, visited)
+		vv.cdr = replacePlaceholder(vv.cdr, p, replacement, visited)
+	case *vector:
+		if visited[vv] {
+			return v
+		}
+		visited[vv] = true
+		for i, item := range vv.items {
+			vv.items[i] = replacePlaceholder(item, p, replacement, visited)
+		}
+	case *box:
+		if visited[vv] {
+			return v
+		}
+		visited[vv] = true
+		vv.v = replacePlaceholder(vv.v, p, replacement, visited)
+	}
+	return v
+}
+
+// readBytevector reads the elements of a `#u8(...)` literal.  The
+// lexer must be positioned after the opening parenthesis.
+func (ls lexState) readBytevector() (val, lexState, error) {
+	start := ls
+	items, ls, err := ls.readSeq()
+	if err != nil {
+		return nil, ls, err
+	}
+	if !isList(items) {
+		return nil, ls, start.errorf("dotted tail in bytevector")
+	}
+	b := []byte{}
+	for _, item := range seqToSlice(items) {
+		n, ok := item.(number)
+		if !ok || n.i < 0 || n.i > 255 {
+			return nil, ls, start.errorf("invalid byte %s in bytevector", item.pr())
+		}
+		b = append(b, byte(n.i))
+	}
+	return &bytevector{b: b}, ls, nil
+}
+
+// readAbbreviation reads the datum following a prefix like `'` and
+// wraps it in a list headed by the symbol `name`.
+func (ls lexState) readAbbreviation(name string) (val, lexState, error) {
+	v, ls, err := ls.read()
+	if err != nil {
+		return nil, ls, err
+	}
+	return list(symbol{name: name}, v), ls, nil
+}
+
+// maxReadDepth limits how deeply datums can be nested, so that
+// malicious input can't overflow the stack.
+var maxReadDepth = 10000
+
+func (ls lexState) read() (val, lexState, error) {
+	if ls.depth >= maxReadDepth {
+		return nil, ls, ls.errorf("datum nested more than %d levels deep", maxReadDepth)
+	}
+	ls.depth++
+	v, ls, err := ls.readDatum()
+	ls.depth--
+	return v, ls, err
+}
+
+func (ls lexState) readDatum() (val, lexState, error) {
+	ls, err := ls.skipAtmosphere()
+	if err != nil {
+		return nil, ls, err
+	}
+	if ls.isEOS() {
+		return nil, ls, ls.eosError("EOS")
+	}
+	start := ls
+	c := ls.current()
+	if c == '#' {
+		ls = ls.advance()
+		if ls.isEOS() {
+			return nil, ls, ls.eosError("EOS")
+		}
+		c = ls.current()
+		ls = ls.advance()
+		if c == '\\' {
+			return ls.readChar()
+		}
+		if c == '(' {
+			items, ls, err := ls.readSeq()
+			if err != nil {
+				return nil, ls, err
+			}
+			if !isList(items) {
+				return nil, ls, start.errorf("dotted tail in vector")
+			}
+			return &vector{items: seqToSlice(items)}, ls, nil
+		}
+		if c >= '0' && c <= '9' {
+			return start.advance().readLabel()
+		}
+		if c == ':' {
+			return ls.readKeyword()
+		}
+		if c == '&' {
+			v, ls, err := ls.read()
+			if err != nil {
+				return nil, ls, err
+			}
+			return &box{v: v}, ls, nil
+		}
+		if c == 'u' && ls.lookingAt("8(") {
+			return ls.advance().advance().readBytevector()
+		}
+		if _, ok := radixPrefixes[unicode.ToLower(c)]; ok {
+			els := ls.skipWhile(func(c rune) bool {
+				return !isDelimiter(c)
+			})
+			num, err := parseNumberToken(getToken(start, els), 10)
+			if err != nil {
+				return nil, els, start.errorf("%s", err)
+			}
+			return num, els, nil
+		}
+		els := ls.skipWhile(func(c rune) bool {
+			return !isDelimiter(c)
+		})
+		switch token := getToken(start, els); token {
+		case "#t", "#true":
+			return boolean{true}, els, nil
+		case "#f", "#false":
+			return boolean{false}, els, nil
+		case "#!optional", "#!key", "#!rest":
+			return lambdaListMarker{token[2:]}, els, nil
 		default:
-			return evalApplication(e, head, v.rest())
+			return nil, els, start.errorf("unknown syntax `%s`", token)
+		}
+	}
+	if c == '(' {
+		l, ls, err := ls.advance().readSeq()
+		if err != nil {
+			return nil, ls, err
+		}
+		if c, ok := l.(*cons); ok {
+			c.loc = start.loc()
+		}
+		return l, ls, nil
+	}
+	if c == ')' {
+		return nil, ls, ls.errorf("unexpected `)`")
+	}
+	if ls.isDot() {
+		return nil, ls, ls.errorf("unexpected `.`")
+	}
+	if c == '"' {
+		ls = ls.advance()
+		return ls.readString()
+	}
+	if c == '|' {
+		name, ls, err := ls.advance().readDelimited('|', "symbol")
+		if err != nil {
+			return nil, ls, err
+		}
+		return symbol{name: name}, ls, nil
+	}
+	if c == '\'' {
+		return ls.advance().readAbbreviation("quote")
+	}
+	if c == '`' {
+		return ls.advance().readAbbreviation("quasiquote")
+	}
+	if c == ',' {
+		ls = ls.advance()
+		if !ls.isEOS() && ls.current() == '@' {
+			return ls.advance().readAbbreviation("unquote-splicing")
+		}
+		return ls.readAbbreviation("unquote")
+	}
+	els := ls.skipWhile(func(c rune) bool {
+		return !isDelimiter(c)
+	})
+	s := getToken(ls, els)
+	if !looksNumeric(s) {
+		return symbol{name: s}, els, nil
+	}
+	num, err := parseNumberToken(s, 10)
+	if err != nil {
+		return nil, els, start.errorf("%s", err)
+	}
+	return num, els, nil
+}
+
+// remaining returns the part of the input that hasn't been read yet.
+func (ls lexState) remaining() string {
+	return ls.s[ls.pos:]
+}
+
+// datumReader reads datums one at a time from an io.Reader.  If a
+// datum is incomplete it reads more input, blocking if necessary, so
+// it can be used to read from a terminal or a network connection.
+type datumReader struct {
+	r   *bufio.Reader
+	ls  lexState
+	eof bool
+}
+
+// newDatumReader creates a datumReader.  The file name is only used
+// for source locations.
+func newDatumReader(file string, r io.Reader) *datumReader {
+	return &datumReader{r: bufio.NewReader(r), ls: newFileLexState(file, "")}
+}
+
+// fill reads another line of input.
+func (dr *datumReader) fill() error {
+	line, err := dr.r.ReadString('\n')
+	if err == io.EOF {
+		dr.eof = true
+	} else if err != nil {
+		return err
+	}
+	dr.ls.s = dr.ls.remaining() + line
+	dr.ls.pos = 0
+	return nil
+}
+
+// next returns the next datum, or io.EOF if there are no more.  If the
+// datum can't be read, the rest of the line the error is on is
+// skipped, so that the next call goes on after it.
+func (dr *datumReader) next() (val, error) {
+	for {
+		ls, err := dr.ls.skipAtmosphere()
+		if err == nil && ls.isEOS() {
+			if dr.eof {
+				return nil, io.EOF
+			}
+		} else if err == nil {
+			var v val
+			v, ls, err = ls.read()
+			if err == nil {
+				dr.ls = ls
+				return v, nil
+			}
+		}
+		if rerr, ok := err.(*ReadError); err != nil && (!ok || !rerr.eos || dr.eof) {
+			dr.skipLine(ls)
+			return nil, err
+		}
+		if err := dr.fill(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// skipLine drops the input up to the end of the line that ls, where
+// reading failed, is on.
+func (dr *datumReader) skipLine(ls lexState) {
+	if ls.pos < dr.ls.pos {
+		ls = dr.ls
+	}
+	for !ls.isEOS() && ls.current() != '\n' {
+		ls = ls.advance()
+	}
+	if !ls.isEOS() {
+		ls = ls.advance()
+	}
+	ls.depth = 0
+	dr.ls = ls
+}
+
+func read(s string) (val, error) {
+	ls := newLexState(s)
+	v, _, err := ls.read()
+	return v, err
+}
+
+// readAll reads all the datums in s, such as the definitions in a
+// source file.  The file name is only used for source locations.
+func readAll(file string, s string) ([]val, error) {
+	ls := newFileLexState(file, s)
+	vs := []val{}
+	for {
+		var err error
+		ls, err = ls.skipAtmosphere()
+		if err != nil {
+			return nil, err
+		}
+		if ls.isEOS() {
+			return vs, nil
+		}
+		var v val
+		v, ls, err = ls.read()
+		if err != nil {
+			return nil, err
+		}
+		vs = append(vs, v)
+	}
+}
+
+func readTest(s string) val {
+	v, err := read(s)
+	if err != nil {
+		panic("could not read")
+	}
+	fmt.Printf("`%s` => %s\n", s, v.pr())
+	return v
+}
+
+func readErrorTest(s string) {
+	_, err := read(s)
+	if err == nil {
+		panic(fmt.Sprintf("reading `%s` should have failed", s))
+	}
+	fmt.Printf("`%s` => error: %s\n", s, err)
+}
+
+func seqToSlice(s seq) []val {
+	vs := []val{}
+	for !s.empty() {
+		vs = append(vs, s.first())
+		s = s.rest()
+	}
+	return vs
+}
+
+func streamTest(s string, expected string) {
+	dr := newDatumReader("", strings.NewReader(s))
+	vs := []val{}
+	for {
+		v, err := dr.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			panic(fmt.Sprintf("could not stream `%s`: %s", s, err))
+		}
+		vs = append(vs, v)
+	}
+	vexpected, err := read(expected)
+	if err != nil {
+		panic("could not read")
+	}
+	if !list(vs...).equal(vexpected) {
+		panic(fmt.Sprintf("stream(`%s`) => %s != %s", s, list(vs...).pr(), vexpected.pr()))
+	}
+	fmt.Printf("stream(`%s`) => %s\n", s, list(vs...).pr())
+}
+
+// circularReadTest checks that reading s gives a structure that
+// contains itself.
+func circularReadTest(s string) {
+	v, err := read(s)
+	if err != nil {
+		panic("could not read")
+	}
+	var contains func(val, map[val]bool) bool
+	contains = func(x val, visited map[val]bool) bool {
+		if visited[x] {
+			return false
+		}
+		switch xx := x.(type) {
+		case *cons:
+			visited[xx] = true
+			return xx.car == v || xx.cdr == v || contains(xx.car, visited) || contains(xx.cdr, visited)
+		case *vector:
+			visited[xx] = true
+			for _, item := range xx.items {
+				if item == v || contains(item, visited) {
+					return true
+				}
+			}
+		case *box:
+			visited[xx] = true
+			return xx.v == v || contains(xx.v, visited)
+		}
+		return false
+	}
+	if !contains(v, map[val]bool{}) {
+		panic(fmt.Sprintf("reading `%s` didn't produce a circular structure", s))
+	}
+	fmt.Printf("`%s` => circular\n", s)
+}
+
+func readLengthTest(s string, n int) {
+	v, err := read(s)
+	if err != nil {
+		panic(fmt.Sprintf("could not read: %s", err))
+	}
+	l, ok := v.(seq)
+	if !ok || len(seqToSlice(l)) != n {
+		panic(fmt.Sprintf("reading didn't produce a list of length %d", n))
+	}
+	fmt.Printf("read list of length %d\n", n)
+}
+
+// printTest checks the written representation of the datum in s.
+func printTest(s string, expected string) {
+	v, err := read(s)
+	if err != nil {
+		panic("could not read")
+	}
+	if v.pr() != expected {
+		panic(fmt.Sprintf("`%s` printed as `%s` instead of `%s`", s, v.pr(), expected))
+	}
+	fmt.Printf("`%s` => %s\n", s, v.pr())
+}
+
+type countingWriter struct {
+	n int
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	cw.n += len(p)
+	return len(p), nil
+}
+
+// writeLengthTest checks the length of the written representation of
+// the datum in s, without building it as a string.
+func writeLengthTest(s string, n int) {
+	v, err := read(s)
+	if err != nil {
+		panic("could not read")
+	}
+	var cw countingWriter
+	if err := write(&cw, v); err != nil {
+		panic(err)
+	}
+	if cw.n != n {
+		panic(fmt.Sprintf("wrote %d bytes instead of %d", cw.n, n))
+	}
+	fmt.Printf("wrote %d bytes\n", n)
+}
+
+func readAllTest(s string, expected string) {
+	vs, err := readAll("", s)
+	if err != nil {
+		panic(fmt.Sprintf("could not read all of `%s`: %s", s, err))
+	}
+	vexpected, err := read(expected)
+	if err != nil {
+		panic("could not read")
+	}
+	if !list(vs...).equal(vexpected) {
+		panic(fmt.Sprintf("readAll(`%s`) => %s != %s", s, list(vs...).pr(), vexpected.pr()))
+	}
+	fmt.Printf("readAll(`%s`) => %s\n", s, list(vs...).pr())
+}
+
+func readErrorPosTest(s string, line int, col int) {
+	_, err := read(s)
+	rerr, ok := err.(*ReadError)
+	if !ok {
+		panic(fmt.Sprintf("reading `%s` should have failed with a ReadError", s))
+	}
+	if rerr.Line != line || rerr.Col != col {
+		panic(fmt.Sprintf("reading `%s` failed at %d:%d instead of %d:%d", s, rerr.Line, rerr.Col, line, col))
+	}
+	fmt.Printf("`%s` => error: %s\n", s, err)
+}
+
+// subforms returns the subforms of a special form, checking that
+// there are between min and max of them.  If max is negative, there
+// can be any number above min.
+func subforms(name string, forms seq, min int, max int) []val {
+	if !isList(forms) {
+		panic(fmt.Sprintf("%s: improper list of subforms %s", name, forms.pr()))
+	}
+	items := seqToSlice(forms)
+	if len(items) >= min && (max < 0 || len(items) <= max) {
+		return items
+	}
+	panic(fmt.Sprintf("%s: expected %s, got %d", name, countDescription(min, max, "subform"), len(items)))
+}
+
+// countDescription describes between min and max things called noun,
+// like "2 or 3 subforms" or "at least 1 argument".  If max is
+// negative, there can be any number above min.
+func countDescription(min int, max int, noun string) string {
+	var count string
+	switch {
+	case min == max:
+		count = fmt.Sprint(min)
+	case max < 0:
+		count = fmt.Sprintf("at least %d", min)
+	case max == min+1:
+		count = fmt.Sprintf("%d or %d", min, max)
+	default:
+		count = fmt.Sprintf("%d to %d", min, max)
+	}
+	if min == 1 && (max == 1 || max < 0) {
+		return count + " " + noun
+	}
+	return count + " " + noun + "s"
+}
+
+type env interface {
+	lookup(s symbol) (val, bool)
+	define(s symbol, v val)
+	// set changes the nearest binding of s to v.  It returns false
+	// if s is unbound.
+	set(s symbol, v val) bool
+}
+
+type globalEnv map[symbol]val
+
+func (ge globalEnv) lookup(s symbol) (val, bool) {
+	v, ok := ge[s]
+	return v, ok
+}
+
+func (ge globalEnv) define(s symbol, v val) {
+	ge[s] = v
+}
+
+func (ge globalEnv) set(s symbol, v val) bool {
+	if _, ok := ge[s]; !ok {
+		return false
+	}
+	ge[s] = v
+	return true
+}
+
+// localEnv is a frame of local bindings on top of another
+// environment.
+type localEnv struct {
+	vars   map[symbol]val
+	parent env
+}
+
+func newLocalEnv(parent env) *localEnv {
+	return &localEnv{vars: map[symbol]val{}, parent: parent}
+}
+
+func (le *localEnv) lookup(s symbol) (val, bool) {
+	if v, ok := le.vars[s]; ok {
+		return v, true
+	}
+	return le.parent.lookup(s)
+}
+
+func (le *localEnv) define(s symbol, v val) {
+	le.vars[s] = v
+}
+
+func (le *localEnv) set(s symbol, v val) bool {
+	if _, ok := le.vars[s]; ok {
+		le.vars[s] = v
+		return true
+	}
+	return le.parent.set(s, v)
+}
+
+// locatedError is an evaluation error together with the location
+// of the innermost form that caused it.
+type locatedError struct {
+	loc   *srcLoc
+	msg   string
+	cause interface{}
+}
+
+func (e *locatedError) Error() string {
+	return fmt.Sprintf("%s: %s", e.loc, e.msg)
+}
+
+// maxEvalDepth is the parameter `max-eval-depth`, which limits how
+// deeply evaluations can be nested, so that deep non-tail recursion
+// fails with an error that can be caught, instead of using up all
+// memory.  The default allows recursing over lists of a million
+// elements, for which the stack takes about a gigabyte.  Programs that
+// recurse more deeply can raise it with `parameterize`.
+var maxEvalDepth = &parameter{
+	name:      "max-eval-depth",
+	value:     number{1000000},
+	converter: builtin{name: "max-eval-depth", f: checkMaxEvalDepth, min: 1, max: 1},
+}
+
+func checkMaxEvalDepth(args []val) val {
+	if n := intArg("max-eval-depth", args, 0); n <= 0 {
+		panic(fmt.Sprintf("max-eval-depth: not a positive integer: %d", n))
+	}
+	return args[0]
+}
+
+// evalDepth is the number of frames on the stacks of all running
+// machines, plus the number of those machines, which are nested on the
+// Go stack.
+var evalDepth int
+
+// eval evaluates v in e.
+func eval(e env, v val) val {
+	m := &machine{}
+	m.eval(e, v)
+	return m.run()
+}
+
+// step evaluates m.expr in m.env.  Forms in tail position - the
+// branches of `if`, the last form of a body, the expansions of macros
+// and derived forms, and the bodies of closures - are evaluated
+// without pushing a frame, so tail calls run in constant space.
+func (m *machine) step() {
+	e, v := m.env, m.expr
+	if c, ok := v.(*cons); ok && c.loc != nil {
+		m.loc = c.loc
+	}
+	switch vv := v.(type) {
+	case boolean, number, bignum, flonum, rational, *vector, *bytevector, *box, keyword, str, char:
+		m.ret(vv)
+	case function:
+		// Procedures aren't written in code, but they can be put
+		// into code that's constructed for `eval`.
+		m.ret(v)
+	case symbol:
+		res, ok := lookupIdentifier(e, vv)
+		if !ok {
+			panic(fmt.Sprintf("unbound %s", unalias(vv).pr()))
+		}
+		switch res.(type) {
+		case unassigned:
+			panic(fmt.Sprintf("%s used before its initialization", unalias(vv).pr()))
+		case transformer:
+			panic(fmt.Sprintf("invalid use of macro %s", unalias(vv).pr()))
+		}
+		m.ret(res)
+	case seq:
+		head := vv.first()
+		if head, ok := head.(symbol); ok {
+			// Keywords that are bound as variables are just that.
+			binding, bound := lookupIdentifier(e, head)
+			if t, ok := binding.(transformer); ok {
+				m.eval(e, t.expand(vv.(*cons)))
+				return
+			}
+			if !bound {
+				name := unalias(head).(symbol).name
+				switch name {
+				case "if":
+					items := subforms("if", vv.rest(), 2, 3)
+					f := &ifFrame{env: e, consequent: items[1]}
+					if len(items) == 3 {
+						f.alternative = items[2]
+					}
+					m.push(f)
+					m.eval(e, items[0])
+					return
+				case "quote":
+					m.ret(subforms("quote", vv.rest(), 1, 1)[0])
+					return
+				case "delay":
+					m.ret(&promise{expr: subforms("delay", vv.rest(), 1, 1)[0], env: e})
+					return
+				case "delay-force":
+					m.ret(&promise{expr: subforms("delay-force", vv.rest(), 1, 1)[0], env: e, lazy: true})
+					return
+				case "begin":
+					if len(subforms("begin", vv.rest(), 0, -1)) == 0 {
+						m.ret(unspecified{})
+						return
+					}
+					m.evalBody(e, vv.rest())
+					return
+				case "define":
+					m.evalDefine(e, vv.rest())
+					return
+				case "set!":
+					m.evalSet(e, vv.rest())
+					return
+				case "lambda":
+					m.ret(evalLambda(e, vv.rest()))
+					return
+				case "parameterize":
+					m.evalParameterize(e, vv.rest())
+					return
+				case "define-record-type":
+					m.ret(evalDefineRecordType(e, vv.rest()))
+					return
+				case "define-syntax":
+					m.ret(evalDefineSyntax(e, vv.rest()))
+					return
+				case "define-macro", "defmacro":
+					m.ret(evalDefineMacro(e, name, vv.rest()))
+					return
+				case "let-syntax", "letrec-syntax":
+					m.ret(evalLetSyntax(e, name, vv.rest()))
+					return
+				}
+				if expand, ok := derivedForms[name]; ok {
+					m.eval(e, expand(vv.(*cons)))
+					return
+				}
+			}
+		}
+		if !isList(vv.rest()) {
+			panic(fmt.Sprintf("improper list of arguments %s", vv.rest().pr()))
 		}
+		m.push(&argFrame{env: e, forms: vv.rest()})
+		m.eval(e, head)
 	default:
-		panic(fmt.Sprintf("cannot eval %s", v.pr()))
+		panic(fmt.Sprintf("cannot eval %s", vv.pr()))
 	}
-	//panic("Should not be reached")
+}
+
+// evalSet evaluates
+//
+//	(set! name value)
+func (m *machine) evalSet(e env, forms seq) {
+	if forms.empty() || forms.rest().empty() || !forms.rest().rest().empty() {
+		panic("set!: expected a name and a value")
+	}
+	name, ok := forms.first().(symbol)
+	if !ok {
+		panic(fmt.Sprintf("set!: invalid name %s", forms.first().pr()))
+	}
+	m.push(&setFrame{env: e, name: name})
+	m.eval(e, forms.rest().first())
+}
+
+// setFrame assigns the value of a `set!`.
+type setFrame struct {
+	env  env
+	name symbol
+}
+
+func (f *setFrame) resume(m *machine, v val) {
+	if !setIdentifier(f.env, f.name, single(v)) {
+		panic(fmt.Sprintf("set!: unbound %s", unalias(f.name).pr()))
+	}
+	m.ret(unspecified{})
+}
+
+// evalDefine evaluates
+//
+//	(define name value)
+//	(define (name param ...) body ...)
+//
+// where the second form is short for defining name as
+// `(lambda (param ...) body ...)`.  Procedures created by the
+// definition are given its name.
+func (m *machine) evalDefine(e env, forms seq) {
+	if forms.empty() {
+		panic("define: missing name")
+	}
+	switch target := forms.first().(type) {
+	case symbol:
+		if forms.rest().empty() || !forms.rest().rest().empty() {
+			panic(fmt.Sprintf("define: expected one value for %s", target.name))
+		}
+		valueForm := forms.rest().first()
+		c, ok := valueForm.(*cons)
+		m.push(&defineFrame{env: e, name: target, isLambda: ok && isSymbolNamed(c.car, "lambda")})
+		m.eval(e, valueForm)
+	case *cons:
+		name, ok := target.car.(symbol)
+		if !ok {
+			panic(fmt.Sprintf("define: invalid name %s", target.car.pr()))
+		}
+		cl := evalLambda(e, &cons{car: target.cdr, cdr: forms.rest()}).(*closure)
+		cl.name = name.name
+		e.define(name, cl)
+		m.ret(unspecified{})
+	default:
+		panic(fmt.Sprintf("define: invalid name %s", target.pr()))
+	}
+}
+
+// defineFrame defines a name as the value of a `define`.  If the value
+// comes from a `lambda` form, the procedure gets the name.
+type defineFrame struct {
+	env      env
+	name     symbol
+	isLambda bool
+}
+
+func (f *defineFrame) resume(m *machine, v val) {
+	v = single(v)
+	if cl, ok := v.(*closure); ok && f.isLambda {
+		cl.name = f.name.name
+	}
+	f.env.define(f.name, v)
+	m.ret(unspecified{})
+}
+
+// checkArgCount checks that there are between min and max args in
+// a call to the procedure called name.  If max is negative, there can
+// be any number above min.
+func checkArgCount(name string, args []val, min int, max int) {
+	if len(args) < min || (max >= 0 && len(args) > max) {
+		panic(fmt.Sprintf("expected %s, got %d, in call to %s", countDescription(min, max, "argument"), len(args), name))
+	}
+}
+
+func stringArg(name string, args []val, i int) string {
+	s, ok := args[i].(str)
+	if !ok {
+		panic(fmt.Sprintf("%s: not a string: %s", name, args[i].pr()))
+	}
+	return s.s
+}
+
+func charArg(name string, args []val, i int) rune {
+	c, ok := args[i].(char)
+	if !ok {
+		panic(fmt.Sprintf("%s: not a character: %s", name, args[i].pr()))
+	}
+	return c.r
+}
+
+func intArg(name string, args []val, i int) int64 {
+	n, ok := args[i].(number)
+	if !ok {
+		panic(fmt.Sprintf("%s: not an integer: %s", name, args[i].pr()))
+	}
+	return n.i
+}
+
+// indexArg returns an integer argument that must be between 0 and
+// max, inclusive.
+func indexArg(name string, args []val, i int, max int) int {
+	n := intArg(name, args, i)
+	if n < 0 || n > int64(max) {
+		panic(fmt.Sprintf("%s: index out of range: %d", name, n))
+	}
+	return int(n)
+}
+
+func listArg(name string, args []val, i int) []val {
+	if !isList(args[i]) {
+		panic(fmt.Sprintf("%s: not a list: %s", name, args[i].pr()))
+	}
+	return seqToSlice(args[i].(seq))
 }
 
 func builtinPlus(args []val) val {
-	sum := int64(0)
+	var sum val = number{0}
 	for _, arg := range args {
-		n, ok := arg.(number)
-		if !ok {
+		if !isNumber(arg) {
 			panic(fmt.Sprintf("cannot add non-number %s", arg.pr()))
 		}
-		sum += n.i
+		sum = numAdd(sum, arg)
 	}
-	return number{sum}
+	return sum
 }
 
 func builtinMul(args []val) val {
-	prod := int64(1)
+	var prod val = number{1}
 	for _, arg := range args {
-		n, ok := arg.(number)
-		if !ok {
+		if !isNumber(arg) {
 			panic(fmt.Sprintf("cannot multiply non-number %s", arg.pr()))
 		}
-		prod *= n.i
+		prod = numMul(prod, arg)
 	}
-	return number{prod}
+	return prod
 }
 
-func evalTest(input string, expected string) {
-	e := map[string]val{
-		"one": number{1},
-		"+":   builtin{name: "+", f: builtinPlus},
-		"*":   builtin{name: "*", f: builtinMul},
+var builtins = []builtin{
+	{name: "+", f: builtinPlus, min: 0, max: -1},
+	{name: "*", f: builtinMul, min: 0, max: -1},
+	{name: "-", f: builtinMinus, min: 1, max: -1},
+	{name: "/", f: builtinDiv, min: 1, max: -1},
+	numericComparison("=", func(c int) bool { return c == 0 }),
+	numericComparison("<", func(c int) bool { return c < 0 }),
+	numericComparison("<=", func(c int) bool { return c <= 0 }),
+	numericComparison(">", func(c int) bool { return c > 0 }),
+	numericComparison(">=", func(c int) bool { return c >= 0 }),
+	builtinExtremum("min", func(c int) bool { return c < 0 }),
+	builtinExtremum("max", func(c int) bool { return c > 0 }),
+	{name: "abs", f: builtinAbs, min: 1, max: 1},
+	{name: "expt", f: builtinExpt, min: 2, max: 2},
+	builtinGCDOrLCM("gcd"),
+	builtinGCDOrLCM("lcm"),
+	{name: "sqrt", f: builtinSqrt, min: 1, max: 1},
+	{name: "quotient", f: builtinQuotient, min: 2, max: 2},
+	{name: "remainder", f: builtinRemainder, min: 2, max: 2},
+	{name: "modulo", f: builtinModulo, min: 2, max: 2},
+	{name: "numerator", f: builtinNumerator, min: 1, max: 1},
+	{name: "denominator", f: builtinDenominator, min: 1, max: 1},
+	{name: "string->number", f: builtinStringToNumber, min: 1, max: 2},
+	{name: "number->string", f: builtinNumberToString, min: 1, max: 2},
+	{name: "number?", f: builtinIsNumber, min: 1, max: 1},
+	{name: "integer?", f: builtinIsInteger, min: 1, max: 1},
+	builtinSignTest("zero?", func(s int) bool { return s == 0 }),
+	builtinSignTest("positive?", func(s int) bool { return s > 0 }),
+	builtinSignTest("negative?", func(s int) bool { return s < 0 }),
+	builtinParityTest("odd?", true),
+	builtinParityTest("even?", false),
+	{name: "exact?", f: builtinIsExact, min: 1, max: 1},
+	{name: "inexact?", f: builtinIsInexact, min: 1, max: 1},
+	{name: "pp", f: builtinPP, min: 1, max: 2},
+
+	builtinTypePredicate("pair?", func(v val) bool { _, ok := v.(*cons); return ok }),
+	builtinTypePredicate("null?", func(v val) bool { _, ok := v.(empty); return ok }),
+	builtinTypePredicate("symbol?", func(v val) bool { _, ok := v.(symbol); return ok }),
+	builtinTypePredicate("boolean?", func(v val) bool { _, ok := v.(boolean); return ok }),
+	builtinTypePredicate("procedure?", func(v val) bool { _, ok := v.(function); return ok }),
+	builtinTypePredicate("string?", func(v val) bool { _, ok := v.(str); return ok }),
+	builtinTypePredicate("vector?", func(v val) bool { _, ok := v.(*vector); return ok }),
+	{name: "not", f: builtinNot, min: 1, max: 1},
+	{name: "boolean=?", f: builtinBooleanEqual, min: 2, max: -1},
+	{name: "eq?", f: builtinIsEq, min: 2, max: 2},
+	{name: "eqv?", f: builtinIsEqv, min: 2, max: 2},
+	{name: "equal?", f: builtinIsEqual, min: 2, max: 2},
+	{name: "cons", f: builtinCons, min: 2, max: 2},
+	{name: "car", f: builtinCar, min: 1, max: 1},
+	{name: "cdr", f: builtinCdr, min: 1, max: 1},
+	{name: "list", f: builtinList, min: 0, max: -1},
+	{name: "length", f: builtinLength, min: 1, max: 1},
+	{name: "append", f: builtinAppend, min: 0, max: -1},
+	{name: "reverse", f: builtinReverse, min: 1, max: 1},
+	{name: "list?", f: builtinIsList, min: 1, max: 1},
+	{name: "list-tail", f: builtinListTail, min: 2, max: 2},
+	{name: "list-ref", f: builtinListRef, min: 2, max: 2},
+	builtinMember("memq", eqv),
+	builtinMember("memv", eqv),
+	builtinMember("member", isEqual),
+	builtinAssoc("assq", eqv),
+	builtinAssoc("assv", eqv),
+	builtinAssoc("assoc", isEqual),
+	{name: "map", control: builtinMap, min: 2, max: -1},
+	{name: "for-each", control: builtinForEach, min: 2, max: -1},
+	{name: "filter", control: builtinFilter, min: 2, max: 2},
+	{name: "fold-left", control: builtinFoldLeft, min: 3, max: -1},
+	{name: "fold-right", control: builtinFoldRight, min: 3, max: -1},
+	{name: "reduce", control: builtinReduce, min: 3, max: 3},
+	{name: "sort", f: builtinSort, min: 2, max: 2},
+	{name: "sort!", f: builtinSortInPlace, min: 2, max: 2},
+	{name: "set-car!", f: builtinSetCar, min: 2, max: 2},
+	{name: "set-cdr!", f: builtinSetCdr, min: 2, max: 2},
+
+	{name: "vector", f: builtinVector, min: 0, max: -1},
+	{name: "make-vector", f: builtinMakeVector, min: 1, max: 2},
+	{name: "vector-length", f: builtinVectorLength, min: 1, max: 1},
+	{name: "vector-ref", f: builtinVectorRef, min: 2, max: 2},
+	{name: "vector-set!", f: builtinVectorSet, min: 3, max: 3},
+	{name: "vector->list", f: builtinVectorToList, min: 1, max: 3},
+	{name: "list->vector", f: builtinListToVector, min: 1, max: 1},
+	{name: "vector-fill!", f: builtinVectorFill, min: 2, max: 4},
+	{name: "vector-map", control: builtinVectorMap, min: 2, max: -1},
+	{name: "vector-for-each", control: builtinVectorForEach, min: 2, max: -1},
+	{name: "vector-copy", f: builtinVectorCopy, min: 1, max: 3},
+	{name: "subvector", f: builtinSubvector, min: 3, max: 3},
+	{name: "vector-copy!", f: builtinVectorCopyInPlace, min: 3, max: 5},
+	{name: "vector-append", f: builtinVectorAppend, min: 0, max: -1},
+	{name: "vector-sort!", f: builtinVectorSortInPlace, min: 2, max: 2},
+
+	{name: "bytevector", f: builtinBytevector, min: 0, max: -1},
+	{name: "make-bytevector", f: builtinMakeBytevector, min: 1, max: 2},
+	{name: "bytevector?", f: builtinIsBytevector, min: 1, max: 1},
+	{name: "bytevector-length", f: builtinBytevectorLength, min: 1, max: 1},
+	{name: "bytevector-u8-ref", f: builtinBytevectorU8Ref, min: 2, max: 2},
+	{name: "bytevector-u8-set!", f: builtinBytevectorU8Set, min: 3, max: 3},
+	{name: "bytevector-copy", f: builtinBytevectorCopy, min: 1, max: 3},
+	{name: "bytevector-append", f: builtinBytevectorAppend, min: 0, max: -1},
+	{name: "utf8->string", f: builtinUTF8ToString, min: 1, max: 3},
+	{name: "string->utf8", f: builtinStringToUTF8, min: 1, max: 3},
+
+	{name: "port?", f: builtinIsPort, min: 1, max: 1},
+	{name: "input-port?", f: builtinIsInputPort, min: 1, max: 1},
+	{name: "output-port?", f: builtinIsOutputPort, min: 1, max: 1},
+	{name: "input-port-open?", f: builtinIsInputPortOpen, min: 1, max: 1},
+	{name: "output-port-open?", f: builtinIsOutputPortOpen, min: 1, max: 1},
+	{name: "close-port", f: builtinClosePort, min: 1, max: 1},
+	{name: "close-input-port", f: builtinCloseInputPort, min: 1, max: 1},
+	{name: "close-output-port", f: builtinCloseOutputPort, min: 1, max: 1},
+	{name: "open-input-string", f: builtinOpenInputString, min: 1, max: 1},
+	{name: "open-output-string", f: builtinOpenOutputString, min: 0, max: 0},
+	{name: "get-output-string", f: builtinGetOutputString, min: 1, max: 1},
+	{name: "display", f: builtinDisplay, min: 1, max: 2},
+	{name: "write", f: builtinWrite, min: 1, max: 2},
+	{name: "newline", f: builtinNewline, min: 0, max: 1},
+	{name: "write-string", f: builtinWriteString, min: 1, max: 4},
+	{name: "read", f: builtinRead, min: 0, max: 1},
+	{name: "read-char", f: builtinReadChar, min: 0, max: 1},
+	{name: "peek-char", f: builtinPeekChar, min: 0, max: 1},
+	{name: "read-line", f: builtinReadLine, min: 0, max: 1},
+	{name: "char-ready?", f: builtinIsCharReady, min: 0, max: 1},
+	{name: "eof-object", f: builtinEOFObject, min: 0, max: 0},
+	{name: "eof-object?", f: builtinIsEOFObject, min: 1, max: 1},
+
+	{name: "keyword?", f: builtinIsKeyword, min: 1, max: 1},
+	{name: "keyword->string", f: builtinKeywordToString, min: 1, max: 1},
+	{name: "string->keyword", f: builtinStringToKeyword, min: 1, max: 1},
+
+	{name: "environment?", f: builtinIsEnvironment, min: 1, max: 1},
+
+	{name: "symbol->string", f: builtinSymbolToString, min: 1, max: 1},
+	{name: "string->symbol", f: builtinStringToSymbol, min: 1, max: 1},
+	{name: "symbol=?", f: builtinSymbolEqual, min: 2, max: -1},
+	{name: "gensym", f: builtinGensym, min: 0, max: 1},
+	{name: "generate-uninterned-symbol", f: builtinGensym, min: 0, max: 1},
+
+	{name: "make-parameter", f: builtinMakeParameter, min: 1, max: 2},
+
+	{name: "box", f: builtinBox, min: 1, max: 1},
+	{name: "box?", f: builtinIsBox, min: 1, max: 1},
+	{name: "unbox", f: builtinUnbox, min: 1, max: 1},
+	{name: "set-box!", f: builtinSetBox, min: 2, max: 2},
+
+	{name: "error", f: builtinError, min: 1, max: -1},
+	{name: "make-error-object", f: builtinMakeErrorObject, min: 1, max: -1},
+	{name: "error-object?", f: builtinIsErrorObject, min: 1, max: 1},
+	{name: "error-object-message", f: builtinErrorObjectMessage, min: 1, max: 1},
+	{name: "error-object-irritants", f: builtinErrorObjectIrritants, min: 1, max: 1},
+
+	{name: "procedure-name", f: builtinProcedureName, min: 1, max: 1},
+	{name: "procedure-arity", f: builtinProcedureArity, min: 1, max: 1},
+
+	{name: "values", f: builtinValues, min: 0, max: -1},
+	{name: "call-with-values", control: builtinCallWithValues, min: 2, max: 2},
+	{name: "call-with-current-continuation", control: builtinCallCC, min: 1, max: 1},
+	{name: "call/cc", control: builtinCallCC, min: 1, max: 1},
+	{name: "dynamic-wind", control: builtinDynamicWind, min: 3, max: 3},
+	{name: "raise", f: builtinRaise, min: 1, max: 1},
+	{name: "raise-continuable", control: builtinRaiseContinuable, min: 1, max: 1},
+	{name: "with-exception-handler", control: builtinWithExceptionHandler, min: 2, max: 2},
+
+	{name: "force", f: builtinForce, min: 1, max: 1},
+	{name: "make-promise", f: builtinMakePromise, min: 1, max: 1},
+	{name: "promise?", f: builtinIsPromise, min: 1, max: 1},
+
+	{name: "make-hash-table", f: builtinMakeHashTable, min: 0, max: 1},
+	{name: "hash-table?", f: builtinIsHashTable, min: 1, max: 1},
+	{name: "hash-ref", f: builtinHashRef, min: 2, max: 3},
+	{name: "hash-set!", f: builtinHashSet, min: 3, max: 3},
+	{name: "hash-delete!", f: builtinHashDelete, min: 2, max: 2},
+	{name: "hash-count", f: builtinHashCount, min: 1, max: 1},
+	{name: "hash-keys", f: builtinHashKeys, min: 1, max: 1},
+	{name: "hash-for-each", f: builtinHashForEach, min: 2, max: 2},
+
+	{name: "string-length", f: builtinStringLength, min: 1, max: 1},
+	{name: "substring", f: builtinSubstring, min: 2, max: 3},
+	{name: "string-append", f: builtinStringAppend, min: 0, max: -1},
+	{name: "string-ref", f: builtinStringRef, min: 2, max: 2},
+	{name: "string=?", f: builtinStringEqual, min: 1, max: -1},
+	{name: "string<?", f: builtinStringLess, min: 1, max: -1},
+	{name: "string->list", f: builtinStringToList, min: 1, max: 3},
+	{name: "list->string", f: builtinListToString, min: 1, max: 1},
+	{name: "make-string", f: builtinMakeString, min: 1, max: 2},
+	{name: "string", f: builtinString, min: 0, max: -1},
+	{name: "string-copy", f: builtinStringCopy, min: 1, max: 3},
+	{name: "string-set!", f: builtinStringSet, min: 3, max: 3},
+	{name: "string-fill!", f: builtinStringFill, min: 2, max: 4},
+	{name: "string-upcase", f: builtinStringUpcase, min: 1, max: 1},
+	{name: "string-downcase", f: builtinStringDowncase, min: 1, max: 1},
+	{name: "string-index", f: builtinStringIndex, min: 2, max: 2},
+	{name: "string-contains", f: builtinStringContains, min: 2, max: 2},
+	{name: "string-split", f: builtinStringSplit, min: 1, max: 2},
+	{name: "string-join", f: builtinStringJoin, min: 1, max: 2},
+	{name: "string-trim", f: builtinStringTrim, min: 1, max: 1},
+	{name: "string-trim-left", f: builtinStringTrimLeft, min: 1, max: 1},
+	{name: "string-trim-right", f: builtinStringTrimRight, min: 1, max: 1},
+
+	{name: "char?", f: builtinIsChar, min: 1, max: 1},
+	{name: "char->integer", f: builtinCharToInteger, min: 1, max: 1},
+	{name: "integer->char", f: builtinIntegerToChar, min: 1, max: 1},
+	{name: "char-alphabetic?", f: builtinCharIsAlphabetic, min: 1, max: 1},
+	{name: "char-numeric?", f: builtinCharIsNumeric, min: 1, max: 1},
+	{name: "char-upcase", f: builtinCharUpcase, min: 1, max: 1},
+	{name: "char-downcase", f: builtinCharDowncase, min: 1, max: 1},
+}
+
+// parameters are the built-in parameter objects.
+var parameters = []*parameter{
+	currentInputPort,
+	currentOutputPort,
+	currentErrorPort,
+	maxEvalDepth,
+}
+
+func newGlobalEnv() globalEnv {
+	ge := globalEnv{}
+	for _, b := range builtins {
+		ge[symbol{name: b.name}] = b
+	}
+	for _, p := range parameters {
+		ge[symbol{name: p.name}] = p
+	}
+	for _, b := range environmentBuiltins(ge) {
+		ge[symbol{name: b.name}] = b
 	}
+	return ge
+}
+
+func testEnv() globalEnv {
+	ge := newGlobalEnv()
+	ge[symbol{name: "one"}] = number{1}
+	return ge
+}
+
+func evalTest(input string, expected string) {
+	evalTestIn(testEnv(), input, expected)
+}
 
+// evalTestIn is like evalTest, but evaluates in the environment e, so
+// that several tests can share state.
+func evalTestIn(e env, input string, expected string) {
 	vinput, err := read(input)
 	if err != nil {
 		panic("could not read")
 	}
 
-	vresult := eval(globalEnv(e), vinput)
+	vresult := eval(e, vinput)
 
 	if expected != "" {
 		vexpected, err := read(expected)
@@ -425,27 +2022,1513 @@ func evalTest(input string, expected string) {
 	fmt.Printf("eval(%s) => %s\n", vinput.pr(), vresult.pr())
 }
 
+func prettyTest(input string, width int, expected string) {
+	v, err := read(input)
+	if err != nil {
+		panic("could not read")
+	}
+	result := prettyPrint(v, width)
+	if result != expected {
+		panic(fmt.Sprintf("prettyPrint(%s, %d) =>\n%s\ninstead of\n%s", v.pr(), width, result, expected))
+	}
+	fmt.Printf("prettyPrint(%s, %d) =>\n%s\n", v.pr(), width, result)
+}
+
+// displayTest checks the displayed representation of the value of
+// input.
+func displayTest(input string, expected string) {
+	displayTestIn(testEnv(), input, expected)
+}
+
+func displayTestIn(e env, input string, expected string) {
+	vinput, err := read(input)
+	if err != nil {
+		panic("could not read")
+	}
+
+	result := display(eval(e, vinput))
+	if result != expected {
+		panic(fmt.Sprintf("display(eval(%s)) => `%s` != `%s`", vinput.pr(), result, expected))
+	}
+
+	fmt.Printf("display(eval(%s)) => `%s`\n", vinput.pr(), result)
+}
+
+// evalErrorTest checks that evaluating input fails with an error
+// message containing expected.
+func evalErrorTest(input string, expected string) {
+	evalErrorTestIn(testEnv(), input, expected)
+}
+
+func evalErrorTestIn(e env, input string, expected string) {
+	vinput, err := read(input)
+	if err != nil {
+		panic("could not read")
+	}
+
+	msg, failed := func() (msg string, failed bool) {
+		defer func() {
+			if r := recover(); r != nil {
+				msg, failed = fmt.Sprint(r), true
+			}
+		}()
+		return eval(e, vinput).pr(), false
+	}()
+
+	if !failed {
+		panic(fmt.Sprintf("eval(%s) => %s should have failed", vinput.pr(), msg))
+	}
+	if !strings.Contains(msg, expected) {
+		panic(fmt.Sprintf("eval(%s) failed with `%s` instead of `%s`", vinput.pr(), msg, expected))
+	}
+
+	fmt.Printf("eval(%s) => error: %s\n", vinput.pr(), msg)
+}
+
 func main() {
 	readTest("  123  ")
-	readTest("1-2")
+	readErrorTest("1-2")
+	readTest("(- 5 -5 +42 + -foo ->x)")
+	readTest("(3.14 1e10 -0.5 .5 -.5e-3 1.0 +inf.0 -inf.0 +nan.0)")
+	readTest("(#xff #XFF #b1010 #o777 #d99 #x-1a #d1.5)")
+	readTest("(3/4 -6/4 4/2 #x1/10)")
+	readErrorTest("1/0")
+	readErrorTest("1/2/3")
+	readErrorTest("#b102")
+	readErrorTest("#x")
+	readErrorTest("1.2.3")
+	readErrorTest("1e")
+	readErrorTest("12abc")
+	readErrorTest("(+ 1 -2x)")
 	readTest("  #t")
 	readTest("  #f")
+	readTest("(#t #true #f #false)")
+	readErrorTest("#tru")
+	readErrorTest("#truex")
+	readErrorTest("#foo")
+	readErrorTest("#")
 	readTest("  12(  ")
 	readTest("  (+ 1 2 () )")
 	readTest("(if #f 1 2)")
+	readTest(`"hello world"`)
+	readTest(`("a\"b" "c\\d" "e\nf")`)
+	readTest("#(1 #(2 3) () \"x\")")
+	readErrorTest("#(1 . 2)")
+	readTest("#u8(0 255 #x10)")
+	readTest("#u8()")
+	readErrorTest("#u8(256)")
+	readErrorTest("#u8(a)")
+	readTest("#&(1 #&2)")
+	readTest("(#:foo #:|a b| #:|1|)")
+	readErrorTest("#:")
+	readErrorTest("#: foo")
+	readErrorTest("#:1")
+	circularReadTest("#0=#&#0#")
+	readErrorTest("#&")
+	readAllTest("", "()")
+	readAllTest(" ; nothing\n", "()")
+	readAllTest("1 (2 3) foo #;bar \"baz\" ; end", "(1 (2 3) foo \"baz\")")
+
+	streamTest("", "()")
+	streamTest("1 2\n3", "(1 2 3)")
+	streamTest("(define (f x)\n  ; comment\n  (+ x\n 1)) #|\n|# foo\n", "((define (f x) (+ x 1)) foo)")
+	streamTest("\"multi\nline\" #;\n\n(skipped) 12\n", "(\"multi\nline\" 12)")
+
+	readTest(`(|hello world| |a(b)| |x\|y| || |42| |foo|)`)
+	readErrorTest("|abc")
+
+	readTest("(λ (ä) \"héllo wörld\" #\\λ #\\ü |日本 語|)")
+	readErrorPosTest("(λ\n ü 1ö)", 2, 4)
+
+	readTest("(#0=(a b) #0# #1=x #1#)")
+	circularReadTest("#0=(a b . #0#)")
+	circularReadTest("#0=#(1 (2 #0#))")
+	printTest("#0=(a b . #0#)", "#0=(a b . #0#)")
+	printTest("#0=(#0# . #0#)", "#0=(#0# . #0#)")
+	printTest("#0=#(1 (2 #0#) #1=(3 . #1#))", "#0=#(1 (2 #0#) #1=(3 . #1#))")
+	printTest("(#0=(x) #0#)", "((x) (x))")
+	printTest("(1 . #0=(2 3 . #0#))", "(1 . #0=(2 3 . #0#))")
+	readErrorTest("#0#")
+	readErrorTest("#0=#0#")
+	readErrorTest("#12x")
+
+	oldMaxReadDepth := maxReadDepth
+	maxReadDepth = 10
+	readTest(strings.Repeat("(", 10) + strings.Repeat(")", 10))
+	readErrorTest(strings.Repeat("(", 11) + strings.Repeat(")", 11))
+	readErrorTest(strings.Repeat("'", 10) + "x")
+	maxReadDepth = oldMaxReadDepth
+	readLengthTest("("+strings.Repeat("x ", 1000000)+")", 1000000)
+	writeLengthTest("("+strings.Repeat("x ", 1000000)+")", 2000001)
+
+	readTest("'foo")
+	readTest("'(1 '2 3)")
+	readTest("`(a ,b ,@c)")
+	readTest("(1 . 2)")
+	readTest("(1 2 . (3 4))")
+	readTest("(a .b . c)")
+	readTest("(1 ; one\n 2;two\n;three\n)")
+	readTest("; comment\n  foo;bar")
+	readTest("(1 #| two #| nested |# |# 3)")
+	readTest("(1 #;(2 3) 4 #;5)")
+	readTest("#;1 #;#;2 3 4")
+	readErrorTest("(1 #| 2 )")
+	readErrorTest("(1 #;)")
+	readErrorTest("(. 1)")
+	readErrorTest("(1 . 2 3)")
+	readErrorTest("(1 . )")
+	readErrorTest("(1 2")
+	readErrorPosTest(")", 1, 1)
+	readErrorPosTest("(a\n  b\n  1x)", 3, 3)
+	readErrorPosTest("(a\n \"b\\q\")", 2, 4)
+	readErrorPosTest("(a b\n", 2, 1)
+	readTest(`(#\a #\( #\space #\newline #\x41 #\x7)`)
 
 	evalTest("123", "123")
 	evalTest("#t", "#t")
 	evalTest("#f", "#f")
+	evalTest("#true", "#t")
+	evalTest("#false", "#f")
+	evalTest(`"abc"`, `"abc"`)
+	evalTest(`(quote ("a\tb" "\""))`, `("a	b" "\"")`)
+	evalTest(`#\a`, `#\a`)
+	evalTest(`#\space`, `#\ `)
+	evalTest(`#\x41`, `#\A`)
 
 	evalTest("(if #f 1 2)", "2")
 	evalTest("(if 123 1 2)", "1")
 	evalTest("(if 123 (quote true) (quote false))", "true")
 
+	evalTest("'foo", "foo")
+	evalTest("'(1 2 3)", "(1 2 3)")
+	evalTest("''foo", "(quote foo)")
+	evalTest("#(1 2 3)", "#(1 2 3)")
+	evalTest("'#(a (b) #())", "#(a (b) #())")
+	evalTest("#u8(1 2 3)", "#u8(1 2 3)")
+	evalTest("'(#u8(7))", "(#u8(7))")
+	evalTest("'|foo|", "foo")
+	evalTest("'|a b|", "|a b|")
+	evalTest("'(|1| |.| |;| |#t|)", "(|1| |.| |;| |#t|)")
+	evalTest("'λ", "λ")
+	evalTest("\"ünïcödé\"", "\"ünïcödé\"")
+	evalTest("'(#\\λ #\\€ #\\x3bb)", "(#\\λ #\\€ #\\λ)")
+	evalTest("'(1 . 2)", "(1 . 2)")
+	evalTest("'(1 . (2 . (3 . ())))", "(1 2 3)")
+	evalTest("'(1 2 . 3)", "(1 . (2 . 3))")
+	evalTest("'`(a ,b ,@c)", "(quasiquote (a (unquote b) (unquote-splicing c)))")
+
+	evalTest("-5", "-5")
+	evalTest("+42", "42")
+	evalTest("'(- -)", "(- -)")
+	evalTest("#xff", "255")
+	evalTest("#b-101", "-5")
+	evalTest("3.14", "3.14")
+	evalTest("1e3", "1000.0")
+	evalTest("-0.5", "-.5")
+	evalTest("1.5e-7", "1.5e-07")
+
 	evalTest("one", "1")
 	evalTest("+", "")
 	evalTest("(+ 1 2 3)", "6")
 	evalTest("(* 3 4)", "12")
+	evalTest("(+ 1/2 1/3)", "5/6")
+	evalTest("(+ 1/2 1/2)", "1")
+	evalTest("(* 2/3 3/2)", "1")
+	evalTest("(* 2 3/4 -1)", "-3/2")
+	evalTest("(+ 1 2/4)", "3/2")
+	evalTest("(* 99999999999 99999999999)", "9999999999800000000001")
+	evalTest("(+ 9223372036854775807 1)", "9223372036854775808")
+	evalTest("(+ -9223372036854775808 -1)", "-9223372036854775809")
+	evalTest("(+ 9223372036854775808 -1)", "9223372036854775807")
+	evalTest("(* -9223372036854775808 1)", "-9223372036854775808")
+	evalTest("(* -9223372036854775808 -1)", "9223372036854775808")
+	evalTest("(* 4294967296 4294967296 1/18446744073709551616)", "1")
+	evalTest("123456789012345678901234567890", "123456789012345678901234567890")
+	evalTest("#x-ffffffffffffffffff", "-4722366482869645213695")
+	evalTest("(+ 100000000000000000000/3 2/3)", "33333333333333333334")
+	evalTest("(+ 100000000000000000000 0.5)", "1e20")
+	evalTest("(exact? 100000000000000000000)", "#t")
+	evalTest("(/ 1 3)", "1/3")
+	evalTest("(/ 6 3)", "2")
+	evalTest("(/ 6 4)", "3/2")
+	evalTest("(/ -6 4)", "-3/2")
+	evalTest("(/ 6 -4)", "-3/2")
+	evalTest("(/ 4)", "1/4")
+	evalTest("(/ 1/2)", "2")
+	evalTest("(/ 120 2 3 4)", "5")
+	evalTest("(+ (/ 1 3) (/ 2 3))", "1")
+	evalTest("(* (/ 1 3) 3)", "1")
+	evalTest("(/ 1 2.0)", "0.5")
+	evalTest("(/ 1.0 0)", "+inf.0")
+	evalTest("(/ 100000000000000000000 3)", "100000000000000000000/3")
+	evalTest("(- 5)", "-5")
+	evalTest("(- 10 1 2 3)", "4")
+	evalTest("(- 1/2 1)", "-1/2")
+	evalTest("(- 1 0.5)", "0.5")
+	evalTest("(- -9223372036854775808)", "9223372036854775808")
+	evalTest("(- -9223372036854775808 1)", "-9223372036854775809")
+	evalTest("(- 9223372036854775808 1)", "9223372036854775807")
+	evalErrorTest("(-)", "expected at least 1 argument, got 0, in call to -")
+	evalErrorTest("(- 1 'a)", "-: not a number: a")
+	evalTest("(quotient 17 5)", "3")
+	evalTest("(quotient -17 5)", "-3")
+	evalTest("(remainder 17 -5)", "2")
+	evalTest("(remainder -17 5)", "-2")
+	evalTest("(modulo 17 -5)", "-3")
+	evalTest("(modulo -17 5)", "3")
+	evalTest("(modulo -15 5)", "0")
+	evalTest("(modulo 17.0 -5)", "-3.0")
+	evalTest("(quotient -7.0 2)", "-3.0")
+	evalTest("(quotient -9223372036854775808 -1)", "9223372036854775808")
+	evalTest("(remainder 100000000000000000001 10)", "1")
+	evalTest("(modulo -100000000000000000001 10)", "9")
+	evalErrorTest("(quotient 1 0)", "division of 1 by zero")
+	evalErrorTest("(modulo 1 0.0)", "division of 1 by zero")
+	evalErrorTest("(remainder 1/2 1)", "remainder: not an integer: 1/2")
+	evalErrorTest("(quotient 1.5 1)", "quotient: not an integer: 1.5")
+	evalErrorTest("(quotient +inf.0 2)", "quotient: not an integer: +inf.0")
+	evalErrorTest("(remainder 2 -inf.0)", "remainder: not an integer: -inf.0")
+	evalErrorTest("(modulo +inf.0 2)", "modulo: not an integer: +inf.0")
+	evalErrorTest("(quotient +nan.0 2)", "quotient: not an integer: +nan.0")
+	evalTest("(= 1 1 1)", "#t")
+	evalTest("(= 1 1 2)", "#f")
+	evalTest("(= 1 1.0 2/2)", "#t")
+	evalTest("(< 1 2 3)", "#t")
+	evalTest("(< 1 3 2)", "#f")
+	evalTest("(< 1 1)", "#f")
+	evalTest("(<= 1 1 2)", "#t")
+	evalTest("(> 3 2 1)", "#t")
+	evalTest("(> 3 2 2)", "#f")
+	evalTest("(>= 3 2 2)", "#t")
+	evalTest("(< 1/3 0.34 1/2)", "#t")
+	evalTest("(< 9223372036854775807 9223372036854775808)", "#t")
+	evalTest("(= 100000000000000000000 100000000000000000000)", "#t")
+	evalTest("(< 5)", "#t")
+	evalTest("(= +nan.0 +nan.0)", "#f")
+	evalTest("(< -inf.0 0 +inf.0)", "#t")
+	evalTest("(= 9007199254740993 9007199254740992.0)", "#f")
+	evalTest("(= 9007199254740992 9007199254740992.0)", "#t")
+	evalTest("(< 9007199254740992.0 9007199254740993)", "#t")
+	evalTest("(> 9007199254740993 9007199254740992.0 9007199254740992)", "#f")
+	evalTest("(>= 9007199254740993 9007199254740992.0 9007199254740992)", "#t")
+	evalTest("(> 1/3 0.3333333333333333)", "#t")
+	evalTest("(< 100000000000000000000 +inf.0)", "#t")
+	evalTest("(> 100000000000000000000 -inf.0)", "#t")
+	evalTest("(< 1 +nan.0)", "#f")
+	evalTest("(> +nan.0 1)", "#f")
+	evalErrorTest("(<)", "expected at least 1 argument, got 0, in call to <")
+	evalErrorTest("(< 2 1 'a)", "<: not a number: a")
+	evalTest("(let loop ((i 0) (sum 0)) (if (< i 10) (loop (+ i 1) (+ sum i)) sum))", "45")
+	evalTest("(min 3 1 2)", "1")
+	evalTest("(max 3 1 2)", "3")
+	evalTest("(max 1 2.0)", "2.0")
+	evalTest("(min 1 2.0)", "1.0")
+	evalTest("(min 1/2 1/3)", "1/3")
+	evalErrorTest("(max)", "expected at least 1 argument, got 0, in call to max")
+	evalErrorTest("(min 1 'a)", "min: not a number: a")
+	evalTest("(abs -5)", "5")
+	evalTest("(abs 5)", "5")
+	evalTest("(abs -1/2)", "1/2")
+	evalTest("(abs -2.5)", "2.5")
+	evalTest("(abs -9223372036854775808)", "9223372036854775808")
+	evalTest("(expt 2 10)", "1024")
+	evalTest("(expt 2 100)", "1267650600228229401496703205376")
+	evalTest("(expt 2 -2)", "1/4")
+	evalTest("(expt 2/3 3)", "8/27")
+	evalTest("(expt -2 3)", "-8")
+	evalTest("(expt 0 0)", "1")
+	evalTest("(expt 2.0 3)", "8.0")
+	evalTest("(expt 2 0.5)", "1.4142135623730951")
+	evalTest("(expt 4 1/2)", "2.0")
+	evalErrorTest("(expt 0 -1)", "division of 1 by zero")
+	evalTest("(expt 1 100000000000000000000)", "1")
+	evalTest("(expt -1 100000000000000000000)", "1")
+	evalTest("(expt -1 100000000000000000001)", "-1")
+	evalTest("(expt -1 -100000000000000000001)", "-1")
+	evalTest("(expt 0 100000000000000000000)", "0")
+	evalErrorTest("(expt 0 -100000000000000000000)", "division of 1 by zero")
+	evalErrorTest("(expt 2 100000000000000000000)", "expt: exponent too large: 100000000000000000000")
+	evalErrorTest("(expt 1/2 -100000000000000000000)", "expt: exponent too large: -100000000000000000000")
+	evalTest("(expt 1.0 100000000000000000000)", "1.0")
+	evalTest("(gcd 12 18)", "6")
+	evalTest("(gcd -12 18 8)", "2")
+	evalTest("(gcd)", "0")
+	evalTest("(gcd 0 5)", "5")
+	evalTest("(lcm 4 6)", "12")
+	evalTest("(lcm -4 6 10)", "60")
+	evalTest("(lcm)", "1")
+	evalTest("(lcm 0 5)", "0")
+	evalTest("(gcd 12.0 18)", "6.0")
+	evalTest("(lcm 100000000000000000000 3)", "300000000000000000000")
+	evalErrorTest("(gcd 1/2 1)", "gcd: not an integer: 1/2")
+	evalErrorTest("(gcd +inf.0 2)", "gcd: not an integer: +inf.0")
+	evalErrorTest("(lcm 2 -inf.0)", "lcm: not an integer: -inf.0")
+	evalErrorTest("(gcd +nan.0)", "gcd: not an integer: +nan.0")
+	evalTest("(sqrt 16)", "4")
+	evalTest("(sqrt 4/9)", "2/3")
+	evalTest("(sqrt 2)", "1.4142135623730951")
+	evalTest("(sqrt 16.0)", "4.0")
+	evalTest("(sqrt 100000000000000000000)", "10000000000")
+	evalErrorTest("(sqrt -4)", "sqrt: negative argument: -4")
+	evalTest(`(string->number "42")`, "42")
+	evalTest(`(string->number "-1/2")`, "-1/2")
+	evalTest(`(string->number "1e3")`, "1000.0")
+	evalTest(`(string->number "ff" 16)`, "255")
+	evalTest(`(string->number "-101" 2)`, "-5")
+	evalTest(`(string->number "#xff")`, "255")
+	evalTest(`(string->number "#b101" 16)`, "5")
+	evalTest(`(string->number "100000000000000000000")`, "100000000000000000000")
+	evalTest(`(string->number "abc")`, "#f")
+	evalTest(`(string->number "1.5" 16)`, "#f")
+	evalTest(`(string->number "")`, "#f")
+	evalTest(`(string->number "+")`, "#f")
+	evalErrorTest(`(string->number "1" 3)`, "string->number: invalid radix 3")
+	evalTest(`(number->string 42)`, `"42"`)
+	evalTest(`(number->string -255 16)`, `"-ff"`)
+	evalTest(`(number->string 5 2)`, `"101"`)
+	evalTest(`(number->string 3/4 2)`, `"11/100"`)
+	evalTest(`(number->string 1.5)`, `"1.5"`)
+	evalTest(`(number->string 100000000000000000000 16)`, `"56bc75e2d63100000"`)
+	evalErrorTest(`(number->string 1.5 2)`, "number->string: inexact number in radix 2: 1.5")
+	evalErrorTest(`(number->string 'a)`, "number->string: not a number: a")
+	evalTest(`(string->number (number->string 1/3 8) 8)`, "1/3")
+	evalTest("(number? 1)", "#t")
+	evalTest("(number? 1/2)", "#t")
+	evalTest("(number? 1.5)", "#t")
+	evalTest("(number? 100000000000000000000)", "#t")
+	evalTest("(number? 'a)", "#f")
+	evalTest("(integer? 1)", "#t")
+	evalTest("(integer? 2.0)", "#t")
+	evalTest("(integer? 2.5)", "#f")
+	evalTest("(integer? 1/2)", "#f")
+	evalTest("(integer? +inf.0)", "#f")
+	evalTest("(integer? \"1\")", "#f")
+	evalTest("(zero? 0)", "#t")
+	evalTest("(zero? 0.0)", "#t")
+	evalTest("(zero? 1/2)", "#f")
+	evalTest("(positive? 1/2)", "#t")
+	evalTest("(positive? -1)", "#f")
+	evalTest("(positive? 0)", "#f")
+	evalTest("(negative? -100000000000000000000)", "#t")
+	evalTest("(negative? +nan.0)", "#f")
+	evalTest("(odd? 3)", "#t")
+	evalTest("(odd? -3)", "#t")
+	evalTest("(even? -4)", "#t")
+	evalTest("(even? 0)", "#t")
+	evalTest("(even? 100000000000000000001)", "#f")
+	evalTest("(odd? 3.0)", "#t")
+	evalErrorTest("(zero? 'a)", "zero?: not a number: a")
+	evalErrorTest("(even? 1.5)", "even?: not an integer: 1.5")
+	evalTest("(numerator 6/4)", "3")
+	evalTest("(denominator 6/4)", "2")
+	evalTest("(denominator 5)", "1")
+	evalErrorTest("(/ 1 0)", "division of 1 by zero")
+	evalErrorTest("(/ 0)", "division of 1 by zero")
+	evalErrorTest("(/ 'a)", "not a number")
+	evalTest("(+ 1 2.5)", "3.5")
+	evalTest("(+ 1/2 0.25)", "0.75")
+	evalTest("(* 2 1.5 1/3)", "1.0")
+	evalTest("(* 1.0 2)", "2.0")
+	evalTest("(exact? 1)", "#t")
+	evalTest("(exact? 1/2)", "#t")
+	evalTest("(exact? 1.0)", "#f")
+	evalTest("(inexact? (+ 1 1.0))", "#t")
+	evalTest("(inexact? (* 2 3))", "#f")
+	evalErrorTest("(exact? 'a)", "not a number")
 	evalTest("((if #t + *) 3 4)", "7")
 	evalTest("((if #f + *) 3 4)", "12")
+
+	prettyTest("(+ 1 2)", 79, "(+ 1 2)")
+	prettyTest("(begin (display 1) (newline))", 20, "(begin\n  (display 1)\n  (newline))")
+	prettyTest("(define (f x) (if (< x 10) (g x) (h (- x 10))))", 30,
+		`(define (f x)
+  (if (< x 10)
+      (g x)
+      (h (- x 10))))`)
+	prettyTest("(let loop ((i 0) (acc '())) (if (= i 10) acc (loop (+ i 1) (cons i acc))))", 40,
+		`(let loop ((i 0) (acc (quote ())))
+  (if (= i 10)
+      acc
+      (loop (+ i 1) (cons i acc))))`)
+	prettyTest("(lambda (x) (display x) (newline))", 20,
+		`(lambda (x)
+  (display x)
+  (newline))`)
+	prettyTest("((f a) #(aaaa bbbb cccc) (1 . 2))", 10,
+		`((f a)
+ #(aaaa
+   bbbb
+   cccc)
+ (1 . 2))`)
+	prettyTest("#0=(aaaa bbbb . #0#)", 10, "#0=(aaaa bbbb . #0#)")
+	prettyTest("#0=(#0# bbbb cccc)", 10, "#0=(#0#\n    bbbb\n    cccc)")
+	prettyTest("#0=#(#0# 2)", 10, "#0=#(#0#\n     2)")
+	prettyTest("(#0=(aaaa #0#) #1=#(bbbb #1#) #0#)", 15, "(#0=(aaaa #0#)\n #1=#(bbbb #1#)\n #0#)")
+	evalTest("(pp '(define (f x) (* x x)) 10)", "")
+	evalTest("(let ((l (list 'aaaa 'bbbb 'cccc)) (out (open-output-string))) (set-car! l l) (parameterize ((current-output-port out)) (pp l 10)) (get-output-string out))", "\"#0=(#0#\\n    bbbb\\n    cccc)\\n\"")
+	evalTest("(let ((v (vector 1 2)) (out (open-output-string))) (vector-set! v 0 v) (parameterize ((current-output-port out)) (pp v 10)) (get-output-string out))", "\"#0=#(#0#\\n     2)\\n\"")
+
+	displayTest(`"hello"`, `hello`)
+	displayTest(`#\a`, `a`)
+	displayTest(`'(1 "two" #\3 |four five| (6 . "seven") #("eight"))`, `(1 two 3 four five (6 . seven) #(eight))`)
+
+	// The datum labels make both quotes refer to the same list.
+	evalTest("(if (set-car! '#0=(1 2) 5) '#0# #f)", "(5 2)")
+	evalTest("(if (set-cdr! '#0=(1 2) 3) '#0# #f)", "(1 . 3)")
+	displayTest("(if (set-cdr! (quote #0=(1 2)) (quote #0#)) (quote #0#) #f)", "#0=(1 . #0#)")
+	evalErrorTest("(set-car! '() 1)", "not a pair")
+	evalTest("(not #f)", "#t")
+	evalTest("(not #t)", "#f")
+	evalTest("(not '())", "#f")
+	evalTest("(not 0)", "#f")
+	evalTest("(boolean=? #t #t)", "#t")
+	evalTest("(boolean=? #f #f #f)", "#t")
+	evalTest("(boolean=? #t #f)", "#f")
+	evalErrorTest("(boolean=? #t 1)", "boolean=?: not a boolean: 1")
+	evalErrorTest("(boolean=? #t)", "expected at least 2 arguments, got 1, in call to boolean=?")
+	evalTest("(pair? '(1))", "#t")
+	evalTest("(pair? '())", "#f")
+	evalTest("(null? '())", "#t")
+	evalTest("(null? '(1))", "#f")
+	evalTest("(symbol? 'a)", "#t")
+	evalTest("(symbol->string 'abc)", `"abc"`)
+	evalTest("(symbol->string (string->symbol \"hello world\"))", `"hello world"`)
+	evalTest("(string-index (symbol->string (gensym \"tmp\")) char-numeric?)", "3")
+	evalTest("(string->symbol \"abc\")", "abc")
+	evalTest("(eq? (string->symbol \"abc\") 'abc)", "#t")
+	evalTest("(string->symbol \"a b\")", "|a b|")
+	evalTest("(symbol=? 'a 'a 'a)", "#t")
+	evalTest("(symbol=? 'a 'b)", "#f")
+	evalTest("(symbol=? (gensym) (gensym))", "#f")
+	evalErrorTest("(symbol=? 'a 1)", "symbol=?: not a symbol: 1")
+	evalErrorTest("(symbol->string \"a\")", "symbol->string: not a symbol: \"a\"")
+	evalErrorTest("(string->symbol 'a)", "string->symbol: not a string: a")
+	evalTest("(symbol? (gensym))", "#t")
+	evalTest("(symbol? \"a\")", "#f")
+	evalTest("(boolean? #f)", "#t")
+	evalTest("(boolean? '())", "#f")
+	evalTest("(procedure? car)", "#t")
+	evalTest("(procedure? (lambda (x) x))", "#t")
+	evalTest("(procedure? (call/cc (lambda (k) k)))", "#t")
+	evalTest("(procedure? (make-parameter 1))", "#t")
+	evalTest("(procedure? 'car)", "#f")
+	evalTest("(string? \"a\")", "#t")
+	evalTest("(string? #\\a)", "#f")
+	evalTest("(vector? #(1))", "#t")
+	evalTest("(vector? '(1))", "#f")
+	evalTest("(map (lambda (p) (p 1)) (list number? char? list? bytevector? box? keyword? port? hash-table? promise?))", "(#t #f #f #f #f #f #f #f #f)")
+	evalErrorTest("(pair?)", "expected 1 argument, got 0, in call to pair?")
+	evalTest("(let ((l (list 1))) (eq? l l))", "#t")
+	evalTest("(eq? (list 1) (list 1))", "#f")
+	evalTest("(eq? 'a 'a)", "#t")
+	evalTest("(eq? '() '())", "#t")
+	evalTest("(eq? car car)", "#t")
+	evalTest("(eq? car cdr)", "#f")
+	evalTest("(let ((f (lambda () 1))) (eq? f f))", "#t")
+	evalTest("(eq? (lambda () 1) (lambda () 1))", "#f")
+	evalTest("(eqv? 100000000000000000000 100000000000000000000)", "#t")
+	evalTest("(eqv? 1/2 1/2)", "#t")
+	evalTest("(eqv? 1.5 1.5)", "#t")
+	evalTest("(eqv? 1 1.0)", "#f")
+	evalTest("(eqv? 0.0 -0.0)", "#f")
+	evalTest("(eqv? -0.0 -0.0)", "#t")
+	evalTest("(eqv? +nan.0 +nan.0)", "#t")
+	evalTest("(let ((x (/ 0.0 0.0))) (eqv? x x))", "#t")
+	evalTest("(equal? '(0.0) '(-0.0))", "#f")
+	evalTest("(equal? (vector +nan.0) (vector +nan.0))", "#t")
+	evalTest("(memv -0.0 '(0.0 -0.0 1.0))", "(-0.0 1.0)")
+	evalTest("(= 0.0 -0.0)", "#t")
+	evalTest("(let ((h (make-hash-table 'eqv?))) (hash-set! h 0.0 'zero) (hash-set! h +nan.0 'nan) (list (hash-ref h -0.0 'none) (hash-ref h +nan.0 'none)))", "(none nan)")
+	evalTest("(let ((h (make-hash-table))) (hash-set! h '(0.0) 'zero) (hash-set! h '(+nan.0) 'nan) (list (hash-ref h '(-0.0) 'none) (hash-ref h (list +nan.0) 'none)))", "(none nan)")
+	evalTest("(eqv? #\\a #\\a)", "#t")
+	evalTest("(eqv? (vector) (vector))", "#f")
+	evalTest("(let ((s \"a\")) (eqv? s s))", "#t")
+	evalTest("(eqv? (string-append \"a\") \"a\")", "#f")
+	evalTest("(equal? (string-append \"a\") \"a\")", "#t")
+	evalTest("(equal? (list 1 (vector 2 \"x\")) (list 1 (vector 2 \"x\")))", "#t")
+	evalTest("(equal? (list 1 2) (list 1 3))", "#f")
+	evalTest("(equal? (box 1) (box 1))", "#t")
+	evalTest("(equal? car car)", "#t")
+	evalTest("(equal? car +)", "#f")
+	evalTest("(equal? (list car) (list (lambda (x) x)))", "#f")
+	evalTest("(let ((v (vector 1))) (vector-set! v 0 v) (equal? v v))", "#t")
+	evalTest("(let ((v (vector 1)) (w (vector 1))) (vector-set! v 0 v) (vector-set! w 0 w) (equal? v w))", "#t")
+	evalTest("(let ((a (list 1 2)) (b (list 1 2 1 2))) (set-cdr! (cdr a) a) (set-cdr! (cdr (cdr (cdr b))) b) (equal? a b))", "#t")
+	evalTest("(let ((a (list 1 2)) (b (list 1 3))) (set-cdr! (cdr a) a) (set-cdr! (cdr b) b) (equal? a b))", "#f")
+	evalTest("(let ((a (box 1)) (b (box 1))) (set-box! a b) (set-box! b a) (equal? a b))", "#t")
+	evalTest("(let ((a (list 1)) (b (list 1))) (set-car! a a) (set-car! b (list b)) (equal? a b))", "#t")
+	evalTest("(let ((a (list 1)) (b (list 1))) (set-car! a a) (equal? a b))", "#f")
+	evalTest("(let loop ((n 100000) (a '()) (b '())) (if (= n 0) (equal? a b) (loop (- n 1) (cons n a) (cons n b))))", "#t")
+	evalTest("(length (member car (list cdr car)))", "1")
+	evalTest("(cons 1 2)", "(1 . 2)")
+	evalTest("(cons 1 '(2 3))", "(1 2 3)")
+	evalTest("(car '(1 2))", "1")
+	evalTest("(cdr '(1 2))", "(2)")
+	evalErrorTest("(car '())", "car: not a pair: ()")
+	evalErrorTest("(cdr 1)", "cdr: not a pair: 1")
+	evalTest("(list)", "()")
+	evalTest("(list 1 (+ 1 1) 'c)", "(1 2 c)")
+	evalTest("(length '(1 2 3))", "3")
+	evalTest("(length '())", "0")
+	evalErrorTest("(length '(1 . 2))", "length: not a list: (1 . 2)")
+	evalErrorTest("(length '#0=(1 . #0#))", "length: not a list")
+	evalTest("(append)", "()")
+	evalTest("(append '(1) '(2 3) '() '(4))", "(1 2 3 4)")
+	evalTest("(append '(1) 2)", "(1 . 2)")
+	evalTest("(append 1)", "1")
+	evalTest("(let* ((tail (list 3)) (l (append '(1 2) tail))) (set-car! tail 4) l)", "(1 2 4)")
+	evalErrorTest("(append '(1 . 2) '(3))", "append: not a list: (1 . 2)")
+	evalTest("(reverse '(1 2 3))", "(3 2 1)")
+	evalTest("(reverse '())", "()")
+	evalErrorTest("(reverse 'a)", "reverse: not a list: a")
+	evalTest("(list? '(1 2))", "#t")
+	evalTest("(list? '())", "#t")
+	evalTest("(list? '(1 . 2))", "#f")
+	evalTest("(list? '#0=(1 . #0#))", "#f")
+	evalTest("(let ((l (list 1 2))) (set-car! (cdr l) 5) l)", "(1 5)")
+	evalTest("(list-tail '(1 2 3) 1)", "(2 3)")
+	evalTest("(list-tail '(1 2 3) 3)", "()")
+	evalTest("(list-tail '(1 2 . 3) 2)", "3")
+	evalErrorTest("(list-tail '(1 2) 3)", "list-tail: index out of range: 3")
+	evalTest("(list-ref '(a b c) 0)", "a")
+	evalTest("(list-ref '(a b c) 2)", "c")
+	evalErrorTest("(list-ref '(a b c) 3)", "list-ref: index out of range: 3")
+	evalErrorTest("(list-ref '(a b c) -1)", "list-ref: index out of range: -1")
+	evalErrorTest("(list-ref '(a b c) 'x)", "list-ref: not an integer: x")
+	evalTest("(memq 'c '(a b c d))", "(c d)")
+	evalTest("(memq 'e '(a b c d))", "#f")
+	evalTest("(memq (list 1) '((1) 2))", "#f")
+	evalTest("(memv 1.5 '(1 1.5 2))", "(1.5 2)")
+	evalTest("(member (list 1) '(0 (1) 2))", "((1) 2)")
+	evalTest("(member 2.0 '(1 2 3) =)", "(2 3)")
+	evalErrorTest("(memq 'a '(b . c))", "memq: not a list: (b . c)")
+	evalErrorTest("(member 1 '(1) 2)", "member: not a procedure: 2")
+	evalTest("(assq 'b '((a 1) (b 2)))", "(b 2)")
+	evalTest("(assq 'c '((a 1) (b 2)))", "#f")
+	evalTest("(assv 2 '((1 one) (2 two)))", "(2 two)")
+	evalTest("(assoc '(x) '(((x) 1) (y 2)))", "((x) 1)")
+	evalTest("(assoc 2.0 '((1 one) (2 two)) =)", "(2 two)")
+	evalErrorTest("(assq 'a '(1))", "assq: not a pair: 1")
+	evalErrorTest("(assq 'a 'b)", "assq: not a list: b")
+	evalTest("(map (lambda (x) (* x x)) '(1 2 3))", "(1 4 9)")
+	evalTest("(map + '(1 2 3) '(10 20 30 40))", "(11 22 33)")
+	evalTest("(map car '())", "()")
+	evalErrorTest("(map car)", "expected at least 2 arguments, got 1, in call to map")
+	evalErrorTest("(map 1 '(1))", "map: not a procedure: 1")
+	evalErrorTest("(map car '(1))", "car: not a pair: 1")
+	evalTest("(let ((v (make-vector 3 0))) (for-each (lambda (i x) (vector-set! v i x)) '(0 1 2) '(a b c)) v)", "#(a b c)")
+	displayTest("(for-each car '())", "#<unspecified>")
+	evalTest("(filter odd? '(1 2 3 4 5))", "(1 3 5)")
+	evalTest("(filter odd? '())", "()")
+	evalTest("(fold-left cons '() '(1 2 3))", "(((() . 1) . 2) . 3)")
+	evalTest("(fold-left + 0 '(1 2) '(10 20))", "33")
+	evalTest("(fold-right cons '() '(1 2 3))", "(1 2 3)")
+	evalTest("(fold-right list 'end '(1 2) '(a b c))", "(1 a (2 b end))")
+	evalTest("(reduce + 0 '(1 2 3 4))", "10")
+	evalTest("(reduce list 0 '(1 2 3))", "(3 (2 1))")
+	evalTest("(reduce + 0 '())", "0")
+	evalTest("(sort '(3 1 2) <)", "(1 2 3)")
+	evalTest("(sort '() <)", "()")
+	evalTest("(sort '((b . 1) (a . 2) (c . 1) (d . 0)) (lambda (x y) (< (cdr x) (cdr y))))", "((d . 0) (b . 1) (c . 1) (a . 2))")
+	evalTest("(let* ((l (list 3 1 2)) (s (sort l <))) (list l s))", "((3 1 2) (1 2 3))")
+	evalTest("(sort #(5 3 4) >)", "#(5 4 3)")
+	evalTest("(let ((v (vector 3 1 2))) (sort v <) v)", "#(3 1 2)")
+	evalTest("(let ((l (list 3 1 2))) (sort! l <) l)", "(1 2 3)")
+	evalTest("(let ((v (vector 3 1 2))) (sort! v <) v)", "#(1 2 3)")
+	evalErrorTest("(sort 1 <)", "sort: not a list or vector: 1")
+	evalErrorTest("(sort '(1 2) 1)", "sort: not a procedure: 1")
+	evalErrorTest("(sort '(1 a) <)", "<: not a number: a")
+	evalTest("(let ((k #f) (n 0)) (let ((r (map (lambda (x) (call/cc (lambda (c) (if (= x 2) (set! k c)) x))) '(1 2 3)))) (set! n (+ n 1)) (if (= n 1) (k 20) r)))", "(1 20 3)")
+
+	evalTest("(vector 1 'a \"b\")", "#(1 a \"b\")")
+	evalTest("(vector)", "#()")
+	evalTest("(make-vector 3 'x)", "#(x x x)")
+	evalTest("(vector-length (make-vector 5))", "5")
+	evalTest("(vector-ref #(a b c) 1)", "b")
+	evalTest("(if (vector-set! '#0=#(1 2 3) 1 'x) '#0# #f)", "#(1 x 3)")
+	evalTest("(vector->list #(1 2 3))", "(1 2 3)")
+	evalTest("(vector->list #(1 2 3) 1)", "(2 3)")
+	evalTest("(vector->list #(1 2 3) 1 2)", "(2)")
+	evalTest("(list->vector '(1 (2) 3))", "#(1 (2) 3)")
+	evalTest("(if (vector-fill! '#0=#(1 2 3) 0) '#0# #f)", "#(0 0 0)")
+	evalTest("(if (vector-fill! '#0=#(1 2 3 4) 0 1 3) '#0# #f)", "#(1 0 0 4)")
+	evalErrorTest("(vector-ref #(1 2) 2)", "index out of range")
+	evalErrorTest("(vector-ref '(1 2) 0)", "not a vector")
+	evalErrorTest("(make-vector -1)", "negative length")
+	evalErrorTest("(list->vector '(1 . 2))", "not a list")
+	evalTest("(vector-map + #(1 2 3) #(10 20))", "#(11 22)")
+	evalTest("(vector-map (lambda (x) (* x x)) #())", "#()")
+	evalTest("(let ((v (make-vector 2))) (vector-for-each (lambda (i x) (vector-set! v i x)) #(1 0) #(a b)) v)", "#(b a)")
+	evalErrorTest("(vector-map car '(1))", "vector-map: not a vector: (1)")
+	evalTest("(let* ((v (vector 1 2 3)) (c (vector-copy v))) (vector-set! c 0 'x) (list v c))", "(#(1 2 3) #(x 2 3))")
+	evalTest("(vector-copy #(1 2 3 4) 1)", "#(2 3 4)")
+	evalTest("(vector-copy #(1 2 3 4) 1 3)", "#(2 3)")
+	evalTest("(subvector #(1 2 3 4) 0 2)", "#(1 2)")
+	evalErrorTest("(subvector #(1 2 3 4) 0)", "expected 3 arguments, got 2, in call to subvector")
+	evalErrorTest("(subvector #(1 2) 1 3)", "subvector: index out of range: 3")
+	evalTest("(let ((v (vector 1 2 3 4 5))) (vector-copy! v 0 #(a b)) v)", "#(a b 3 4 5)")
+	evalTest("(let ((v (vector 1 2 3 4 5))) (vector-copy! v 1 v 0 3) v)", "#(1 1 2 3 5)")
+	evalTest("(let ((v (vector 1 2 3 4 5))) (vector-copy! v 0 v 2) v)", "#(3 4 5 4 5)")
+	evalErrorTest("(vector-copy! (vector 1 2) 1 #(a b))", "vector-copy!: not enough room for 2 items at 1")
+	evalTest("(vector-append #(1) #() #(2 3))", "#(1 2 3)")
+	evalTest("(vector-append)", "#()")
+	evalTest("(let ((v (vector 3 1 2))) (vector-sort! v <) v)", "#(1 2 3)")
+	evalErrorTest("(vector-sort! '(1) <)", "vector-sort!: not a vector: (1)")
+
+	evalTest("(bytevector 1 2 255)", "#u8(1 2 255)")
+	evalTest("(make-bytevector 3 7)", "#u8(7 7 7)")
+	evalTest("(bytevector? #u8())", "#t")
+	evalTest("(bytevector? #(1))", "#f")
+	evalTest("(bytevector-length #u8(1 2 3))", "3")
+	evalTest("(bytevector-u8-ref #u8(1 2 3) 2)", "3")
+	evalTest("(if (bytevector-u8-set! '#0=#u8(1 2 3) 0 9) '#0# #f)", "#u8(9 2 3)")
+	evalTest("(bytevector-copy #u8(1 2 3 4) 1 3)", "#u8(2 3)")
+	evalTest("(bytevector-append #u8(1) #u8() #u8(2 3))", "#u8(1 2 3)")
+	evalTest("(string->utf8 \"aλ\")", "#u8(97 206 187)")
+	evalTest("(string->utf8 \"aλb\" 1)", "#u8(206 187 98)")
+	evalTest("(utf8->string #u8(97 206 187))", "\"aλ\"")
+	evalErrorTest("(utf8->string #u8(206))", "invalid UTF-8")
+	evalErrorTest("(bytevector 256)", "not a byte: 256")
+	evalErrorTest("(bytevector-u8-ref #u8(1) 1)", "index out of range")
+	evalErrorTest("(make-bytevector 2 -1)", "not a byte")
+
+	recordEnv := testEnv()
+	evalTestIn(recordEnv, "(define-record-type <point> (make-point x y) point? (x point-x set-point-x!) (y point-y))", "")
+	displayTestIn(recordEnv, "(make-point 1 2)", "#<point x: 1 y: 2>")
+	displayTestIn(recordEnv, "<point>", "#<record-type point>")
+	evalTestIn(recordEnv, "(point? (make-point 1 2))", "#t")
+	evalTestIn(recordEnv, "(point? '(1 2))", "#f")
+	evalTestIn(recordEnv, "(point-y (make-point 1 2))", "2")
+	recordEnv[symbol{name: "p"}] = recordEnv[symbol{name: "make-point"}].(function).call([]val{number{1}, number{2}})
+	evalTestIn(recordEnv, "(set-point-x! p 3)", "")
+	evalTestIn(recordEnv, "(point-x p)", "3")
+	evalErrorTestIn(recordEnv, "(point-x 1)", "point-x: not a point: 1")
+	evalErrorTestIn(recordEnv, "(make-point 1)", "expected 2 arguments, got 1, in call to make-point")
+	evalTestIn(recordEnv, "(define-record-type cell (make-cell) cell? (value cell-value set-cell-value!))", "")
+	displayTestIn(recordEnv, "(cell-value (make-cell))", "#<unspecified>")
+	evalTestIn(recordEnv, "(point? (make-cell))", "#f")
+	evalErrorTestIn(recordEnv, "(point-x (make-cell))", "not a point")
+	evalTestIn(recordEnv, "(define-record-type pair* kons kons? (a kar) (d kdr))", "")
+	evalTestIn(recordEnv, "(kdr (kons 1 2))", "2")
+	evalTestIn(recordEnv, "(define-record-type a (make-a x) a? (x px))", "")
+	evalTestIn(recordEnv, "(define a-px px)", "")
+	evalTestIn(recordEnv, "(define-record-type b (make-b x) b? (x px))", "")
+	evalTestIn(recordEnv, "(list (eq? a-px px) (equal? a-px px) (eq? px px) (eqv? a-px a-px))", "(#f #f #t #t)")
+	evalTestIn(recordEnv, "(let ((h (make-hash-table))) (hash-set! h a-px 1) (hash-set! h px 2) (list (hash-ref h a-px) (hash-ref h px)))", "(1 2)")
+	evalTestIn(recordEnv, "(let ((h (make-hash-table))) (hash-set! h (list a-px) 1) (hash-ref h (list px) 'none))", "none")
+	evalTestIn(recordEnv, "(let ((h (make-hash-table)) (p (make-point 1 2))) (hash-set! h (vector p) 1) (list (hash-ref h (vector p)) (hash-ref h (vector (make-point 1 2)) 'none)))", "(1 none)")
+	evalTest("(eq? eval (eval 'eval (environment '(scheme base))))", "#f")
+	evalTest("(eq? eval (eval 'eval (interaction-environment)))", "#t")
+	plusEnv := testEnv()
+	evalTestIn(plusEnv, "(define-record-type t (+ x) t? (x t-x))", "")
+	evalTestIn(plusEnv, "(define (f) (+ 2))", "")
+	evalTestIn(plusEnv, "(list (t-x (f)) (eq? (f) (f)))", "(2 #f)")
+	displayTestIn(recordEnv, "(let ((c (make-cell))) (set-cell-value! c (list 1 c)) c)", "#0=#<cell value: (1 #0#)>")
+	displayTestIn(recordEnv, "(let ((c (make-cell))) (set-cell-value! c c) (vector c c))", "#(#0=#<cell value: #0#> #0#)")
+	evalTestIn(recordEnv, "(let ((c (make-cell)) (out (open-output-string))) (set-cell-value! c c) (write c out) (display (kons \"a\" c) out) (get-output-string out))", "\"#0=#<cell value: #0#>#<pair* a: a d: #0=#<cell value: #0#>>\"")
+	evalErrorTest("(define-record-type <p> (make-p x) p? (y p-y))", "unknown field x")
+	evalErrorTest("(define-record-type <p> (make-p) p? (x p-x) (x p-y))", "duplicate field x")
+	evalErrorTest("(define-record-type p (mk))", "define-record-type: invalid syntax: (p (mk))")
+	evalErrorTest("(define-record-type p)", "define-record-type: invalid syntax")
+
+	displayTest("(current-input-port)", "#<input-port stdin>")
+	displayTest("(current-output-port)", "#<output-port stdout>")
+	evalTest("(input-port? (current-input-port))", "#t")
+	evalTest("(output-port? (current-input-port))", "#f")
+	evalTest("(port? (current-error-port))", "#t")
+	evalTest("(port? \"abc\")", "#f")
+	evalTest("(input-port? (open-input-string \"abc\"))", "#t")
+	evalTest("(get-output-string (open-output-string))", "\"\"")
+	evalErrorTest("(get-output-string (current-output-port))", "not a string port")
+	evalErrorTest("(input-port-open? (current-output-port))", "not an input port")
+	displayTest("(eof-object)", "#<eof>")
+	evalTest("(eof-object? (eof-object))", "#t")
+	evalTest("(eof-object? '())", "#f")
+	portEnv := testEnv()
+	portEnv[symbol{name: "p"}] = newStringInputPort("abc")
+	evalTestIn(portEnv, "(input-port-open? p)", "#t")
+	evalTestIn(portEnv, "(close-port p)", "")
+	evalTestIn(portEnv, "(input-port-open? p)", "#f")
+	evalTestIn(portEnv, "(close-input-port p)", "")
+	evalErrorTestIn(portEnv, "(close-output-port p)", "not an output port")
+	evalErrorTestIn(portEnv, "(read-char p)", "port is closed")
+	evalTest("(let ((p (open-input-string \"ab\"))) (list (peek-char p) (read-char p) (read-char p) (eof-object? (read-char p))))", "(#\\a #\\a #\\b #t)")
+	evalTest("(eof-object? (peek-char (open-input-string \"\")))", "#t")
+	portEnv[symbol{name: "q"}] = newStringInputPort("one\r\ntwo\n\nthree")
+	evalTestIn(portEnv, "(list (read-line q) (read-line q) (read-line q) (read-line q) (eof-object? (read-line q)))", "(\"one\" \"two\" \"\" \"three\" #t)")
+	evalTest("(char-ready? (open-input-string \"\"))", "#t")
+	evalErrorTest("(read-char 'p)", "not an input port")
+	portEnv[symbol{name: "r"}] = newStringInputPort("(a . b) 42 ; comment\n#(\"s\" #\\x)\n'c #0=(1 . #0#) d")
+	evalTestIn(portEnv, "(list (read r) (read r) (read-char r) (read-line r) (read r))", "((a . b) 42 #\\space \"; comment\" #(\"s\" #\\x))")
+	evalTestIn(portEnv, "(read r)", "(quote c)")
+	evalTestIn(portEnv, "(let ((x (read r))) (eq? x (cdr x)))", "#t")
+	evalTestIn(portEnv, "(list (read r) (eof-object? (read r)) (eof-object? (read-char r)))", "(d #t #t)")
+	evalTest("(let ((p (open-input-string \"(+ 1 2)\"))) (eval (read p) (interaction-environment)))", "3")
+	// The first line ends around the boundaries of the 4096-byte
+	// buffer fills, so the reader's lookahead spans several of them.
+	for _, n := range []int{4088, 4089, 4090, 4091, 8184, 8185, 8186, 8187} {
+		var lines strings.Builder
+		lines.WriteString("1 (" + strings.Repeat("b", n) + ") 2\n")
+		for i := 0; i < 2000; i++ {
+			fmt.Fprintf(&lines, "%d\n", i)
+		}
+		portEnv[symbol{name: "long"}] = newStringInputPort(lines.String())
+		evalTestIn(portEnv, "(list (read long) (length (read long)) (read long) (read long))", "(1 1 2 0)")
+		evalTestIn(portEnv, "(let loop ((n 1)) (let ((x (read long))) (cond ((eof-object? x) 'missing) ((= x n) (if (= n 1999) n (loop (+ n 1)))) (else x))))", "1999")
+	}
+	evalErrorTest("(read (open-input-string \"(a\"))", "read: 1:3:")
+	evalErrorTest("(read (open-input-string \")\"))", "read: 1:1:")
+	evalTest("(let ((p (open-input-string \") 1\n(2 . ) 3\n4\n(5\n . )\n6\n#(\"))) (let loop ((acc '())) (let ((v (guard (e (#t 'error)) (read p)))) (if (eof-object? v) (reverse acc) (loop (cons v acc))))))", "(error error 4 error 6 error)")
+	evalTest("(let ((out (open-output-string))) (write \"a\\\"b\" out) (display \" \" out) (display '(\"c\" #\\d) out) (newline out) (write '(\"c\" #\\d) out) (get-output-string out))", "\"\\\"a\\\\\\\"b\\\" (c d)\\n(\\\"c\\\" #\\\\d)\"")
+	evalTest("(let ((out (open-output-string))) (write-string \"hello\" out) (write-string \"hello\" out 1 3) (get-output-string out))", "\"helloel\"")
+	evalTest("(let ((out (open-output-string))) (parameterize ((current-output-port out)) (display 1) (newline) (write-string \"x\") (write 'y)) (get-output-string out))", "\"1\\nxy\"")
+	evalErrorTest("(display 1 (current-input-port))", "not an output port")
+	evalErrorTest("(write-string 'a)", "not a string")
+	evalErrorTest("(write-string \"abc\" (current-output-port) 2 1)", "start is after end")
+	evalErrorTest("(let ((out (open-output-string))) (close-port out) (newline out))", "newline: port is closed")
+
+	evalTest("#:foo", "#:foo")
+	evalTest("(keyword? #:foo)", "#t")
+	evalTest("(keyword? 'foo)", "#f")
+	evalTest("(keyword->string #:foo)", "\"foo\"")
+	evalTest("(string->keyword \"a b\")", "#:|a b|")
+	displayTest("#:|a b|", "#:a b")
+	evalErrorTest("(keyword->string \"foo\")", "not a keyword")
+
+	evalTest("(eval '(+ one 2))", "3")
+	evalTest("(eval '(+ one 2) (interaction-environment))", "3")
+	evalTest("(eval ''(1 2) (environment '(scheme base)))", "(1 2)")
+	evalTest("(environment? (interaction-environment))", "#t")
+	evalTest("(environment? '())", "#f")
+	displayTest("(environment)", "#<environment>")
+	evalErrorTest("(eval 'one (environment '(scheme base)))", "unbound one")
+	evalErrorTest("(eval 1 2)", "not an environment: 2")
+	evalErrorTest("(environment 'foo)", "invalid import set: foo")
+
+	loadDir, err := os.MkdirTemp("", "scheme")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(loadDir)
+	loadFiles := map[string]string{
+		"lib.scm":    "; a library\n(define (square x) (* x x))\n(define-syntax swap!\n  (syntax-rules () ((_ a b) (let ((t a)) (set! a b) (set! b t)))))\n(define (broken) (car '()))\n",
+		"bad.scm":    "(define x 1)\n\n  (vector-ref (vector) x)\n",
+		"syntax.scm": "(define x 1)\n(a\n  . )\n",
+		"empty.scm":  "; nothing\n",
+	}
+	for name, contents := range loadFiles {
+		if err := os.WriteFile(filepath.Join(loadDir, name), []byte(contents), 0o644); err != nil {
+			panic(err)
+		}
+	}
+	load := func(name string) string {
+		return fmt.Sprintf("(load %q)", filepath.Join(loadDir, name))
+	}
+	loadEnv := testEnv()
+	evalTestIn(loadEnv, load("lib.scm"), "")
+	evalTestIn(loadEnv, "(square 3)", "9")
+	evalTestIn(loadEnv, "(let ((a 1) (b 2)) (swap! a b) (list a b))", "(2 1)")
+	evalErrorTestIn(loadEnv, "(broken)", filepath.Join(loadDir, "lib.scm")+":5:18: car: ")
+	evalErrorTestIn(loadEnv, load("bad.scm"), filepath.Join(loadDir, "bad.scm")+":3:3: vector-ref: index out of range")
+	evalTestIn(loadEnv, "x", "1")
+	evalErrorTestIn(loadEnv, load("syntax.scm"), "load: "+filepath.Join(loadDir, "syntax.scm")+":3:")
+	evalTestIn(loadEnv, load("empty.scm"), "")
+	evalErrorTestIn(loadEnv, load("missing.scm"), "load: open ")
+	evalTestIn(loadEnv, fmt.Sprintf("(let ((e (environment '(scheme base)))) (load %q e) (eval '(square 4) e))", filepath.Join(loadDir, "lib.scm")), "16")
+	evalErrorTest("(load 'lib)", "load: not a string")
+	evalEnv := testEnv()
+	evalTestIn(evalEnv, "(eval '(define (square x) (* x x)) (interaction-environment))", "")
+	evalTestIn(evalEnv, "(square 4)", "16")
+	evalTestIn(evalEnv, "(define sandbox (environment '(scheme base)))", "")
+	evalTestIn(evalEnv, "(eval '(define square 'shadowed) sandbox)", "")
+	evalTestIn(evalEnv, "(vector (eval 'square sandbox) (square 3))", "#(shadowed 9)")
+	evalTestIn(evalEnv, "(eval `(,square 5) sandbox)", "25")
+	evalErrorTestIn(evalEnv, "(let ((x 1)) (eval 'x))", "unbound x")
+
+	displayTest("(make-parameter 1)", "#<parameter>")
+	displayTest("current-output-port", "#<parameter:current-output-port>")
+	evalTest("((make-parameter 1))", "1")
+	evalTest("((make-parameter 1 vector))", "#(1)")
+	evalTest("(parameterize () 1 2)", "2")
+	paramEnv := testEnv()
+	paramEnv[symbol{name: "p"}] = &parameter{value: number{1}, converter: builtin{name: "vector", f: builtinVector, min: 0, max: -1}}
+	paramEnv[symbol{name: "out"}] = newStringOutputPort()
+	evalTestIn(paramEnv, "(parameterize ((p 2)) (p))", "#(2)")
+	evalTestIn(paramEnv, "(p)", "1")
+	evalTestIn(paramEnv, "(parameterize ((p 2)) (parameterize ((p 3)) (p)))", "#(3)")
+	evalErrorTestIn(paramEnv, "(parameterize ((p 2)) (unbound-variable))", "unbound")
+	evalTestIn(paramEnv, "(p)", "1")
+	evalTestIn(paramEnv, "(let ((k #f) (seen '())) (parameterize ((p 2)) (call/cc (lambda (c) (set! k c))) (set! seen `(,(p) ,@seen))) (set! seen `(,(p) ,@seen)) (case (vector-length (list->vector seen)) ((4) seen) (else (k #f))))", "(1 #(2) 1 #(2))")
+	evalTestIn(paramEnv, "(parameterize ((current-output-port out)) (pp '(a b)) (pp 'c))", "")
+	evalTestIn(paramEnv, "(get-output-string out)", "\"(a b)\\nc\\n\"")
+	evalErrorTestIn(paramEnv, "(parameterize ((current-output-port 1)) 2)", "not an output port: 1")
+	evalErrorTestIn(paramEnv, "(parameterize ((1 2)) 3)", "not a parameter: 1")
+	evalErrorTestIn(paramEnv, "(parameterize ((p)) 3)", "invalid binding (p)")
+	evalErrorTestIn(paramEnv, "(p 1)", "expected 0 arguments, got 1")
+
+	evalTest("(box 1)", "#&1")
+	evalTest("(unbox #&(1 2))", "(1 2)")
+	evalTest("(box? (box 1))", "#t")
+	evalTest("(box? '(1))", "#f")
+	evalTest("(if (set-box! '#0=#&1 2) '#0# #f)", "#&2")
+	displayTest("(box \"a\")", "#&a")
+	displayTest("'#0=#&#0#", "#0=#&#0#")
+	evalErrorTest("(unbox 1)", "not a box")
+
+	displayTest("(make-error-object \"bad thing\" 1 'a)", "#<error \"bad thing\" 1 a>")
+	evalTest("(error-object? (make-error-object \"bad\"))", "#t")
+	evalTest("(error-object? \"bad\")", "#f")
+	evalTest("(error-object-message (make-error-object \"bad\" 1))", "\"bad\"")
+	evalTest("(error-object-irritants (make-error-object \"bad\" 1 '(2)))", "(1 (2))")
+	evalTest("(error-object-irritants (make-error-object \"bad\"))", "()")
+	evalErrorTest("(error-object-message 1)", "not an error object")
+	errorEnv := testEnv()
+	errorEnv[symbol{name: "fail"}] = builtin{name: "fail", max: -1, f: func(args []val) val {
+		panic(&errorObject{message: "failed with", irritants: args})
+	}}
+	evalErrorTestIn(errorEnv, "(fail \"x\" 'y)", "failed with \"x\" y")
+	evalTestIn(errorEnv, "(guard (e (#t (vector 'caught e))) (raise 'oops))", "#(caught oops)")
+	evalTestIn(errorEnv, "(guard (e ((error-object? e) 'error) ((case e ((oops) #t) (else #f)) 'oops)) (+ 1 (raise 'oops)))", "oops")
+	evalTestIn(errorEnv, "(guard (e ((error-object? e) (error-object-irritants e))) (fail \"x\" 'y))", "(\"x\" y)")
+	evalTestIn(errorEnv, "(guard (e ((error-object? e) (error-object-message e))) (vector-ref (vector) 0))", "\"vector-ref: index out of range: 0\"")
+	evalTestIn(errorEnv, "(guard (e ((error-object? e) (error-object-message e))) (unbound-variable))", "\"unbound unbound-variable\"")
+	evalTestIn(errorEnv, "(guard (e (e => vector)) (raise 1))", "#(1)")
+	evalTestIn(errorEnv, "(guard (e (else 'other)) 'no-exception)", "no-exception")
+	evalTestIn(errorEnv, "(guard (outer (#t (vector 'outer outer))) (guard (inner ((error-object? inner) 'inner)) (raise 'sym)))", "#(outer sym)")
+	evalTestIn(errorEnv, "(guard (e (#t (vector 'second e))) (guard (e (#t (raise 'again))) (raise 'first)))", "#(second again)")
+	evalTestIn(errorEnv, "(with-exception-handler (lambda (e) 42) (lambda () (+ (raise-continuable 'oops) 1)))", "43")
+	evalTestIn(errorEnv, "(call/cc (lambda (k) (with-exception-handler (lambda (e) (k (vector 'handled e))) (lambda () (raise 'oops)))))", "#(handled oops)")
+	evalTestIn(errorEnv, "(with-exception-handler (lambda (e) 'outer) (lambda () (with-exception-handler (lambda (e) (raise-continuable 'inner)) (lambda () (raise-continuable 'oops)))))", "outer")
+	evalTestIn(errorEnv, "(guard (e (#t e)) (with-exception-handler (lambda (e) (raise-continuable 'continued)) (lambda () (raise-continuable 'oops))))", "continued")
+	evalTestIn(errorEnv, "(guard (e ((error-object? e) (vector (error-object-message e) (error-object-irritants e)))) (with-exception-handler (lambda (e) 'ignored) (lambda () (raise 'oops))))", "#(\"exception handler returned\" (oops))")
+	evalTestIn(errorEnv, "(let ((h (make-hash-table))) (hash-set! h 1 2) (guard (e (#t (vector 'caught e))) (hash-for-each h (lambda (k v) (raise k)))))", "#(caught 1)")
+	evalTestIn(errorEnv, "(define trace '())", "")
+	evalTestIn(errorEnv, "(guard (e (#t trace)) (dynamic-wind (lambda () #f) (lambda () (raise 'oops)) (lambda () (set! trace '(unwound)))))", "(unwound)")
+	evalTestIn(errorEnv, "(set! trace '())", "")
+	evalTestIn(errorEnv, "(call/cc (lambda (k) (with-exception-handler (lambda (e) (set! trace (cons 'handler trace)) (k trace)) (lambda () (dynamic-wind (lambda () #f) (lambda () (raise 'oops)) (lambda () (set! trace (cons 'after trace))))))))", "(handler)")
+	evalTestIn(errorEnv, "trace", "(after handler)")
+	evalTestIn(errorEnv, "(define p (make-parameter 1))", "")
+	evalTestIn(errorEnv, "(call/cc (lambda (k) (with-exception-handler (lambda (e) (k (p))) (lambda () (parameterize ((p 2)) (raise 'oops))))))", "2")
+	evalTestIn(errorEnv, "(call/cc (lambda (k) (with-exception-handler (lambda (e) (k (p))) (lambda () (parameterize ((p 3)) (vector-ref (vector) 0))))))", "3")
+	evalTestIn(errorEnv, "(call/cc (lambda (k) (with-exception-handler (lambda (e) (k e)) (lambda () (sort (list 1 2) (lambda (a b) (raise 'in-sort)))))))", "in-sort")
+	evalErrorTestIn(errorEnv, "(raise 'oops)", "1:1: uncaught exception: oops")
+	evalErrorTestIn(errorEnv, "(guard (e ((error-object? e) 'error)) (raise 'oops))", "uncaught exception: oops")
+	evalErrorTestIn(errorEnv, "(raise-continuable 'oops)", "uncaught exception: oops")
+	evalErrorTestIn(errorEnv, "(guard (e (#t e)) (vector-ref (vector) 0) . 1)", "guard: invalid syntax")
+	evalErrorTestIn(errorEnv, "(guard (1 (#t 1)) 2)", "guard: invalid variable 1")
+	evalErrorTest("(error \"bad thing:\" 1 'a)", "1:1: bad thing: 1 a")
+	evalErrorTest("(error 'oops)", "error: not a string")
+	evalTest("(guard (e ((error-object? e) (vector (error-object-message e) (error-object-irritants e)))) (error \"bad\" 1 2))", "#(\"bad\" (1 2))")
+	evalTest("(call/cc (lambda (k) (with-exception-handler (lambda (e) (k (error-object-message e))) (lambda () (error \"caught\")))))", "\"caught\"")
+	evalTest("(assert (= 1 1))", "")
+	evalErrorTest("(assert (= 1 2))", "1:1: assertion failed (= 1 2)")
+	evalTest("(guard (e ((error-object? e) (error-object-irritants e))) (let ((x 3)) (assert (even? x))))", "((even? x))")
+	evalErrorTest("(assert)", "assert: invalid syntax")
+	evalErrorTest("(assert 1 2)", "assert: invalid syntax")
+
+	evalTest("((lambda (x y) (+ x y)) 1 2)", "3")
+	evalTest("((lambda () 1 2))", "2")
+	evalTest("(((lambda (x) (lambda (y) (+ x y))) 1) 2)", "3")
+	evalTest("((lambda (x) ((lambda (x) x) 2)) 1)", "2")
+	evalTest("((lambda (+) (+ 2 3)) *)", "6")
+	evalTest("((lambda (x) one) 1)", "1")
+	evalTest("((lambda (x) ((lambda (x) (set! x 2)) 3) x) 1)", "1")
+	evalTest("((lambda (x) ((lambda (y) (set! x y)) 2) x) 1)", "2")
+	evalTest("((lambda (x) ((lambda () (define x 2) x)) x) 1)", "1")
+	evalTest("(procedure-arity (lambda (x y) x))", "2")
+	evalTest("((lambda args args) 1 2 3)", "(1 2 3)")
+	evalTest("((lambda args args))", "()")
+	evalTest("((lambda (a b . rest) (vector a b rest)) 1 2 3 4)", "#(1 2 (3 4))")
+	evalTest("((lambda (a . rest) (vector a rest)) 1)", "#(1 ())")
+	evalTest("(procedure-arity (lambda (a b . rest) a))", "(2 . #f)")
+	displayTest("(lambda args args)", "#<procedure (0+)>")
+	evalErrorTest("((lambda (a b . rest) a) 1)", "expected at least 2 arguments, got 1")
+	evalErrorTest("(lambda (a . 1) a)", "invalid parameter 1")
+	evalErrorTest("(lambda (a . a) a)", "duplicate parameter a")
+	evalErrorTest("(lambda #0=(a . #0#) a)", "duplicate parameter a")
+	evalTest("((lambda (a #!optional b (c (vector a b))) (vector a b c)) 1)", "#(1 #f #(1 #f))")
+	evalTest("((lambda (a #!optional b (c (vector a b))) (vector a b c)) 1 2 3)", "#(1 2 3)")
+	evalTest("((lambda (#!optional a #!rest r) (vector a r)) 1 2 3)", "#(1 (2 3))")
+	evalTest("((lambda (#!key a (b 2)) (vector a b)))", "#(#f 2)")
+	evalTest("((lambda (#!key a (b 2)) (vector a b)) #:b 3 #:a 4 #:b 5)", "#(4 3)")
+	evalTest("((lambda (x #!optional y #!key z) (vector x y z)) 1 #:z 3)", "#(1 #f 3)")
+	evalTest("((lambda (#!key a . r) (vector a r)) #:b 1 #:a 2)", "#(2 (#:b 1 #:a 2))")
+	evalTest("(procedure-arity (lambda (a #!optional b c) a))", "(1 . 3)")
+	evalTest("(procedure-arity (lambda (a #!key b) a))", "(1 . #f)")
+	evalTest("'(a #!optional b #!key c #!rest d)", "(a #!optional b #!key c #!rest d)")
+	evalErrorTest("((lambda (a #!optional b) a) 1 2 3)", "expected 1 or 2 arguments, got 3")
+	evalErrorTest("((lambda (#!key a) a) #:b 1)", "unknown keyword #:b")
+	evalErrorTest("((lambda (#!key a) a) #:a)", "missing value for keyword #:a")
+	evalErrorTest("((lambda (#!key a) a) 1 2)", "not a keyword: 1")
+	evalErrorTest("(lambda (#!key a #!optional b) a)", "misplaced #!optional")
+	evalErrorTest("(lambda (#!rest a b) a)", "#!rest must be followed by exactly one parameter")
+	evalErrorTest("(lambda (#!optional (a)) a)", "invalid parameter (a)")
+	evalTest("(procedure-name (lambda (x y) x))", "#f")
+	displayTest("(lambda (x) x)", "#<procedure (1)>")
+	evalErrorTest("((lambda (x) x))", "expected 1 argument, got 0, in call to #<procedure>")
+	evalErrorTest("(vector-ref (vector 1) 0 1)", "expected 2 arguments, got 3, in call to vector-ref")
+	evalErrorTest("(pp)", "expected 1 or 2 arguments, got 0, in call to pp")
+	evalErrorTest("(vector->list)", "expected 1 to 3 arguments, got 0, in call to vector->list")
+	evalErrorTest("(/)", "expected at least 1 argument, got 0, in call to /")
+	evalErrorTest("((lambda (x) y) 1)", "unbound y")
+	evalErrorTest("(begin ((lambda () (define local 1) local)) local)", "unbound local")
+	evalTest("(if #t 1)", "1")
+	displayTest("(if #f 1)", "#<unspecified>")
+	evalErrorTest("(if)", "if: expected 2 or 3 subforms, got 0")
+	evalErrorTest("(if 1 2 3 4)", "if: expected 2 or 3 subforms, got 4")
+	evalErrorTest("(vector 1\n  (if #t))", "2:3: if: expected 2 or 3 subforms, got 1")
+	evalErrorTest("(if #t 1 . 2)", "if: improper list of subforms (#t 1 . 2)")
+	evalErrorTest("(quote)", "quote: expected 1 subform, got 0")
+	evalErrorTest("(quote 1 2)", "quote: expected 1 subform, got 2")
+	evalErrorTest("(delay 1 2)", "delay: expected 1 subform, got 2")
+	evalErrorTest("(delay-force)", "delay-force: expected 1 subform, got 0")
+	evalErrorTest("(begin 1 . 2)", "begin: improper list of subforms (1 . 2)")
+	evalErrorTest("(vector 1 . 2)", "improper list of arguments (1 . 2)")
+	depthEnv := testEnv()
+	evalTestIn(depthEnv, "(define (count-down n) (case n ((0) 0) (else (+ 1 (count-down (+ n -1))))))", "")
+	evalTestIn(depthEnv, "(count-down 10000)", "10000")
+	evalErrorTestIn(depthEnv, "(parameterize ((max-eval-depth 100)) (count-down 1000))", "evaluation nested more than 100 levels deep")
+	evalTestIn(depthEnv, "(guard (e (#t 'too-deep)) (parameterize ((max-eval-depth 100)) (count-down 1000)))", "too-deep")
+	evalTestIn(depthEnv, "(call/cc (lambda (k) (with-exception-handler (lambda (e) (k 'too-deep)) (lambda () (parameterize ((max-eval-depth 100)) (count-down 1000))))))", "too-deep")
+	evalTestIn(depthEnv, "(parameterize ((max-eval-depth 100)) (count-down 10))", "10")
+	evalTestIn(depthEnv, "(max-eval-depth)", "1000000")
+	evalTestIn(depthEnv, "(define (naive-length l) (if (null? l) 0 (+ 1 (naive-length (cdr l)))))", "")
+	evalTestIn(depthEnv, "(define big (vector->list (make-vector 200000 'x)))", "")
+	evalTestIn(depthEnv, "(naive-length big)", "200000")
+	evalErrorTestIn(depthEnv, "(parameterize ((max-eval-depth 100000)) (naive-length big))", "evaluation nested more than 100000 levels deep")
+	evalErrorTest("(parameterize ((max-eval-depth 0)) 1)", "max-eval-depth: not a positive integer: 0")
+	evalErrorTest("(parameterize ((max-eval-depth 'deep)) 1)", "max-eval-depth: not an integer: deep")
+	evalTest("((lambda (x) (if x 1 (if))) #t)", "1")
+	evalErrorTest("((lambda ()\n  (vector 1 (if #t))))", "2:13: if: expected 2 or 3 subforms, got 1")
+	evalErrorTest("((lambda () (vector 1 (2 3))))", "cannot apply non-function 2")
+	evalTest("((lambda () (define-syntax two (syntax-rules () ((_) 2))) (vector (two) (two))))", "#(2 2)")
+	evalTest("(let ((r (vector 1 (call/cc (lambda (k) k)) 3))) (case (vector-ref r 1) ((2) r) (else ((vector-ref r 1) 2))))", "#(1 2 3)")
+	compileEnv := testEnv()
+	evalTestIn(compileEnv, "(define (use-later) (later 1))", "")
+	evalTestIn(compileEnv, "(define (later x) (vector x))", "")
+	evalTestIn(compileEnv, "(use-later)", "#(1)")
+	evalTestIn(compileEnv, "(define-syntax later (syntax-rules () ((_ x) 'x)))", "")
+	evalTestIn(compileEnv, "(use-later)", "1")
+	evalTest("((lambda () (+ 1 (* 2 3) (/ 1 2))))", "15/2")
+	evalTest("((lambda () (if (char? #\\a) 'yes (if))))", "yes")
+	evalTest("((lambda () (if (char? 1) (if) 'no)))", "no")
+	evalTest("((lambda () (if (char? 1) 'yes)))", "")
+	evalTest("((lambda () (if '#f 1 2)))", "2")
+	evalTest("((lambda (quote) (if '#f 1 2)) vector)", "1")
+	evalErrorTest("((lambda ()\n  (if #t (/ 1 0) 2)))", "2:10: division of 1 by zero")
+	foldEnv := testEnv()
+	evalTestIn(foldEnv, "(define (three) (+ 1 2))", "")
+	evalTestIn(foldEnv, "(define (add-two x) (+ x 2))", "")
+	evalTestIn(foldEnv, "(vector (three) (add-two 1))", "#(3 3)")
+	evalTestIn(foldEnv, "(define (positive) (if (> 1 0) 'yes 'no))", "")
+	evalTestIn(foldEnv, "(positive)", "yes")
+	evalTestIn(foldEnv, "(define + *)", "")
+	evalTestIn(foldEnv, "(define > <)", "")
+	evalTestIn(foldEnv, "(vector (three) (add-two 1) (positive))", "#(2 2 no)")
+	evalTestIn(foldEnv, "(define (four) (- 8 4))", "")
+	evalTestIn(foldEnv, "(define a (four))", "")
+	evalTestIn(foldEnv, "(define - +)", "")
+	evalTestIn(foldEnv, "(list a (four))", "(4 32)")
+	// Folding this would take minutes, even though the call is never
+	// reached.
+	evalTest("(begin (define (g x) (if x (expt 7 300000000) 0)) (g #f))", "0")
+	evalTest("(begin (define (g x) (if x (* 2 (expt 7 10000)) 0)) (g #f))", "0")
+	evalTest("((lambda () (expt 2 100)))", "1267650600228229401496703205376")
+	evalTest("(begin (define (three) (+ 1 2)) (define a (three)) (define + *) (list a (three)))", "(3 2)")
+	evalTest("((lambda () (define-record-type t (+ x) t? (x t-x)) (t? (+ 2))))", "#t")
+	evalTest("((lambda () (define-record-type t (+ x) t? (x t-x)) (+ 2) 'tail))", "tail")
+	evalErrorTest("(parameterize)", "parameterize:")
+	evalErrorTest("(parameterize ((1 2)) 3)", "parameterize:")
+	evalErrorTest("(define-syntax)", "define-syntax:")
+	evalErrorTest("(define-syntax foo)", "define-syntax:")
+	evalErrorTest("(let-syntax)", "let-syntax:")
+	evalErrorTest("(define-record-type)", "define-record-type:")
+	evalTest("(let ((if vector)) (if 1 2 3))", "#(1 2 3)")
+	evalTest("((lambda (quote) (quote 1)) vector)", "#(1)")
+	evalTest("(let ((if vector)) (cond (#f 1) (else 2)))", "2")
+	evalTest("(let ((let vector) (lambda vector)) (and 1 (or #f 2)))", "2")
+	evalTest("(let ((quote vector) (begin vector) (set! vector)) `(1 ,(+ 1 1)))", "(1 2)")
+	evalTest("(let ((define vector)) (define 1 2))", "#(1 2)")
+	evalTest("(let ((when vector)) (when #f 1))", "#(#f 1)")
+	shadowEnv := testEnv()
+	evalTestIn(shadowEnv, "(define-syntax my-if (syntax-rules () ((_ c a b) (cond (c a) (else b)))))", "")
+	evalTestIn(shadowEnv, "(let ((if vector) (cond vector) (else #f)) (my-if #t 1 2))", "1")
+	evalTestIn(shadowEnv, "(define (lambda x) (vector 'not-lambda x))", "")
+	evalTestIn(shadowEnv, "(lambda 1)", "#(not-lambda 1)")
+	evalTestIn(shadowEnv, "(let ((x 1)) x)", "1")
+	evalErrorTest("(lambda (x 1) x)", "invalid parameter 1")
+	evalErrorTest("(lambda (x x) x)", "duplicate parameter x")
+	evalErrorTest("(lambda (x))", "missing parameters or body")
+
+	defineEnv := testEnv()
+	evalTestIn(defineEnv, "(define x 10)", "")
+	evalTestIn(defineEnv, "x", "10")
+	evalTestIn(defineEnv, "(define (add-x y) (+ x y))", "")
+	evalTestIn(defineEnv, "(add-x 5)", "15")
+	evalTestIn(defineEnv, "(define x 20)", "")
+	evalTestIn(defineEnv, "(add-x 5)", "25")
+	evalTestIn(defineEnv, "(define mul (lambda (a b) (* a b)))", "")
+	evalTestIn(defineEnv, "(define times mul)", "")
+	evalTestIn(defineEnv, "(procedure-name times)", "mul")
+	displayTestIn(defineEnv, "add-x", "#<procedure:add-x (1)>")
+	evalTestIn(defineEnv, "(define (answer) 42)", "")
+	evalTestIn(defineEnv, "(answer)", "42")
+	evalTestIn(defineEnv, "(set! x 30)", "")
+	evalTestIn(defineEnv, "(add-x 5)", "35")
+	evalTestIn(defineEnv, "(define (make-counter) ((lambda (n) (lambda () (set! n (+ n 1)) n)) 0))", "")
+	evalTestIn(defineEnv, "(define c (make-counter))", "")
+	evalTestIn(defineEnv, "(c)", "1")
+	evalTestIn(defineEnv, "(c)", "2")
+	evalTestIn(defineEnv, "((make-counter))", "1")
+	evalTestIn(defineEnv, "(define (tail x . xs) xs)", "")
+	evalTestIn(defineEnv, "(tail 1 2 3)", "(2 3)")
+	evalTestIn(defineEnv, "(define z 'outer)", "")
+	evalTestIn(defineEnv, "(define (f) (define (g) z) (define z 'inner) (g))", "")
+	evalTestIn(defineEnv, "(f)", "inner")
+	evalTestIn(defineEnv, "(let () (define (ev? n) (if (case n ((0) #t) (else #f)) #t (od? (+ n -1)))) (define (od? n) (if (case n ((0) #t) (else #f)) #f (ev? (+ n -1)))) (ev? 10))", "#t")
+	evalTestIn(defineEnv, "(letrec ((y 1)) (begin (define a y) (define b (+ a 1))) (vector a b))", "#(1 2)")
+	evalTestIn(defineEnv, "(procedure-name ((lambda () (define (inner) 1) inner)))", "inner")
+	evalTestIn(defineEnv, "z", "outer")
+	evalErrorTestIn(defineEnv, "(let () (define y z) (define z 2) y)", "z used before its initialization")
+	evalErrorTestIn(defineEnv, "((lambda (x) (define x (+ x 1)) x) 1)", "x used before its initialization")
+	evalTestIn(defineEnv, "((lambda (x) (set! x 1) x) 0)", "1")
+	evalTestIn(defineEnv, "x", "30")
+	evalErrorTestIn(defineEnv, "(set! undefined-variable 1)", "set!: unbound undefined-variable")
+	evalErrorTestIn(defineEnv, "(set! x)", "expected a name and a value")
+	evalErrorTestIn(defineEnv, "(set! 1 2)", "invalid name 1")
+	evalErrorTestIn(defineEnv, "(define x)", "expected one value for x")
+	evalErrorTestIn(defineEnv, "(define 1 2)", "invalid name 1")
+	evalErrorTestIn(defineEnv, "(define (1 x) 2)", "invalid name 1")
+	evalErrorTestIn(defineEnv, "(define (f x))", "missing parameters or body")
+
+	evalTest("(cond (#f 1) ((vector-ref #(#t) 0) 2 3) (else 4))", "3")
+	evalTest("(cond (#f 1) (else 2 4))", "4")
+	evalTest("(cond ((vector-ref #(#f 5) 1)))", "5")
+	evalTest("(cond ((vector-ref #(#f 5) 1) => (lambda (x) (* x 2))) (else 0))", "10")
+	evalTest("(cond (#f => vector) ('a => vector))", "#(a)")
+	evalTest("(let ((x 1)) (cond ((vector-ref #(#f #t) x) x)))", "1")
+	displayTest("(cond (#f 1))", "#<unspecified>")
+	displayTest("(cond)", "#<unspecified>")
+	evalErrorTest("(cond (else 1) (#t 2))", "cond: invalid else clause (else 1)")
+	evalErrorTest("(cond (1 => vector 2))", "cond: invalid => clause")
+	evalErrorTest("(cond ())", "cond: invalid syntax ()")
+	evalErrorTest("(cond 1)", "cond: invalid syntax 1")
+
+	evalTest("(case (* 2 3) ((2 3 5 7) 'prime) ((1 4 6 8 9) 'composite))", "composite")
+	evalTest("(case 'x ((a) 1) ((x y) 2 3) (else 4))", "3")
+	evalTest("(case 'z ((a) 1) (else 'other))", "other")
+	evalTest("(case #\\a ((#\\a) => char->integer) (else => vector))", "97")
+	evalTest("(case \"a\" ((a) 1) (else => vector))", "#(\"a\")")
+	evalTest("(case 100000000000000000000 ((100000000000000000000) 'big) (else 'small))", "big")
+	evalTest("(case 1.0 ((1) 'exact) ((1.0) 'inexact))", "inexact")
+	displayTest("(case 1 ((2) 'two))", "#<unspecified>")
+	evalErrorTest("(case 1 (2 'two))", "case: invalid clause (2 (quote two))")
+	evalErrorTest("(case 1 (else 1) ((1) 2))", "case: invalid else clause")
+	evalErrorTest("(case)", "case: invalid syntax (case)")
+
+	evalTest("(and)", "#t")
+	evalTest("(and 1)", "1")
+	evalTest("(and 1 2 'c)", "c")
+	evalTest("(and 1 #f (unbound-variable))", "#f")
+	evalTest("(or)", "#f")
+	evalTest("(or #f)", "#f")
+	evalTest("(or #f 2 (unbound-variable))", "2")
+	evalTest("(or #f #f)", "#f")
+	evalTest("(let ((v (vector 0))) (or (begin (vector-set! v 0 (+ (vector-ref v 0) 1)) #f) (vector-ref v 0)))", "1")
+	evalTest("(let ((x 5)) (or #f x))", "5")
+	evalErrorTest("(and 1 (unbound-variable))", "unbound unbound-variable")
+
+	evalTest("(when 1 2 3)", "3")
+	displayTest("(when #f (unbound-variable))", "#<unspecified>")
+	evalTest("(unless #f 2 3)", "3")
+	displayTest("(unless 1 (unbound-variable))", "#<unspecified>")
+	evalTest("(let ((v (vector 0 0))) (when v (vector-set! v 0 1) (vector-set! v 1 2)) v)", "#(1 2)")
+	evalErrorTest("(when #t)", "when: invalid syntax (when #t)")
+	evalErrorTest("(unless)", "unless: invalid syntax")
+
+	evalTest("(do ((vec (make-vector 5)) (i 0 (+ i 1))) ((vector-ref #(#f #f #f #f #f #t) i) vec) (vector-set! vec i i))", "#(0 1 2 3 4)")
+	evalTest("(do ((i 0 (+ i 1)) (acc 1 (* acc 2))) ((vector-ref #(#f #f #t) i) acc))", "4")
+	displayTest("(do ((i 0)) (#t))", "#<unspecified>")
+	evalTest("(do () (#t 1 2))", "2")
+	evalErrorTest("(do ((i)) (#t))", "do: invalid syntax (i)")
+	evalErrorTest("(do ((1 2)) (#t))", "do: invalid variable spec (1 2)")
+	evalErrorTest("(do ((i 0)))", "do: invalid syntax")
+	evalErrorTest("(do ((i 0)) ())", "do: invalid syntax ()")
+
+	// Tail calls run in constant space, so they get by with a small stack.
+	maxStack := debug.SetMaxStack(1 << 20)
+	tailEnv := testEnv()
+	evalTestIn(tailEnv, "(define (count-to n i) (case i ((100000) 'done) (else (count-to n (+ i 1)))))", "")
+	evalTestIn(tailEnv, "(count-to 100000 0)", "done")
+	evalTestIn(tailEnv, "(define (even? n) (if (eqv-zero? n) #t (odd? (+ n -1))))", "")
+	evalTestIn(tailEnv, "(define (odd? n) (if (eqv-zero? n) #f (even? (+ n -1))))", "")
+	evalTestIn(tailEnv, "(define (eqv-zero? n) (case n ((0) #t) (else #f)))", "")
+	evalTestIn(tailEnv, "(even? 100001)", "#f")
+	evalTestIn(tailEnv, "(let loop ((i 0)) (cond ((case i ((100000) #t) (else #f)) i) (else (begin (loop (+ i 1))))))", "100000")
+	evalTestIn(tailEnv, "(do ((i 0 (+ i 1))) ((case i ((100000) #t) (else #f)) i))", "100000")
+	evalErrorTestIn(tailEnv, "(count-to 1 'x)", "1:67: cannot add non-number x")
+	debug.SetMaxStack(maxStack)
+
+	evalTest("`(1 2)", "(1 2)")
+	evalTest("`(1 ,(+ 1 1) ,@(vector->list #(3 4)) 5)", "(1 2 3 4 5)")
+	evalTest("`(1 . ,(+ 1 1))", "(1 . 2)")
+	evalTest("`(,@(vector->list #(1 2)) . ,(+ 1 2))", "(1 2 . 3)")
+	evalTest("`#(1 ,(+ 1 1) ,@(vector->list #(3)))", "#(1 2 3)")
+	evalTest("`,(+ 1 2)", "3")
+	evalTest("(let ((x 'a)) `(x ,x 'x ',x))", "(x a (quote x) (quote a))")
+	evalTest("`(1 `(2 ,(3 ,(+ 1 3))))", "(1 (quasiquote (2 (unquote (3 4)))))")
+	evalTest("`(1 `(2 ,(3 ,@(vector->list #(4 5)))))", "(1 (quasiquote (2 (unquote (3 4 5)))))")
+	evalTest("`(1 `(2 ,(3 x)))", "(1 (quasiquote (2 (unquote (3 x)))))")
+	evalTest("(let ((x '(2 3))) `(1 ,@x ,@x))", "(1 2 3 2 3)")
+	evalTest("`(1 ,@'() 2)", "(1 2)")
+	evalTest("(let ((name 'a)) `(list ,name ',name))", "(list a (quote a))")
+	evalErrorTest("`(1 ,@2 3)", "unquote-splicing: not a list: 2")
+	evalErrorTest("(quasiquote 1 2)", "quasiquote: invalid syntax")
+
+	macroEnv := testEnv()
+	evalTestIn(macroEnv, "(define-syntax swap! (syntax-rules () ((_ a b) (let ((tmp a)) (set! a b) (set! b tmp)))))", "")
+	evalTestIn(macroEnv, "(define tmp 1)", "")
+	evalTestIn(macroEnv, "(define other 2)", "")
+	evalTestIn(macroEnv, "(swap! tmp other)", "")
+	evalTestIn(macroEnv, "(vector tmp other)", "#(2 1)")
+	evalTestIn(macroEnv, "(define-syntax my-or (syntax-rules () ((_) #f) ((_ e) e) ((_ e r ...) (let ((t e)) (if t t (my-or r ...))))))", "")
+	evalTestIn(macroEnv, "(let ((t 5)) (my-or #f t))", "5")
+	evalTestIn(macroEnv, "(my-or)", "#f")
+	evalTestIn(macroEnv, "(let ((if vector)) (my-or #f 3))", "3")
+	evalTestIn(macroEnv, "(define-syntax my-cond (syntax-rules (else) ((_ (else e)) e) ((_ (c e) rest ...) (if c e (my-cond rest ...)))))", "")
+	evalTestIn(macroEnv, "(my-cond (#f 1) (else 2))", "2")
+	evalErrorTestIn(macroEnv, "(my-cond (#f 1))", "my-cond: no syntax rule matches (my-cond)")
+	evalTestIn(macroEnv, "(define-syntax my-let* (syntax-rules () ((_ () body ...) (let () body ...)) ((_ ((x v) rest ...) body ...) (let ((x v)) (my-let* (rest ...) body ...)))))", "")
+	evalTestIn(macroEnv, "(my-let* ((a 1) (b (+ a 1))) (* a b))", "2")
+	evalTestIn(macroEnv, "(define-syntax quote-all (syntax-rules () ((_ x ...) '(x ... foo #(x ...)))))", "")
+	evalTestIn(macroEnv, "(quote-all a b)", "(a b foo #(a b))")
+	evalTestIn(macroEnv, "(define-syntax template (syntax-rules () ((_ x) `(x ,x foo))))", "")
+	evalTestIn(macroEnv, "(template (+ 1 2))", "((+ 1 2) 3 foo)")
+	evalTestIn(macroEnv, "(define-syntax flatten (syntax-rules () ((_ (a b ...) ...) '(a ... (b ... ...)))))", "")
+	evalTestIn(macroEnv, "(flatten (1 2 3) (4) (5 6))", "(1 4 5 (2 3 6))")
+	evalTestIn(macroEnv, "(define-syntax tail (syntax-rules () ((_ a ... z) 'z) ((_ . rest) 'rest)))", "")
+	evalTestIn(macroEnv, "(tail 1 2 3)", "3")
+	evalTestIn(macroEnv, "(tail)", "()")
+	evalTestIn(macroEnv, "(define-syntax dotted (syntax-rules () ((_ a . b) '(a b))))", "")
+	evalTestIn(macroEnv, "(dotted 1 2 3)", "(1 (2 3))")
+	evalTestIn(macroEnv, "(define-syntax vec (syntax-rules () ((_ #(a ...)) (+ a ...))))", "")
+	evalTestIn(macroEnv, "(vec #(1 2 3))", "6")
+	evalTestIn(macroEnv, "(define-syntax lit (syntax-rules () ((_ 1 \"a\" x) 'x)))", "")
+	evalTestIn(macroEnv, "(lit 1 \"a\" yes)", "yes")
+	evalTestIn(macroEnv, "(define-syntax my-list (syntax-rules ::: () ((_ x :::) (list->vector '(x ::: ...)))))", "")
+	evalTestIn(macroEnv, "(my-list 1 2)", "#(1 2 ...)")
+	evalTestIn(macroEnv, "(define-syntax def-getter (syntax-rules () ((_ name) (define-syntax name (syntax-rules () ((_ x (... ...)) '(x (... ...))))))))", "")
+	evalTestIn(macroEnv, "(def-getter get)", "")
+	evalTestIn(macroEnv, "(get 1 2)", "(1 2)")
+	evalTestIn(macroEnv, "(define counter 0)", "")
+	evalTestIn(macroEnv, "(define-syntax bump! (syntax-rules () ((_) (set! counter (+ counter 1)))))", "")
+	evalTestIn(macroEnv, "(let ((counter 10)) (bump!) counter)", "10")
+	evalTestIn(macroEnv, "counter", "1")
+	evalTestIn(macroEnv, "(let-syntax ((foo (syntax-rules () ((_ x) (* x 2))))) (foo 21))", "42")
+	evalTestIn(macroEnv, "(letrec-syntax ((ev? (syntax-rules () ((_) #t) ((_ x . r) (od? . r)))) (od? (syntax-rules () ((_) #f) ((_ x . r) (ev? . r))))) (ev? 1 2 3))", "#f")
+	displayTestIn(macroEnv, "(let ((x 1)) (define-syntax m (syntax-rules () ((_) x))) (let ((x 2)) (m)))", "1")
+	evalErrorTestIn(macroEnv, "swap!", "invalid use of macro swap!")
+	evalTestIn(macroEnv, "(define-syntax bad (syntax-rules () ((_ x ...) x)))", "")
+	evalErrorTestIn(macroEnv, "(bad 1)", "pattern variable x used without ellipsis")
+	evalErrorTestIn(macroEnv, "(define-syntax bad (lambda (x) x))", "unsupported transformer")
+	evalErrorTestIn(macroEnv, "(define-syntax bad (syntax-rules () (x y)))", "invalid rule (x y)")
+
+	evalTestIn(macroEnv, "(define-macro (my-unless c body) `(if ,c #f ,body))", "")
+	evalTestIn(macroEnv, "(my-unless #f 'yes)", "yes")
+	evalTestIn(macroEnv, "(my-unless #t (unbound-variable))", "#f")
+	evalTestIn(macroEnv, "(defmacro my-quote (x) (vector-set! (vector 0) 0 x) `',x)", "")
+	evalTestIn(macroEnv, "(my-quote (a b))", "(a b)")
+	evalTestIn(macroEnv, "(define-macro add-one (lambda (x) `(+ ,x 1)))", "")
+	evalTestIn(macroEnv, "(add-one 41)", "42")
+	displayTestIn(macroEnv, "(let ((x 'outer)) (define-macro (get-x) 'x) (let ((x 'inner)) (get-x)))", "inner")
+	evalErrorTestIn(macroEnv, "add-one", "invalid use of macro add-one")
+	evalErrorTestIn(macroEnv, "(add-one)", "expected 1 argument, got 0, in call to add-one")
+	evalErrorTestIn(macroEnv, "(define-macro foo 1)", "define-macro: not a procedure: 1")
+	evalErrorTestIn(macroEnv, "(defmacro (foo x) x)", "defmacro: invalid syntax")
+	evalTestIn(macroEnv, "(define-macro (swap! a b) (let ((tmp (gensym))) `(let ((,tmp ,a)) (set! ,a ,b) (set! ,b ,tmp))))", "")
+	evalTestIn(macroEnv, "(let ((tmp 1) (other 2)) (swap! tmp other) (vector tmp other))", "#(2 1)")
+	evalTest("(let ((g (gensym))) (case g ((g) 'interned) (else 'uninterned)))", "uninterned")
+	evalTest("(let ((h (make-hash-table)) (a (gensym 'x)) (b (gensym 'x))) (hash-set! h a 1) (vector (hash-ref h a) (hash-ref h b 'none)))", "#(1 none)")
+	evalTest("(let ((g (generate-uninterned-symbol))) (case (vector-ref (vector g) 0) ((g) 'other) (else 'same)))", "same")
+	evalTest("(let ((g (gensym 'loop))) (eval `(let ((,g 1)) ,g) (interaction-environment)))", "1")
+	evalErrorTest("(gensym 1)", "gensym: not a string or symbol: 1")
+	evalTest("(let ((g (gensym \"x\"))) (eq? g (string->symbol (symbol->string g))))", "#f")
+	evalTest("(let ((g (gensym \"x\"))) (list (eq? g g) (equal? (list g) (list g))))", "(#t #t)")
+	evalTest("(let* ((a (gensym)) (b (string->symbol (symbol->string a)))) (eval `((lambda (,a ,b) (list ,a ,b)) 1 2) (interaction-environment)))", "(1 2)")
+	evalTest("(let ((g (gensym))) (eval `(begin (define ,g 1) (define ,(string->symbol (symbol->string g)) 2) ,g) (interaction-environment)))", "1")
+	evalTestIn(macroEnv, "(define-syntax inc! (syntax-rules () ((_ v) (let ((one 1)) (set! v (+ v one))))))", "")
+	evalTestIn(macroEnv, "(define-syntax inc-by-one! (syntax-rules () ((_ v) (inc! v))))", "")
+	evalTestIn(macroEnv, "(macroexpand-1 '(inc! x))", "(let ((one 1)) (set! x (+ x one)))")
+	evalTestIn(macroEnv, "(macroexpand-1 '(inc-by-one! x))", "(inc! x)")
+	evalTestIn(macroEnv, "(macroexpand '(inc-by-one! x))", "(let ((one 1)) (set! x (+ x one)))")
+	evalTestIn(macroEnv, "(macroexpand-1 '(add-one 1))", "(+ 1 1)")
+	evalTestIn(macroEnv, "(macroexpand '(vector (inc! x)))", "(vector (inc! x))")
+	evalTestIn(macroEnv, "(macroexpand '(let ((x 1)) x))", "(let ((x 1)) x)")
+	evalTestIn(macroEnv, "(macroexpand 'inc!)", "inc!")
+	evalTest("(macroexpand '(inc! x) (environment '(scheme base)))", "(inc! x)")
+	evalErrorTestIn(macroEnv, "(macroexpand '(inc! x y))", "inc!: no syntax rule matches (inc! x y)")
+	evalErrorTest("(macroexpand 1 2)", "macroexpand: not an environment: 2")
+
+	evalTest("(begin 1 2 3)", "3")
+	displayTest("(begin)", "#<unspecified>")
+	evalTest("(let ((v (vector 1 2))) (begin (vector-set! v 0 'a) (vector-set! v 1 'b)) v)", "#(a b)")
+	evalTest("((lambda (v) (vector-set! v 0 'x) (vector-fill! v 'y 1) v) (make-vector 3 0))", "#(x y y)")
+	evalTest("(let () (begin (define x 1) (define y 2)) (+ x y))", "3")
+
+	evalTest("(let ((x 1) (y 2)) (+ x y))", "3")
+	evalTest("(let () 1)", "1")
+	evalTest("(let ((x 1)) (let ((x 2) (y x)) y))", "1")
+	evalTest("(let* ((x 1) (y (+ x 1))) (* x y))", "2")
+	evalTest("(let* () 5)", "5")
+	evalTest("(letrec ((f (lambda (n) (if (g n) n (f 2)))) (g (lambda (n) n))) (f #f))", "2")
+	evalTest("(letrec* ((x 1) (y (+ x 1))) y)", "2")
+	evalTest("(letrec ((x 1)) (define y 2) (+ x y))", "3")
+	evalErrorTest("(letrec ((x y) (y 1)) x)", "y used before its initialization")
+	evalTest("(let loop ((i 0) (acc 1)) (if (vector-ref #(#f #f #f #t) i) acc (loop (+ i 1) (* acc 2))))", "8")
+	evalTest("(let loop ((i 0)) (if (vector-ref #(#f #f #t) i) i (loop (+ i 1))))", "2")
+	evalTest("(let f () 7)", "7")
+	evalErrorTest("(let loop ((i 0)))", "let: invalid syntax")
+	evalErrorTest("(let loop (i) i)", "let: invalid binding i")
+	evalErrorTest("(let ((x)) x)", "let: invalid binding (x)")
+	evalErrorTest("(let ((1 2)) 1)", "let: invalid binding (1 2)")
+	evalErrorTest("(let ((x 1)))", "let: invalid syntax")
+	evalErrorTest("(let* (x) x)", "let*: invalid binding x")
+
+	displayTest("vector-ref", "#<procedure:vector-ref (2)>")
+	displayTest("substring", "#<procedure:substring (2-3)>")
+	displayTest("+", "#<procedure:+ (0+)>")
+	evalTest("(procedure-name vector-ref)", "vector-ref")
+	evalTest("(procedure-name current-output-port)", "current-output-port")
+	evalTest("(procedure-name (make-parameter 1))", "#f")
+	evalTest("(procedure-arity vector-ref)", "2")
+	evalTest("(procedure-arity substring)", "(2 . 3)")
+	evalTest("(procedure-arity string=?)", "(1 . #f)")
+	evalTest("(procedure-arity (make-parameter 1))", "0")
+	evalErrorTest("(procedure-arity 1)", "not a procedure: 1")
+
+	evalTest("(call-with-values vector vector)", "#(#())")
+	evalTest("(values 1)", "1")
+	displayTest("(values 1 \"a\")", "1 \"a\"")
+	valuesEnv := testEnv()
+	valuesEnv[symbol{name: "one-two"}] = builtin{name: "one-two", f: func(args []val) val {
+		return makeValues([]val{number{1}, number{2}})
+	}}
+	valuesEnv[symbol{name: "none"}] = builtin{name: "none", f: func(args []val) val {
+		return makeValues(nil)
+	}}
+	evalTestIn(valuesEnv, "(call-with-values one-two +)", "3")
+	evalTestIn(valuesEnv, "(call-with-values one-two vector)", "#(1 2)")
+	evalTestIn(valuesEnv, "(call-with-values none vector)", "#()")
+	evalErrorTestIn(valuesEnv, "(+ (one-two) 3)", "2 values returned to a single-value context")
+	evalErrorTestIn(valuesEnv, "(if (none) 1 2)", "0 values returned")
+	evalErrorTest("(call-with-values 1 +)", "not a procedure: 1")
+
+	evalTest("(+ 1 (call/cc (lambda (k) 2)))", "3")
+	evalTest("(+ 1 (call/cc (lambda (k) (+ 10 (k 2)))))", "3")
+	evalTest("(call-with-current-continuation (lambda (k) (let loop ((i 0)) (if (vector-ref #(#f #f 7) i) (k i) (loop (+ i 1))))))", "2")
+	evalTest("(call/cc (lambda (k) (call-with-values (lambda () (k 'escaped)) vector)))", "escaped")
+	evalTest("(call/cc (lambda (outer) (+ 1 (call/cc (lambda (inner) (outer 5))))))", "5")
+	evalTest("(call-with-values (lambda () (call/cc (lambda (k) (k 1 2)))) vector)", "#(1 2)")
+	evalTest("(procedure-arity (call/cc (lambda (k) k)))", "(0 . #f)")
+	displayTest("(call/cc (lambda (k) k))", "#<continuation>")
+	evalErrorTest("((call/cc (lambda (k) k)) 1)", "cannot apply non-function 1")
+	evalTest("(let ((n 0) (k #f)) (call/cc (lambda (c) (set! k c))) (set! n (+ n 1)) (case n ((3) n) (else (k #f))))", "3")
+	evalTest("(let ((k #f)) (vector (call/cc (lambda (c) (set! k c) 1)) (case k ((#f) 'done) (else (let ((c k)) (set! k #f) (c 2))))))", "#(2 done)")
+	evalTest("(let ((h (make-hash-table))) (hash-set! h 1 2) (call-with-values (lambda () (call/cc (lambda (k) (hash-for-each h k) 'not-escaped))) vector))", "#(1 2)")
+	contEnv := testEnv()
+	evalTestIn(contEnv, "(define r #f)", "")
+	evalTestIn(contEnv, "(+ 1 (call/cc (lambda (k) (set! r k) 1)))", "2")
+	evalTestIn(contEnv, "(r 5)", "6")
+	evalTestIn(contEnv, "(vector (r 10))", "11")
+	evalErrorTest("(call/cc 1)", "call-with-current-continuation: not a procedure: 1")
+	windEnv := testEnv()
+	evalTestIn(windEnv, "(define trace '())", "")
+	evalTestIn(windEnv, "(define (note x) (set! trace `(,@trace ,x)))", "")
+	evalTestIn(windEnv, "(dynamic-wind (lambda () (note 'before)) (lambda () (note 'during) 'result) (lambda () (note 'after)))", "result")
+	evalTestIn(windEnv, "trace", "(before during after)")
+	evalTestIn(windEnv, "(set! trace '())", "")
+	evalTestIn(windEnv, "(call/cc (lambda (k) (dynamic-wind (lambda () (note 'before)) (lambda () (k 'escaped) (note 'during)) (lambda () (note 'after)))))", "escaped")
+	evalTestIn(windEnv, "trace", "(before after)")
+	evalTestIn(windEnv, "(set! trace '())", "")
+	evalErrorTestIn(windEnv, "(dynamic-wind (lambda () (note 'before)) (lambda () (unbound-variable)) (lambda () (note 'after)))", "unbound unbound-variable")
+	evalTestIn(windEnv, "trace", "(before after)")
+	evalTestIn(windEnv, "(call-with-values (lambda () (dynamic-wind vector (lambda () (values 1 2)) vector)) vector)", "#(1 2)")
+	evalErrorTest("(dynamic-wind vector 1 vector)", "dynamic-wind: not a procedure: 1")
+	evalTestIn(windEnv, "(define x 1)", "")
+	evalTestIn(windEnv, "(define (get-x) x)", "")
+	evalTestIn(windEnv, "(fluid-let ((x 2)) (get-x))", "2")
+	evalTestIn(windEnv, "x", "1")
+	evalTestIn(windEnv, "(fluid-let ((x 2) (trace '(inner))) (set! x 3) (vector (get-x) trace))", "#(3 (inner))")
+	evalTestIn(windEnv, "(vector x trace)", "#(1 (before after))")
+	evalTestIn(windEnv, "(call/cc (lambda (k) (fluid-let ((x 2)) (k (get-x)))))", "2")
+	evalTestIn(windEnv, "x", "1")
+	evalErrorTestIn(windEnv, "(fluid-let ((x 2)) (raise 'oops))", "oops")
+	evalTestIn(windEnv, "x", "1")
+	evalTestIn(windEnv, "(let ((y 1)) (define (get-y) y) (fluid-let ((y (+ y 1))) (get-y)))", "2")
+	evalErrorTestIn(windEnv, "(fluid-let ((undefined-variable 1)) 2)", "unbound undefined-variable")
+	evalErrorTestIn(windEnv, "(fluid-let ((1 2)) 3)", "fluid-let: invalid binding (1 2)")
+	evalTestIn(windEnv, "(set! trace '())", "")
+	evalTestIn(windEnv, "(let ((n 0) (k #f)) (dynamic-wind (lambda () (note 'in)) (lambda () (call/cc (lambda (c) (set! k c)))) (lambda () (note 'out))) (set! n (+ n 1)) (case n ((2) trace) (else (k #f))))", "(in out in out)")
+	evalTestIn(windEnv, "(set! trace '())", "")
+	evalTestIn(windEnv, "(dynamic-wind (lambda () (note 'outer-in)) (lambda () (call/cc (lambda (k) (dynamic-wind (lambda () (note 'inner-in)) (lambda () (k 'escaped)) (lambda () (note 'inner-out)))))) (lambda () (note 'outer-out)))", "escaped")
+	evalTestIn(windEnv, "trace", "(outer-in inner-in inner-out outer-out)")
+
+	evalTestIn(valuesEnv, "(let-values (((a b) (one-two)) ((c) (values 3))) (vector a b c))", "#(1 2 3)")
+	evalTestIn(valuesEnv, "(let-values (((a . rest) (values 1 2 3)) (all (one-two))) (vector a rest all))", "#(1 (2 3) (1 2))")
+	evalTestIn(valuesEnv, "(let ((a 'outer)) (let-values (((a) (values 1)) ((b) (values a))) (vector a b)))", "#(1 outer)")
+	evalTestIn(valuesEnv, "(let*-values (((a b) (one-two)) ((c) (values (+ a b)))) c)", "3")
+	evalTestIn(valuesEnv, "(let*-values () 4)", "4")
+	evalTestIn(valuesEnv, "(let-values ((() (none))) 5)", "5")
+	evalTestIn(valuesEnv, "(define-values (x y) (one-two))", "")
+	evalTestIn(valuesEnv, "(vector x y)", "#(1 2)")
+	evalTestIn(valuesEnv, "(define-values (p . q) (values 1 2 3))", "")
+	evalTestIn(valuesEnv, "(vector p q)", "#(1 (2 3))")
+	evalTestIn(valuesEnv, "(define (f) (define-values (a b) (values 1 (g))) (define (g) a) b)", "")
+	evalErrorTestIn(valuesEnv, "(f)", "g used before its initialization")
+	evalErrorTestIn(valuesEnv, "(let () (define (g) a) (define-values (a b) (values (g) 2)) b)", "a used before its initialization")
+	evalTestIn(valuesEnv, "(let () (define-values (a b) (one-two)) (+ a b))", "3")
+	evalErrorTestIn(valuesEnv, "(let-values (((a b) (values 1))) a)", "expected 2 arguments, got 1")
+	evalErrorTestIn(valuesEnv, "(let-values (((a 1) (values 1 2))) a)", "let-values: invalid formals (a 1)")
+	evalErrorTestIn(valuesEnv, "(let-values (((a a) (values 1 2))) a)", "let-values: duplicate name a")
+	evalErrorTestIn(valuesEnv, "(define-values (a))", "define-values: invalid syntax")
+
+	evalTest("(force (delay (+ 1 2)))", "3")
+	evalTest("(promise? (delay 1))", "#t")
+	evalTest("(promise? 1)", "#f")
+	evalTest("(force (make-promise 4))", "4")
+	evalTest("(force 5)", "5")
+	evalTest("(force (delay-force (delay-force (delay 6))))", "6")
+	displayTest("(delay (unbound-variable))", "#<promise>")
+	evalErrorTest("(force (delay (unbound-variable)))", "unbound unbound-variable")
+	evalErrorTest("(force (delay-force 1))", "not a promise")
+	promiseEnv := testEnv()
+	promiseEnv[symbol{name: "v"}] = &vector{items: []val{number{0}}}
+	evalTestIn(promiseEnv, "(promise? (make-promise (delay 1)))", "#t")
+	delayForm, _ := read("(delay (if (vector-set! v 0 (+ (vector-ref v 0) 1)) (vector-ref v 0) #f))")
+	promiseEnv[symbol{name: "p"}] = eval(promiseEnv, delayForm)
+	evalTestIn(promiseEnv, "(force p)", "1")
+	evalTestIn(promiseEnv, "(force p)", "1")
+	evalTestIn(promiseEnv, "v", "#(1)")
+
+	hashEnv := testEnv()
+	hashEnv[symbol{name: "h"}] = newHashTable(false)
+	hashEnv[symbol{name: "k"}] = list(number{1})
+	evalTestIn(hashEnv, "(hash-table? h)", "#t")
+	evalTestIn(hashEnv, "(hash-set! h 'a 1)", "")
+	evalTestIn(hashEnv, "(hash-set! h \"b\" 2)", "")
+	evalTestIn(hashEnv, "(hash-set! h '(1 2) 3)", "")
+	evalTestIn(hashEnv, "(hash-set! h 100000000000000000000 4)", "")
+	evalTestIn(hashEnv, "(hash-set! h 'a 5)", "")
+	evalTestIn(hashEnv, "(hash-ref h 'a)", "5")
+	evalTestIn(hashEnv, "(hash-ref h \"b\")", "2")
+	evalTestIn(hashEnv, "(hash-ref h (list->vector '(1 2)) 'none)", "none")
+	evalTestIn(hashEnv, "(hash-ref h (vector->list #(1 2)))", "3")
+	evalTestIn(hashEnv, "(hash-ref h (* 10000000000 10000000000))", "4")
+	evalTestIn(hashEnv, "(hash-count h)", "4")
+	evalTestIn(hashEnv, "(hash-keys h)", "(a \"b\" (1 2) 100000000000000000000)")
+	evalTestIn(hashEnv, "(hash-delete! h \"b\")", "")
+	evalTestIn(hashEnv, "(hash-keys h)", "(a (1 2) 100000000000000000000)")
+	evalTestIn(hashEnv, "(hash-set! h (list \"a\") 6)", "")
+	evalTestIn(hashEnv, "(hash-ref h '(a) 'none)", "none")
+	evalTestIn(hashEnv, "(hash-ref h (list (string #\\a)))", "6")
+	evalTestIn(hashEnv, "(hash-delete! h '(1 2))", "")
+	evalTestIn(hashEnv, "(hash-keys h)", "(a 100000000000000000000 (\"a\"))")
+	evalTest("(let ((h (make-hash-table)) (f (lambda () 1)) (g (lambda () 1))) (hash-set! h (list f) 1) (list (hash-ref h (list f)) (hash-ref h (list g) 'none)))", "(1 none)")
+	evalTest("(let ((h (make-hash-table)) (k (list 1 2))) (set-cdr! (cdr k) k) (hash-set! h k 'circular) (hash-ref h k))", "circular")
+	// The keys differ after the elements that are hashed.
+	evalTest("(let ((h (make-hash-table)) (a (make-vector 100 0)) (b (make-vector 100 0))) (vector-set! b 99 1) (hash-set! h a 'a) (hash-set! h b 'b) (hash-delete! h a) (list (hash-ref h (make-vector 100 0) 'none) (hash-ref h b) (hash-count h)))", "(none b 1)")
+	evalErrorTest("(hash-ref (make-hash-table) 'x)", "no value for key x")
+
+	eqHashEnv := testEnv()
+	eqHashEnv[symbol{name: "h"}] = newHashTable(true)
+	eqHashEnv[symbol{name: "k"}] = list(number{1})
+	evalTestIn(eqHashEnv, "(hash-set! h k 'x)", "")
+	evalTestIn(eqHashEnv, "(hash-ref h '(1) 'none)", "none")
+	evalTestIn(eqHashEnv, "(hash-ref h k)", "x")
+	// set-car! is called with every key and value.
+	evalTestIn(eqHashEnv, "(hash-for-each h set-car!)", "")
+	evalTestIn(eqHashEnv, "k", "(x)")
+	evalTest("(hash-table? (make-hash-table 'eq?))", "#t")
+	evalTest("(hash-table? '())", "#f")
+	evalErrorTest("(make-hash-table 'foo)", "unknown test foo")
+
+	evalTest(`(string-length "hello")`, "5")
+	evalTest(`(string-length "λx")`, "2")
+	evalTest(`(substring "hello world" 6 11)`, `"world"`)
+	evalTest(`(substring "hello" 2)`, `"llo"`)
+	evalTest(`(string-append)`, `""`)
+	evalTest(`(string-append "foo" "bar" "baz")`, `"foobarbaz"`)
+	evalTest(`(string-ref "aλc" 1)`, `#\λ`)
+	evalTest(`(string=? "abc" "abc" "abc")`, "#t")
+	evalTest(`(string=? "abc" "abd")`, "#f")
+	evalTest(`(string<? "abc" "abd" "b")`, "#t")
+	evalTest(`(string<? "abc" "abc")`, "#f")
+	evalTest(`(string=? "abc")`, "#t")
+	evalErrorTest(`(string=? 5)`, "string=?: not a string: 5")
+	evalErrorTest(`(string<? "b" "a" 'c)`, "string<?: not a string: c")
+	evalTest(`(string->list "abc")`, `(#\a #\b #\c)`)
+	evalTest(`(string->list "abcde" 1 3)`, `(#\b #\c)`)
+	evalTest(`(list->string '(#\a #\λ))`, `"aλ"`)
+	evalErrorTest(`(string-ref "abc" 3)`, "index out of range")
+	evalErrorTest(`(substring "abc" 2 1)`, "index out of range")
+	evalErrorTest(`(string-length 'abc)`, "not a string")
+	evalErrorTest(`(list->string '(1 2))`, "not a character")
+	evalTest(`(make-string 3 #\x)`, `"xxx"`)
+	evalTest(`(string-length (make-string 2))`, "2")
+	evalErrorTest(`(make-string -1)`, "make-string: negative length: -1")
+	evalTest(`(string #\a #\λ)`, `"aλ"`)
+	evalTest(`(string)`, `""`)
+	evalTest(`(string-copy "hello" 1 3)`, `"el"`)
+	evalTest(`(let* ((s "abc") (c (string-copy s))) (string-set! c 0 #\x) (list s c))`, `("abc" "xbc")`)
+	evalTest(`(let ((s (make-string 3 #\a))) (string-set! s 1 #\λ) s)`, `"aλa"`)
+	evalErrorTest(`(string-set! (make-string 2) 2 #\a)`, "string-set!: index out of range: 2")
+	evalErrorTest(`(string-set! 'a 0 #\a)`, "string-set!: not a string: a")
+	evalTest(`(let ((s (make-string 4 #\a))) (string-fill! s #\b 1 3) s)`, `"abba"`)
+	evalTest(`(let ((s (make-string 2 #\a))) (string-fill! s #\c) s)`, `"cc"`)
+	evalErrorTest(`(string-set! "abc" 0 #\x)`, `string-set!: immutable string: "abc"`)
+	evalErrorTest(`(string-fill! "abc" #\x)`, `string-fill!: immutable string: "abc"`)
+	evalTest(`(let ((literal (lambda () "abc"))) (guard (e (#t (literal))) (string-set! (literal) 0 #\x)))`, `"abc"`)
+	evalTest(`(let ((s (string-copy "abc"))) (string-fill! s #\x) s)`, `"xxx"`)
+	evalTest(`(let ((s (symbol->string 'abc))) (string-set! s 0 #\x) s)`, `"xbc"`)
+	evalTest(`(let ((s (read (open-input-string "\"abc\"")))) (guard (e (#t s)) (string-set! s 0 #\x)))`, `"abc"`)
+	evalTest(`(string-upcase "Hello λ")`, `"HELLO Λ"`)
+	evalTest(`(string-downcase "HeLLo")`, `"hello"`)
+	evalTest(`(string-index "hello" #\l)`, "2")
+	evalTest(`(string-index "λx" #\x)`, "1")
+	evalTest(`(string-index "hello" char-numeric?)`, "#f")
+	evalTest(`(string-index "ab1" char-numeric?)`, "2")
+	evalErrorTest(`(string-index "ab" 1)`, "string-index: not a character or procedure: 1")
+	evalTest(`(string-contains "hello world" "o w")`, "4")
+	evalTest(`(string-contains "λλx" "x")`, "2")
+	evalTest(`(string-contains "hello" "z")`, "#f")
+	evalTest(`(string-split "  a b\tc  ")`, `("a" "b" "c")`)
+	evalTest(`(string-split "a,b,,c" #\,)`, `("a" "b" "" "c")`)
+	evalTest(`(string-split "a::b" "::")`, `("a" "b")`)
+	evalErrorTest(`(string-split "a" "")`, "string-split: empty delimiter")
+	evalTest(`(string-join '("a" "b" "c"))`, `"a b c"`)
+	evalTest(`(string-join '("a" "b") ", ")`, `"a, b"`)
+	evalTest(`(string-join '())`, `""`)
+	evalErrorTest(`(string-join '("a" 1))`, "string-join: not a string: 1")
+	evalTest(`(string-trim "  a b \n")`, `"a b"`)
+	evalTest(`(string-trim-left "  a ")`, `"a "`)
+	evalTest(`(string-trim-right "  a ")`, `"  a"`)
+
+	evalTest(`(char? #\a)`, "#t")
+	evalTest(`(char? "a")`, "#f")
+	evalTest(`(char->integer #\A)`, "65")
+	evalTest(`(char->integer #\λ)`, "955")
+	evalTest(`(integer->char 955)`, `#\λ`)
+	evalTest(`(char-alphabetic? #\ä)`, "#t")
+	evalTest(`(char-alphabetic? #\1)`, "#f")
+	evalTest(`(char-numeric? #\7)`, "#t")
+	evalTest(`(char-numeric? #\x)`, "#f")
+	evalTest(`(char-upcase #\ä)`, `#\Ä`)
+	evalTest(`(char-downcase #\Λ)`, `#\λ`)
+	evalTest(`(char-upcase #\1)`, `#\1`)
+	evalErrorTest(`(integer->char #xd800)`, "not a Unicode scalar value")
+	evalErrorTest(`(char-upcase "a")`, "not a character")
+
+	evalErrorTest("foo", "unbound foo")
+	evalErrorTest("(+ 1\n   (* 2 foo))", "2:4: unbound foo")
+	evalErrorTest("(+ 1 (2 3))", "1:6: cannot apply non-function 2")
 }
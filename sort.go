@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// sortItems sorts items stably with the procedure less, which is
+// called with two items and returns whether the first must come
+// before the second.
+func sortItems(items []val, less function) {
+	sort.SliceStable(items, func(i, j int) bool {
+		return isTrue(single(less.call([]val{items[i], items[j]})))
+	})
+}
+
+// builtinSort returns a sorted copy of a list or vector.
+func builtinSort(args []val) val {
+	checkArgCount("sort", args, 2, 2)
+	less := functionArg("sort", args, 1)
+	if v, ok := args[0].(*vector); ok {
+		items := append([]val{}, v.items...)
+		sortItems(items, less)
+		return &vector{items: items}
+	}
+	if !isList(args[0]) {
+		panic(fmt.Sprintf("sort: not a list or vector: %s", args[0].pr()))
+	}
+	items := seqToSlice(args[0].(seq))
+	sortItems(items, less)
+	return list(items...)
+}
+
+// builtinSortInPlace sorts a list or vector in place.  The pairs of a
+// list stay where they are, and get the items in sorted order.
+func builtinSortInPlace(args []val) val {
+	checkArgCount("sort!", args, 2, 2)
+	less := functionArg("sort!", args, 1)
+	if v, ok := args[0].(*vector); ok {
+		sortItems(v.items, less)
+		return v
+	}
+	if !isList(args[0]) {
+		panic(fmt.Sprintf("sort!: not a list or vector: %s", args[0].pr()))
+	}
+	items := seqToSlice(args[0].(seq))
+	sortItems(items, less)
+	l := args[0]
+	for _, item := range items {
+		l.(*cons).car = item
+		l = l.(*cons).cdr
+	}
+	return args[0]
+}
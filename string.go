@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+func builtinStringLength(args []val) val {
+	checkArgCount("string-length", args, 1, 1)
+	return number{int64(len([]rune(stringArg("string-length", args, 0))))}
+}
+
+// substringArgs returns the runes of the string argument at index i,
+// restricted to the optional start and end arguments following it.
+func substringArgs(name string, args []val, i int) []rune {
+	rs := []rune(stringArg(name, args, i))
+	start, end := rangeArgs(name, len(rs), args, i+1)
+	return rs[start:end]
+}
+
+func strArg(name string, args []val, i int) str {
+	s, ok := args[i].(str)
+	if !ok {
+		panic(fmt.Sprintf("%s: not a string: %s", name, args[i].pr()))
+	}
+	return s
+}
+
+// mutableStrArg is like strArg, but it also checks that the string can
+// be changed.
+func mutableStrArg(name string, args []val, i int) str {
+	s := strArg(name, args, i)
+	if s.immutable {
+		panic(fmt.Sprintf("%s: immutable string: %s", name, s.pr()))
+	}
+	return s
+}
+
+func builtinSubstring(args []val) val {
+	checkArgCount("substring", args, 2, 3)
+	return newStr(string(substringArgs("substring", args, 0)))
+}
+
+func builtinStringAppend(args []val) val {
+	var b strings.Builder
+	for i := range args {
+		b.WriteString(stringArg("string-append", args, i))
+	}
+	return newStr(b.String())
+}
+
+func builtinStringRef(args []val) val {
+	checkArgCount("string-ref", args, 2, 2)
+	rs := []rune(stringArg("string-ref", args, 0))
+	return char{rs[indexArg("string-ref", args, 1, len(rs)-1)]}
+}
+
+// compareStrings checks whether cmp holds for every pair of adjacent
+// string arguments.
+func compareStrings(name string, args []val, cmp func(string, string) bool) val {
+	checkArgCount(name, args, 1, -1)
+	for i := range args {
+		stringArg(name, args, i)
+	}
+	for i := 1; i < len(args); i++ {
+		if !cmp(stringArg(name, args, i-1), stringArg(name, args, i)) {
+			return boolean{false}
+		}
+	}
+	return boolean{true}
+}
+
+func builtinStringEqual(args []val) val {
+	return compareStrings("string=?", args, func(a, b string) bool { return a == b })
+}
+
+func builtinStringLess(args []val) val {
+	return compareStrings("string<?", args, func(a, b string) bool { return a < b })
+}
+
+func builtinStringToList(args []val) val {
+	checkArgCount("string->list", args, 1, 3)
+	chars := []val{}
+	for _, r := range substringArgs("string->list", args, 0) {
+		chars = append(chars, char{r})
+	}
+	return list(chars...)
+}
+
+func builtinListToString(args []val) val {
+	checkArgCount("list->string", args, 1, 1)
+	items := listArg("list->string", args, 0)
+	rs := make([]rune, len(items))
+	for i := range items {
+		rs[i] = charArg("list->string", items, i)
+	}
+	return newStr(string(rs))
+}
+
+func builtinMakeString(args []val) val {
+	checkArgCount("make-string", args, 1, 2)
+	n := intArg("make-string", args, 0)
+	if n < 0 {
+		panic(fmt.Sprintf("make-string: negative length: %d", n))
+	}
+	fill := ' '
+	if len(args) == 2 {
+		fill = charArg("make-string", args, 1)
+	}
+	return newStr(strings.Repeat(string(fill), int(n)))
+}
+
+func builtinString(args []val) val {
+	rs := make([]rune, len(args))
+	for i := range args {
+		rs[i] = charArg("string", args, i)
+	}
+	return newStr(string(rs))
+}
+
+func builtinStringCopy(args []val) val {
+	checkArgCount("string-copy", args, 1, 3)
+	return newStr(string(substringArgs("string-copy", args, 0)))
+}
+
+func builtinStringSet(args []val) val {
+	checkArgCount("string-set!", args, 3, 3)
+	s := mutableStrArg("string-set!", args, 0)
+	rs := []rune(s.s)
+	rs[indexArg("string-set!", args, 1, len(rs)-1)] = charArg("string-set!", args, 2)
+	s.s = string(rs)
+	return unspecified{}
+}
+
+func builtinStringFill(args []val) val {
+	checkArgCount("string-fill!", args, 2, 4)
+	s := mutableStrArg("string-fill!", args, 0)
+	fill := charArg("string-fill!", args, 1)
+	rs := []rune(s.s)
+	start, end := rangeArgs("string-fill!", len(rs), args, 2)
+	for i := start; i < end; i++ {
+		rs[i] = fill
+	}
+	s.s = string(rs)
+	return unspecified{}
+}
+
+func builtinStringUpcase(args []val) val {
+	checkArgCount("string-upcase", args, 1, 1)
+	return newStr(strings.ToUpper(stringArg("string-upcase", args, 0)))
+}
+
+func builtinStringDowncase(args []val) val {
+	checkArgCount("string-downcase", args, 1, 1)
+	return newStr(strings.ToLower(stringArg("string-downcase", args, 0)))
+}
+
+// builtinStringIndex returns the index of the first character of a
+// string that is a given character, or for which a given predicate
+// returns true, or #f if there's none.
+func builtinStringIndex(args []val) val {
+	checkArgCount("string-index", args, 2, 2)
+	rs := []rune(stringArg("string-index", args, 0))
+	var matches func(r rune) bool
+	switch p := args[1].(type) {
+	case char:
+		matches = func(r rune) bool { return r == p.r }
+	case function:
+		matches = func(r rune) bool { return isTrue(single(p.call([]val{char{r}}))) }
+	default:
+		panic(fmt.Sprintf("string-index: not a character or procedure: %s", p.pr()))
+	}
+	for i, r := range rs {
+		if matches(r) {
+			return number{int64(i)}
+		}
+	}
+	return boolean{false}
+}
+
+// builtinStringContains returns the index at which the second string
+// first occurs in the first one, or #f if it doesn't.
+func builtinStringContains(args []val) val {
+	checkArgCount("string-contains", args, 2, 2)
+	s := stringArg("string-contains", args, 0)
+	i := strings.Index(s, stringArg("string-contains", args, 1))
+	if i < 0 {
+		return boolean{false}
+	}
+	return number{int64(len([]rune(s[:i])))}
+}
+
+// builtinStringSplit returns the list of the parts of a string that
+// are separated by a delimiter, which is a character or a string.
+// Without a delimiter, the string is split at runs of whitespace.
+func builtinStringSplit(args []val) val {
+	checkArgCount("string-split", args, 1, 2)
+	s := stringArg("string-split", args, 0)
+	var parts []string
+	if len(args) == 1 {
+		parts = strings.Fields(s)
+	} else {
+		switch d := args[1].(type) {
+		case char:
+			parts = strings.Split(s, string(d.r))
+		case str:
+			if d.s == "" {
+				panic("string-split: empty delimiter")
+			}
+			parts = strings.Split(s, d.s)
+		default:
+			panic(fmt.Sprintf("string-split: not a character or string: %s", d.pr()))
+		}
+	}
+	items := make([]val, len(parts))
+	for i, part := range parts {
+		items[i] = newStr(part)
+	}
+	return list(items...)
+}
+
+// builtinStringJoin concatenates a list of strings, separated by a
+// delimiter, which is a space unless given.
+func builtinStringJoin(args []val) val {
+	checkArgCount("string-join", args, 1, 2)
+	items := listArg("string-join", args, 0)
+	parts := make([]string, len(items))
+	for i := range items {
+		parts[i] = stringArg("string-join", items, i)
+	}
+	delimiter := " "
+	if len(args) == 2 {
+		delimiter = stringArg("string-join", args, 1)
+	}
+	return newStr(strings.Join(parts, delimiter))
+}
+
+func builtinStringTrim(args []val) val {
+	checkArgCount("string-trim", args, 1, 1)
+	return newStr(strings.TrimFunc(stringArg("string-trim", args, 0), unicode.IsSpace))
+}
+
+func builtinStringTrimLeft(args []val) val {
+	checkArgCount("string-trim-left", args, 1, 1)
+	return newStr(strings.TrimLeftFunc(stringArg("string-trim-left", args, 0), unicode.IsSpace))
+}
+
+func builtinStringTrimRight(args []val) val {
+	checkArgCount("string-trim-right", args, 1, 1)
+	return newStr(strings.TrimRightFunc(stringArg("string-trim-right", args, 0), unicode.IsSpace))
+}
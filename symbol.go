@@ -0,0 +1,69 @@
+package main
+
+import "fmt"
+
+// uninterned is the identity of an uninterned symbol, as made by
+// `gensym`.  Such a symbol is only equal to itself, even if another
+// symbol has the same name, so it can't collide with any symbol in
+// the user's code.  Its name is its prefix and a number, which are
+// only there to make it readable.  It isn't empty, because pointers
+// to distinct empty values can be equal.
+type uninterned struct {
+	_ byte
+}
+
+// gensymCounter numbers the uninterned symbols.
+var gensymCounter int
+
+// builtinGensym implements `gensym` and `generate-uninterned-symbol`,
+// which take an optional string or symbol to use as the prefix.
+func builtinGensym(args []val) val {
+	checkArgCount("gensym", args, 0, 1)
+	prefix := "g"
+	if len(args) == 1 {
+		switch a := args[0].(type) {
+		case str:
+			prefix = a.s
+		case symbol:
+			prefix = unalias(a).(symbol).name
+		default:
+			panic(fmt.Sprintf("gensym: not a string or symbol: %s", a.pr()))
+		}
+	}
+	gensymCounter++
+	return symbol{name: fmt.Sprintf("%s%d", prefix, gensymCounter), u: &uninterned{}}
+}
+
+func symbolArg(name string, args []val, i int) symbol {
+	s, ok := args[i].(symbol)
+	if !ok {
+		panic(fmt.Sprintf("%s: not a symbol: %s", name, args[i].pr()))
+	}
+	return s
+}
+
+func builtinSymbolToString(args []val) val {
+	checkArgCount("symbol->string", args, 1, 1)
+	return newStr(unalias(symbolArg("symbol->string", args, 0)).(symbol).name)
+}
+
+// builtinStringToSymbol returns the symbol with the given name.
+// Interned symbols are compared by name, so it returns an interned
+// one.
+func builtinStringToSymbol(args []val) val {
+	checkArgCount("string->symbol", args, 1, 1)
+	return symbol{name: stringArg("string->symbol", args, 0)}
+}
+
+func builtinSymbolEqual(args []val) val {
+	checkArgCount("symbol=?", args, 2, -1)
+	for i := range args {
+		symbolArg("symbol=?", args, i)
+	}
+	for _, arg := range args[1:] {
+		if arg != args[0] {
+			return boolean{false}
+		}
+	}
+	return boolean{true}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// multipleValues is the result of `values` with other than one
+// argument.  It can only be passed on to a continuation that accepts
+// multiple values, like the consumer of `call-with-values`.
+type multipleValues struct {
+	vals []val
+}
+
+func (mv *multipleValues) pr() string {
+	strs := make([]string, len(mv.vals))
+	for i, v := range mv.vals {
+		strs[i] = v.pr()
+	}
+	return strings.Join(strs, " ")
+}
+
+func (mv *multipleValues) equal(other val) bool {
+	omv, ok := other.(*multipleValues)
+	if !ok || len(mv.vals) != len(omv.vals) {
+		return false
+	}
+	for i, v := range mv.vals {
+		if !v.equal(omv.vals[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// makeValues returns vals as the result of an expression.
+func makeValues(vals []val) val {
+	if len(vals) == 1 {
+		return vals[0]
+	}
+	return &multipleValues{vals: vals}
+}
+
+// valuesOf returns the values that v stands for.
+func valuesOf(v val) []val {
+	if mv, ok := v.(*multipleValues); ok {
+		return mv.vals
+	}
+	return []val{v}
+}
+
+// single checks that v is a single value, for contexts that don't
+// accept multiple values.
+func single(v val) val {
+	if mv, ok := v.(*multipleValues); ok {
+		panic(fmt.Sprintf("%d values returned to a single-value context", len(mv.vals)))
+	}
+	return v
+}
+
+func functionArg(name string, args []val, i int) function {
+	f, ok := args[i].(function)
+	if !ok {
+		panic(fmt.Sprintf("%s: not a procedure: %s", name, args[i].pr()))
+	}
+	return f
+}
+
+func builtinValues(args []val) val {
+	return makeValues(append([]val{}, args...))
+}
+
+func builtinCallWithValues(m *machine, args []val) {
+	producer := functionArg("call-with-values", args, 0)
+	consumer := functionArg("call-with-values", args, 1)
+	m.push(&valuesFrame{consumer: consumer})
+	m.apply(producer, nil)
+}
+
+// valuesFrame applies the consumer of `call-with-values` to the values
+// of the producer.
+type valuesFrame struct {
+	consumer function
+}
+
+func (f *valuesFrame) resume(m *machine, v val) {
+	m.apply(f.consumer, valuesOf(v))
+}
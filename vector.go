@@ -0,0 +1,161 @@
+package main
+
+import "fmt"
+
+func vectorArg(name string, args []val, i int) *vector {
+	v, ok := args[i].(*vector)
+	if !ok {
+		panic(fmt.Sprintf("%s: not a vector: %s", name, args[i].pr()))
+	}
+	return v
+}
+
+func builtinVector(args []val) val {
+	return &vector{items: append([]val{}, args...)}
+}
+
+func builtinMakeVector(args []val) val {
+	checkArgCount("make-vector", args, 1, 2)
+	n := intArg("make-vector", args, 0)
+	if n < 0 {
+		panic(fmt.Sprintf("make-vector: negative length: %d", n))
+	}
+	var fill val = unspecified{}
+	if len(args) == 2 {
+		fill = args[1]
+	}
+	items := make([]val, n)
+	for i := range items {
+		items[i] = fill
+	}
+	return &vector{items: items}
+}
+
+func builtinVectorLength(args []val) val {
+	checkArgCount("vector-length", args, 1, 1)
+	return number{int64(len(vectorArg("vector-length", args, 0).items))}
+}
+
+func builtinVectorRef(args []val) val {
+	checkArgCount("vector-ref", args, 2, 2)
+	v := vectorArg("vector-ref", args, 0)
+	return v.items[indexArg("vector-ref", args, 1, len(v.items)-1)]
+}
+
+func builtinVectorSet(args []val) val {
+	checkArgCount("vector-set!", args, 3, 3)
+	v := vectorArg("vector-set!", args, 0)
+	v.items[indexArg("vector-set!", args, 1, len(v.items)-1)] = args[2]
+	return unspecified{}
+}
+
+// rangeArgs returns the optional start and end arguments at index i
+// and i+1 for a sequence of length n.  They default to 0 and n.
+func rangeArgs(name string, n int, args []val, i int) (int, int) {
+	start, end := 0, n
+	if len(args) > i {
+		start = indexArg(name, args, i, n)
+	}
+	if len(args) > i+1 {
+		end = indexArg(name, args, i+1, n)
+	}
+	if start > end {
+		panic(name + ": index out of range: start is after end")
+	}
+	return start, end
+}
+
+// vectorRange returns the items of a vector, restricted to the
+// optional start and end arguments at index i and i+1.  The result
+// shares its storage with the vector.
+func vectorRange(name string, items []val, args []val, i int) []val {
+	start, end := rangeArgs(name, len(items), args, i)
+	return items[start:end]
+}
+
+func builtinVectorToList(args []val) val {
+	checkArgCount("vector->list", args, 1, 3)
+	items := vectorArg("vector->list", args, 0).items
+	return list(vectorRange("vector->list", items, args, 1)...)
+}
+
+func builtinListToVector(args []val) val {
+	checkArgCount("list->vector", args, 1, 1)
+	return &vector{items: listArg("list->vector", args, 0)}
+}
+
+func builtinVectorFill(args []val) val {
+	checkArgCount("vector-fill!", args, 2, 4)
+	items := vectorArg("vector-fill!", args, 0).items
+	items = vectorRange("vector-fill!", items, args, 2)
+	for i := range items {
+		items[i] = args[1]
+	}
+	return unspecified{}
+}
+
+// vectorArgs returns copies of the items of the vectors from argument
+// i on.
+func vectorArgs(name string, args []val, i int) [][]val {
+	vectors := [][]val{}
+	for ; i < len(args); i++ {
+		vectors = append(vectors, append([]val{}, vectorArg(name, args, i).items...))
+	}
+	return vectors
+}
+
+// builtinVectorMap is like builtinMap, but for vectors.
+func builtinVectorMap(m *machine, args []val) {
+	mapElements(m, functionArg("vector-map", args, 0), vectorArgs("vector-map", args, 1), func(results []val) val {
+		// The results are copied, because a continuation might
+		// resume the loop again.
+		return &vector{items: append([]val{}, results...)}
+	})
+}
+
+func builtinVectorForEach(m *machine, args []val) {
+	forEachElements(m, functionArg("vector-for-each", args, 0), vectorArgs("vector-for-each", args, 1))
+}
+
+func builtinVectorCopy(args []val) val {
+	checkArgCount("vector-copy", args, 1, 3)
+	items := vectorArg("vector-copy", args, 0).items
+	return &vector{items: append([]val{}, vectorRange("vector-copy", items, args, 1)...)}
+}
+
+// builtinSubvector is like vector-copy, but the start and end are
+// required.
+func builtinSubvector(args []val) val {
+	checkArgCount("subvector", args, 3, 3)
+	items := vectorArg("subvector", args, 0).items
+	return &vector{items: append([]val{}, vectorRange("subvector", items, args, 1)...)}
+}
+
+// builtinVectorCopyInPlace copies the items of a vector, restricted
+// to the optional start and end, into another vector at an index.
+// The vectors can be the same.
+func builtinVectorCopyInPlace(args []val) val {
+	checkArgCount("vector-copy!", args, 3, 5)
+	to := vectorArg("vector-copy!", args, 0).items
+	at := indexArg("vector-copy!", args, 1, len(to))
+	from := vectorRange("vector-copy!", vectorArg("vector-copy!", args, 2).items, args, 3)
+	if len(from) > len(to)-at {
+		panic(fmt.Sprintf("vector-copy!: not enough room for %d items at %d", len(from), at))
+	}
+	copy(to[at:], from)
+	return unspecified{}
+}
+
+func builtinVectorAppend(args []val) val {
+	items := []val{}
+	for i := range args {
+		items = append(items, vectorArg("vector-append", args, i).items...)
+	}
+	return &vector{items: items}
+}
+
+func builtinVectorSortInPlace(args []val) val {
+	checkArgCount("vector-sort!", args, 2, 2)
+	sortItems(vectorArg("vector-sort!", args, 0).items, functionArg("vector-sort!", args, 1))
+	return unspecified{}
+}